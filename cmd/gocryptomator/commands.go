@@ -0,0 +1,776 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	gopath "path"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/fhilgers/gocryptomator/internal/constants"
+	"github.com/fhilgers/gocryptomator/pkg/osfs"
+	"github.com/fhilgers/gocryptomator/pkg/vault"
+)
+
+type infoJSON struct {
+	Path                string `json:"path"`
+	Format              int    `json:"format"`
+	CipherCombo         string `json:"cipherCombo"`
+	ShorteningThreshold int    `json:"shorteningThreshold"`
+	Jti                 string `json:"jti"`
+	KeyID               string `json:"keyId"`
+}
+
+type entryJSON struct {
+	Name     string      `json:"name"`
+	Type     string      `json:"type"`
+	Size     int64       `json:"size"`
+	ModTime  time.Time   `json:"modTime"`
+	Children []entryJSON `json:"children,omitempty"`
+}
+
+type problemJSON struct {
+	Path  string `json:"path"`
+	Error string `json:"error"`
+}
+
+type decryptedPathJSON struct {
+	EncryptedPath string `json:"encryptedPath"`
+	Path          string `json:"path"`
+}
+
+type resolveJSON struct {
+	Resolved []string      `json:"resolved"`
+	Problems []problemJSON `json:"problems"`
+}
+
+type normalizeJSON struct {
+	Normalized []string `json:"normalized"`
+}
+
+type checkJSON struct {
+	Directories int           `json:"directories"`
+	Files       int           `json:"files"`
+	Problems    []problemJSON `json:"problems"`
+}
+
+func newInfoJSON(path string, v *vault.Vault) infoJSON {
+	return infoJSON{
+		Path:                path,
+		Format:              v.Format,
+		CipherCombo:         v.CipherCombo,
+		ShorteningThreshold: v.ShorteningThreshold,
+		Jti:                 v.Jti,
+		KeyID:               string(v.KeyID),
+	}
+}
+
+func newEntryJSON(info fs.FileInfo) entryJSON {
+	entry := entryJSON{
+		Name:    info.Name(),
+		Type:    "file",
+		Size:    info.Size(),
+		ModTime: info.ModTime(),
+	}
+
+	switch {
+	case info.IsDir():
+		entry.Type = "dir"
+	case info.Mode()&fs.ModeSymlink != 0:
+		entry.Type = "symlink"
+	}
+
+	return entry
+}
+
+func (e entryJSON) displayName() string {
+	if e.Type == "dir" {
+		return e.Name + "/"
+	}
+
+	return e.Name
+}
+
+func runInit(o *options, args []string) error {
+	if _, err := o.parse(args, 0, 0); err != nil {
+		return err
+	}
+
+	passphrase, err := o.passphrase.read(o.stderr, "New passphrase: ", true)
+	if err != nil {
+		return err
+	}
+
+	if err := os.MkdirAll(o.vaultPath, 0o755); err != nil {
+		return err
+	}
+
+	v, err := vault.Create(osfs.New(o.vaultPath), passphrase)
+	if err != nil {
+		return err
+	}
+	defer v.Close()
+
+	if err := v.MkRootDir(); err != nil {
+		return err
+	}
+
+	info := newInfoJSON(o.vaultPath, v)
+
+	return o.output(info, func(w io.Writer) {
+		fmt.Fprintf(w, "created vault %s\n", info.Path)
+	})
+}
+
+func runInfo(o *options, args []string) error {
+	if _, err := o.parse(args, 0, 0); err != nil {
+		return err
+	}
+
+	v, _, err := o.openVault()
+	if err != nil {
+		return err
+	}
+	defer v.Close()
+
+	info := newInfoJSON(o.vaultPath, v)
+
+	return o.output(info, func(w io.Writer) {
+		fmt.Fprintf(w, "path:                 %s\n", info.Path)
+		fmt.Fprintf(w, "format:               %d\n", info.Format)
+		fmt.Fprintf(w, "cipher combo:         %s\n", info.CipherCombo)
+		fmt.Fprintf(w, "shortening threshold: %d\n", info.ShorteningThreshold)
+		fmt.Fprintf(w, "jti:                  %s\n", info.Jti)
+		fmt.Fprintf(w, "key id:               %s\n", info.KeyID)
+	})
+}
+
+func runPasswd(o *options, args []string) error {
+	var newPassphrase passphraseSource
+	newPassphrase.register(o.flags, "new-", "new passphrase")
+
+	if _, err := o.parse(args, 0, 0); err != nil {
+		return err
+	}
+
+	v, _, err := o.openVault()
+	if err != nil {
+		return err
+	}
+	defer v.Close()
+
+	passphrase, err := newPassphrase.read(o.stderr, "New passphrase: ", true)
+	if err != nil {
+		return err
+	}
+
+	return v.ChangePassphrase(passphrase)
+}
+
+func runLs(o *options, args []string) error {
+	long := o.flags.Bool("l", false, "show type, size and modification time")
+
+	rest, err := o.parse(args, 0, 1)
+	if err != nil {
+		return err
+	}
+
+	name := ""
+	if len(rest) == 1 {
+		name = rest[0]
+	}
+
+	v, _, err := o.openVault()
+	if err != nil {
+		return err
+	}
+	defer v.Close()
+
+	dirEntries, err := v.ReadDir(name)
+	if err != nil {
+		return err
+	}
+
+	entries := make([]entryJSON, 0, len(dirEntries))
+	for _, dirEntry := range dirEntries {
+		info, err := dirEntry.Info()
+		if err != nil {
+			return err
+		}
+
+		entries = append(entries, newEntryJSON(info))
+	}
+
+	return o.output(entries, func(w io.Writer) {
+		for _, entry := range entries {
+			if *long {
+				fmt.Fprintf(w, "%-7s %12d %s %s\n", entry.Type, entry.Size, entry.ModTime.Format(time.RFC3339), entry.displayName())
+			} else {
+				fmt.Fprintln(w, entry.displayName())
+			}
+		}
+	})
+}
+
+func runTree(o *options, args []string) error {
+	rest, err := o.parse(args, 0, 1)
+	if err != nil {
+		return err
+	}
+
+	name := ""
+	if len(rest) == 1 {
+		name = rest[0]
+	}
+
+	v, _, err := o.openVault()
+	if err != nil {
+		return err
+	}
+	defer v.Close()
+
+	root := entryJSON{Name: name, Type: "dir"}
+	if root.Children, err = buildTree(v, name); err != nil {
+		return err
+	}
+
+	return o.output(root, func(w io.Writer) {
+		fmt.Fprintln(w, "/"+strings.TrimPrefix(name, "/"))
+		printTree(w, root.Children, "")
+	})
+}
+
+func buildTree(v *vault.Vault, name string) ([]entryJSON, error) {
+	dirEntries, err := v.ReadDir(name)
+	if err != nil {
+		return nil, err
+	}
+
+	entries := make([]entryJSON, 0, len(dirEntries))
+	for _, dirEntry := range dirEntries {
+		info, err := dirEntry.Info()
+		if err != nil {
+			return nil, err
+		}
+
+		entry := newEntryJSON(info)
+		if info.IsDir() {
+			if entry.Children, err = buildTree(v, gopath.Join(name, info.Name())); err != nil {
+				return nil, err
+			}
+		}
+
+		entries = append(entries, entry)
+	}
+
+	return entries, nil
+}
+
+func printTree(w io.Writer, entries []entryJSON, indent string) {
+	for i, entry := range entries {
+		branch, nextIndent := "├── ", "│   "
+		if i == len(entries)-1 {
+			branch, nextIndent = "└── ", "    "
+		}
+
+		fmt.Fprintln(w, indent+branch+entry.displayName())
+		printTree(w, entry.Children, indent+nextIndent)
+	}
+}
+
+func runCat(o *options, args []string) error {
+	rest, err := o.parse(args, 1, -1)
+	if err != nil {
+		return err
+	}
+
+	v, _, err := o.openVault()
+	if err != nil {
+		return err
+	}
+	defer v.Close()
+
+	for _, name := range rest {
+		if err := copyFromVault(v, name, o.stdout); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func runPut(o *options, args []string) error {
+	force := o.flags.Bool("f", false, "overwrite an existing file")
+
+	rest, err := o.parse(args, 2, 2)
+	if err != nil {
+		return err
+	}
+	src, dst := rest[0], rest[1]
+
+	v, _, err := o.openVault()
+	if err != nil {
+		return err
+	}
+	defer v.Close()
+
+	r := o.stdin
+	if src != "-" {
+		f, err := os.Open(src)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+
+		r = f
+	}
+
+	if *force {
+		return v.ReplaceFile(dst, r)
+	}
+
+	return v.WriteFile(dst, r)
+}
+
+func runGet(o *options, args []string) error {
+	rest, err := o.parse(args, 1, 2)
+	if err != nil {
+		return err
+	}
+
+	src := rest[0]
+	dst := gopath.Base(src)
+	if len(rest) == 2 {
+		dst = rest[1]
+	}
+
+	v, _, err := o.openVault()
+	if err != nil {
+		return err
+	}
+	defer v.Close()
+
+	if dst == "-" {
+		return copyFromVault(v, src, o.stdout)
+	}
+
+	f, err := os.OpenFile(dst, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0o644)
+	if err != nil {
+		return err
+	}
+
+	if err = copyFromVault(v, src, f); err != nil {
+		f.Close()
+		os.Remove(dst)
+		return err
+	}
+
+	return f.Close()
+}
+
+func copyFromVault(v *vault.Vault, name string, w io.Writer) error {
+	r, err := v.OpenFile(name)
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+
+	_, err = io.Copy(w, r)
+
+	return err
+}
+
+func runMkdir(o *options, args []string) error {
+	parents := o.flags.Bool("p", false, "create parent directories as needed, no error if existing")
+
+	rest, err := o.parse(args, 1, -1)
+	if err != nil {
+		return err
+	}
+
+	v, _, err := o.openVault()
+	if err != nil {
+		return err
+	}
+	defer v.Close()
+
+	for _, name := range rest {
+		if !*parents {
+			if _, err := v.GetDirID(name); err == nil {
+				return fmt.Errorf("%s: %w", name, fs.ErrExist)
+			}
+
+			if err := v.Mkdir(name); err != nil {
+				return err
+			}
+
+			continue
+		}
+
+		dir := ""
+		for _, segment := range strings.Split(strings.Trim(name, "/"), "/") {
+			dir = gopath.Join(dir, segment)
+
+			if err := v.Mkdir(dir); err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+func runRm(o *options, args []string) error {
+	recursive := o.flags.Bool("r", false, "remove directories and their contents recursively")
+
+	rest, err := o.parse(args, 1, -1)
+	if err != nil {
+		return err
+	}
+
+	v, _, err := o.openVault()
+	if err != nil {
+		return err
+	}
+	defer v.Close()
+
+	for _, name := range rest {
+		if err := remove(v, name, *recursive); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func remove(v *vault.Vault, name string, recursive bool) error {
+	if _, err := v.GetDirID(name); err != nil {
+		return v.Remove(name)
+	}
+
+	if recursive {
+		return v.RemoveAll(name)
+	}
+
+	return v.Rmdir(name)
+}
+
+func runMv(o *options, args []string) error {
+	rest, err := o.parse(args, 2, 2)
+	if err != nil {
+		return err
+	}
+	src, dst := rest[0], rest[1]
+
+	v, _, err := o.openVault()
+	if err != nil {
+		return err
+	}
+	defer v.Close()
+
+	if _, err := v.GetDirID(dst); err == nil {
+		dst = gopath.Join(dst, gopath.Base(src))
+	}
+
+	return v.Rename(src, dst)
+}
+
+func runCheck(o *options, args []string) error {
+	rest, err := o.parse(args, 0, 1)
+	if err != nil {
+		return err
+	}
+
+	name := ""
+	if len(rest) == 1 {
+		name = rest[0]
+	}
+
+	v, fsys, err := o.openVaultReadOnly()
+	if err != nil {
+		return err
+	}
+	defer v.Close()
+
+	result := checkJSON{Problems: []problemJSON{}}
+	checkDir(v, fsys, name, &result)
+
+	err = o.output(result, func(w io.Writer) {
+		for _, problem := range result.Problems {
+			fmt.Fprintf(w, "%s: %s\n", problem.Path, problem.Error)
+		}
+		fmt.Fprintf(w, "checked %d directories and %d files, found %d problems\n", result.Directories, result.Files, len(result.Problems))
+	})
+	if err != nil {
+		return err
+	}
+
+	if len(result.Problems) > 0 {
+		return errSilent
+	}
+
+	return nil
+}
+
+func checkDir(v *vault.Vault, fsys *osfs.Fs, name string, result *checkJSON) {
+	report := func(name string, err error) {
+		result.Problems = append(result.Problems, problemJSON{Path: "/" + name, Error: err.Error()})
+	}
+
+	result.Directories++
+
+	dirPath, dirID, err := v.GetDirPath(name)
+	if err != nil {
+		report(name, err)
+		return
+	}
+
+	if dirID != vault.RootDirID {
+		if err := checkDirIDBackup(v, fsys, dirPath, dirID); err != nil {
+			report(name, err)
+		}
+	}
+
+	// Listing reports the sync conflicts it cannot list, which are not
+	// reported as undecryptable names again
+	conflicts := map[string]bool{}
+	v.OnConflict(func(err *vault.ConflictError) {
+		conflicts[err.Path] = true
+		report(err.Name, err)
+	})
+
+	entries, err := v.ReadDir(name)
+	if err != nil {
+		report(name, err)
+		return
+	}
+
+	// The sync conflicts it lists are found by their encrypted paths
+	listed := map[string]string{}
+	for _, entry := range entries {
+		entryName := gopath.Join(name, entry.Name())
+		if encPath, _, err := v.GetFilePath(entryName); err == nil {
+			listed[encPath] = entryName
+		}
+	}
+
+	encEntries, err := fsys.ReadDir(dirPath)
+	if err != nil {
+		report(name, err)
+		return
+	}
+
+	for _, encEntry := range encEntries {
+		encName := encEntry.Name()
+		encPath := gopath.Join(dirPath, encName)
+		if encName == constants.DirIDBackupFile || !strings.HasSuffix(encName, constants.RegularSuffix) || conflicts[encPath] {
+			continue
+		}
+
+		if _, err := v.DecryptFileName(encName, dirID); err == nil {
+			continue
+		} else if entryName, ok := listed[encPath]; ok {
+			report(entryName, errors.New("sync conflict copy, see resolve-conflicts"))
+		} else {
+			report(gopath.Join(name, encName), fmt.Errorf("undecryptable name: %w", err))
+		}
+	}
+
+	for _, entry := range entries {
+		entryName := gopath.Join(name, entry.Name())
+
+		switch {
+		case entry.IsDir():
+			checkDir(v, fsys, entryName, result)
+		case entry.Type().IsRegular():
+			result.Files++
+
+			if err := copyFromVault(v, entryName, io.Discard); err != nil {
+				report(entryName, err)
+			}
+		}
+	}
+}
+
+func runResolveConflicts(o *options, args []string) error {
+	rest, err := o.parse(args, 0, 1)
+	if err != nil {
+		return err
+	}
+
+	name := ""
+	if len(rest) == 1 {
+		name = rest[0]
+	}
+
+	v, _, err := o.openVaultLocked()
+	if err != nil {
+		return err
+	}
+	defer v.Close()
+
+	result := resolveJSON{Resolved: []string{}, Problems: []problemJSON{}}
+
+	// Copies that cannot be resolved are reported again when listing
+	problems := map[string]bool{}
+	v.OnConflict(func(err *vault.ConflictError) {
+		if !problems[err.Path] {
+			problems[err.Path] = true
+			result.Problems = append(result.Problems, problemJSON{Path: "/" + err.Name, Error: err.Error()})
+		}
+	})
+
+	// Directories are resolved before they are listed, so that the copies
+	// that are kept are walked as well
+	err = v.WalkDir(name, func(path string, d fs.DirEntry, err error) error {
+		if err != nil || !d.IsDir() {
+			return err
+		}
+
+		resolved, err := v.ResolveConflicts(path)
+		for _, name := range resolved {
+			result.Resolved = append(result.Resolved, "/"+name)
+		}
+
+		return err
+	})
+	if err != nil {
+		return err
+	}
+
+	err = o.output(result, func(w io.Writer) {
+		for _, name := range result.Resolved {
+			fmt.Fprintf(w, "resolved %s\n", name)
+		}
+		for _, problem := range result.Problems {
+			fmt.Fprintf(w, "%s: %s\n", problem.Path, problem.Error)
+		}
+	})
+	if err != nil {
+		return err
+	}
+
+	if len(result.Problems) > 0 {
+		return errSilent
+	}
+
+	return nil
+}
+
+func runNormalizeNames(o *options, args []string) error {
+	rest, err := o.parse(args, 0, 1)
+	if err != nil {
+		return err
+	}
+
+	name := ""
+	if len(rest) == 1 {
+		name = rest[0]
+	}
+
+	v, _, err := o.openVaultLocked()
+	if err != nil {
+		return err
+	}
+	defer v.Close()
+
+	result := normalizeJSON{Normalized: []string{}}
+
+	// Directories are normalized before they are listed, so that the
+	// moved directories are walked by their new names
+	err = v.WalkDir(name, func(path string, d fs.DirEntry, err error) error {
+		if err != nil || !d.IsDir() {
+			return err
+		}
+
+		normalized, err := v.NormalizeNames(path)
+		for _, name := range normalized {
+			result.Normalized = append(result.Normalized, "/"+name)
+		}
+
+		return err
+	})
+	if err != nil {
+		return err
+	}
+
+	return o.output(result, func(w io.Writer) {
+		for _, name := range result.Normalized {
+			fmt.Fprintf(w, "normalized %s\n", name)
+		}
+	})
+}
+
+func checkDirIDBackup(v *vault.Vault, fsys *osfs.Fs, dirPath, dirID string) error {
+	r, err := fsys.Open(gopath.Join(dirPath, constants.DirIDBackupFile))
+	if err != nil {
+		return fmt.Errorf("missing directory id backup: %w", err)
+	}
+	defer r.Close()
+
+	decReader, err := v.NewDecryptReader(r)
+	if err != nil {
+		return fmt.Errorf("invalid directory id backup: %w", err)
+	}
+
+	backupID, err := io.ReadAll(decReader)
+	if err != nil {
+		return fmt.Errorf("invalid directory id backup: %w", err)
+	}
+
+	if string(backupID) != dirID {
+		return fmt.Errorf("directory id backup %q does not match directory id %q", backupID, dirID)
+	}
+
+	return nil
+}
+
+func runDecryptPath(o *options, args []string) error {
+	rest, err := o.parse(args, 1, -1)
+	if err != nil {
+		return err
+	}
+
+	v, _, err := o.openVault()
+	if err != nil {
+		return err
+	}
+	defer v.Close()
+
+	encryptedPaths := make([]string, len(rest))
+	for i, encryptedPath := range rest {
+		// Paths of the local filesystem, as reported by sync clients
+		if filepath.IsAbs(encryptedPath) {
+			root, err := filepath.Abs(o.vaultPath)
+			if err != nil {
+				return err
+			}
+
+			if encryptedPath, err = filepath.Rel(root, encryptedPath); err != nil {
+				return err
+			}
+		}
+
+		encryptedPaths[i] = filepath.ToSlash(encryptedPath)
+	}
+
+	decryptedPaths, err := v.DecryptPaths(encryptedPaths)
+	if err != nil {
+		return err
+	}
+
+	paths := make([]decryptedPathJSON, len(rest))
+	for i, path := range decryptedPaths {
+		paths[i] = decryptedPathJSON{EncryptedPath: filepath.FromSlash(encryptedPaths[i]), Path: "/" + path}
+	}
+
+	return o.output(paths, func(w io.Writer) {
+		for _, path := range paths {
+			fmt.Fprintln(w, path.Path)
+		}
+	})
+}
@@ -0,0 +1,223 @@
+// Command gocryptomator manages Cryptomator vaults stored on the local
+// filesystem.
+//
+// Usage:
+//
+//	gocryptomator <command> [flags] [args]
+//
+// Every command accepts -vault (defaulting to $GOCRYPTOMATOR_VAULT), -json
+// and one of -password-env, -password-fd or -password-file. Without a
+// password source the passphrase is prompted for on the terminal.
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+
+	"github.com/fhilgers/gocryptomator/pkg/osfs"
+	"github.com/fhilgers/gocryptomator/pkg/vault"
+)
+
+const vaultEnv = "GOCRYPTOMATOR_VAULT"
+
+type command struct {
+	usage       string
+	description string
+	run         func(o *options, args []string) error
+}
+
+var commands = map[string]command{
+	"init":              {"init", "create a new vault", runInit},
+	"info":              {"info", "show the vault configuration", runInfo},
+	"passwd":            {"passwd", "change the vault passphrase", runPasswd},
+	"ls":                {"ls [-l] [path]", "list a directory", runLs},
+	"tree":              {"tree [path]", "list a directory recursively", runTree},
+	"cat":               {"cat path...", "write decrypted files to stdout", runCat},
+	"put":               {"put [-f] local|- path", "encrypt a local file into the vault", runPut},
+	"get":               {"get path [local|-]", "decrypt a file from the vault", runGet},
+	"mkdir":             {"mkdir [-p] path...", "create directories", runMkdir},
+	"rm":                {"rm [-r] path...", "remove files and directories", runRm},
+	"mv":                {"mv src dst", "move or rename a file or directory", runMv},
+	"check":             {"check [path]", "verify directory ids and file authenticity", runCheck},
+	"resolve-conflicts": {"resolve-conflicts [path]", "resolve the conflict copies of sync clients", runResolveConflicts},
+	"normalize-names":   {"normalize-names [path]", "move names that are not normalized to their normalized form", runNormalizeNames},
+	"serve":             {"serve webdav|http|sftp [flags]", "serve the vault over the network", runServe},
+	"decrypt-path":      {"decrypt-path encrypted-path...", "show the cleartext path of files in the vault directory", runDecryptPath},
+}
+
+// errSilent signals a failure that has already been reported.
+var errSilent = errors.New("silent error")
+
+type usageError struct {
+	error
+}
+
+type options struct {
+	flags *flag.FlagSet
+
+	vaultPath  string
+	json       bool
+	passphrase passphraseSource
+
+	stdin  io.Reader
+	stdout io.Writer
+	stderr io.Writer
+}
+
+func main() {
+	os.Exit(run(os.Args[1:], os.Stdin, os.Stdout, os.Stderr))
+}
+
+func run(args []string, stdin io.Reader, stdout, stderr io.Writer) int {
+	if len(args) == 0 || args[0] == "-h" || args[0] == "-help" || args[0] == "help" {
+		printUsage(stderr)
+		return 2
+	}
+
+	cmd, ok := commands[args[0]]
+	if !ok {
+		fmt.Fprintf(stderr, "gocryptomator: unknown command %q\n", args[0])
+		printUsage(stderr)
+		return 2
+	}
+
+	o := newOptions(args[0], cmd, stdin, stdout, stderr)
+
+	err := cmd.run(o, args[1:])
+
+	var uerr usageError
+	switch {
+	case err == nil:
+		return 0
+	case errors.Is(err, flag.ErrHelp):
+		return 2
+	case errors.As(err, &uerr):
+		fmt.Fprintf(stderr, "gocryptomator %s: %s\n", args[0], uerr)
+		o.flags.Usage()
+		return 2
+	case errors.Is(err, errSilent):
+		return 1
+	default:
+		o.printError(err)
+		return 1
+	}
+}
+
+func printUsage(w io.Writer) {
+	fmt.Fprintf(w, "usage: gocryptomator <command> [flags] [args]\n\ncommands:\n")
+
+	names := make([]string, 0, len(commands))
+	for name := range commands {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		fmt.Fprintf(w, "  %-32s %s\n", commands[name].usage, commands[name].description)
+	}
+}
+
+func newOptions(name string, cmd command, stdin io.Reader, stdout, stderr io.Writer) *options {
+	o := &options{
+		flags:  flag.NewFlagSet(name, flag.ContinueOnError),
+		stdin:  stdin,
+		stdout: stdout,
+		stderr: stderr,
+	}
+
+	o.flags.SetOutput(stderr)
+	o.flags.Usage = func() {
+		fmt.Fprintf(stderr, "usage: gocryptomator %s\n\n%s\n\nflags:\n", cmd.usage, cmd.description)
+		o.flags.PrintDefaults()
+	}
+
+	o.flags.StringVar(&o.vaultPath, "vault", os.Getenv(vaultEnv), "path to the vault directory (default $"+vaultEnv+")")
+	o.flags.BoolVar(&o.json, "json", false, "write machine readable json output")
+	o.passphrase.register(o.flags, "", "passphrase")
+
+	return o
+}
+
+func (o *options) parse(args []string, minArgs, maxArgs int) ([]string, error) {
+	if err := o.flags.Parse(args); err != nil {
+		return nil, err
+	}
+
+	rest := o.flags.Args()
+	if len(rest) < minArgs || (maxArgs >= 0 && len(rest) > maxArgs) {
+		return nil, usageError{errors.New("wrong number of arguments")}
+	}
+
+	if o.vaultPath == "" {
+		return nil, usageError{fmt.Errorf("no vault given, use -vault or $%s", vaultEnv)}
+	}
+
+	return rest, nil
+}
+
+func (o *options) openVault() (*vault.Vault, *osfs.Fs, error) {
+	return o.open(func(fs *osfs.Fs, passphrase string) (*vault.Vault, error) {
+		return vault.Open(fs, passphrase)
+	})
+}
+
+// openVaultReadOnly opens the vault for commands that must not modify it.
+func (o *options) openVaultReadOnly() (*vault.Vault, *osfs.Fs, error) {
+	return o.open(func(fs *osfs.Fs, passphrase string) (*vault.Vault, error) {
+		return vault.OpenReadOnly(fs, passphrase)
+	})
+}
+
+// openVaultLocked opens the vault holding its storage lock, which is
+// released when the vault is closed.
+func (o *options) openVaultLocked() (*vault.Vault, *osfs.Fs, error) {
+	return o.open(func(fs *osfs.Fs, passphrase string) (*vault.Vault, error) {
+		return vault.OpenLocked(context.Background(), fs, passphrase, vault.StorageLockOptions{})
+	})
+}
+
+func (o *options) open(open func(fs *osfs.Fs, passphrase string) (*vault.Vault, error)) (*vault.Vault, *osfs.Fs, error) {
+	passphrase, err := o.passphrase.read(o.stderr, "Passphrase: ", false)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	fs := osfs.New(o.vaultPath)
+
+	v, err := open(fs, passphrase)
+	if err != nil {
+		return nil, nil, fmt.Errorf("opening vault %s: %w", o.vaultPath, err)
+	}
+
+	return v, fs, nil
+}
+
+// output writes value as json if requested and calls text otherwise.
+func (o *options) output(value any, text func(w io.Writer)) error {
+	if !o.json {
+		text(o.stdout)
+		return nil
+	}
+
+	enc := json.NewEncoder(o.stdout)
+	enc.SetIndent("", "  ")
+
+	return enc.Encode(value)
+}
+
+func (o *options) printError(err error) {
+	if !o.json {
+		fmt.Fprintf(o.stderr, "gocryptomator %s: %s\n", o.flags.Name(), err)
+		return
+	}
+
+	json.NewEncoder(o.stderr).Encode(struct {
+		Error string `json:"error"`
+	}{err.Error()})
+}
@@ -0,0 +1,140 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/fhilgers/gocryptomator/pkg/osfs"
+	"github.com/fhilgers/gocryptomator/pkg/vault"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func runCmd(t *testing.T, stdin string, args ...string) (string, int) {
+	stdout, stderr := &bytes.Buffer{}, &bytes.Buffer{}
+
+	code := run(args, strings.NewReader(stdin), stdout, stderr)
+	if code != 0 {
+		t.Logf("%v: %s", args, stderr)
+	}
+
+	return stdout.String(), code
+}
+
+func TestCommands(t *testing.T) {
+	t.Setenv(vaultEnv, t.TempDir())
+	t.Setenv("TEST_PASSPHRASE", "secret")
+	t.Setenv("TEST_NEW_PASSPHRASE", "other")
+
+	pw := "-password-env=TEST_PASSPHRASE"
+
+	out, code := runCmd(t, "", "init", pw)
+	require.Zero(t, code)
+	assert.Contains(t, out, "created vault")
+
+	_, code = runCmd(t, "", "mkdir", pw, "-p", "a/b")
+	assert.Zero(t, code)
+
+	_, code = runCmd(t, "hello", "put", pw, "-", "a/b/file.txt")
+	assert.Zero(t, code)
+
+	_, code = runCmd(t, "again", "put", pw, "-", "a/b/file.txt")
+	assert.NotZero(t, code)
+
+	_, code = runCmd(t, "hello", "put", pw, "-f", "-", "a/b/file.txt")
+	assert.Zero(t, code)
+
+	out, code = runCmd(t, "", "cat", pw, "a/b/file.txt")
+	assert.Zero(t, code)
+	assert.Equal(t, "hello", out)
+
+	out, code = runCmd(t, "", "ls", pw, "-json", "a/b")
+	assert.Zero(t, code)
+
+	var entries []entryJSON
+	assert.NoError(t, json.Unmarshal([]byte(out), &entries))
+	assert.Len(t, entries, 1)
+	assert.Equal(t, "file.txt", entries[0].Name)
+	assert.Equal(t, int64(5), entries[0].Size)
+
+	_, code = runCmd(t, "", "mv", pw, "a/b/file.txt", "a")
+	assert.Zero(t, code)
+
+	out, code = runCmd(t, "", "tree", pw)
+	assert.Zero(t, code)
+	assert.Equal(t, "/\n└── a/\n    ├── b/\n    └── file.txt\n", out)
+
+	v, err := vault.Open(osfs.New(os.Getenv(vaultEnv)), "secret")
+	require.NoError(t, err)
+	filePath, _, err := v.GetFilePath("a/file.txt")
+	require.NoError(t, err)
+
+	out, code = runCmd(t, "", "decrypt-path", pw, filepath.Join(os.Getenv(vaultEnv), filePath))
+	assert.Zero(t, code)
+	assert.Equal(t, "/a/file.txt\n", out)
+
+	out, code = runCmd(t, "", "check", pw, "-json")
+	assert.Zero(t, code)
+
+	var result checkJSON
+	assert.NoError(t, json.Unmarshal([]byte(out), &result))
+	assert.Equal(t, 3, result.Directories)
+	assert.Equal(t, 1, result.Files)
+	assert.Empty(t, result.Problems)
+
+	// A conflict copy of a sync client is listed, but reported by check
+	content, err := os.ReadFile(filepath.Join(os.Getenv(vaultEnv), filePath))
+	require.NoError(t, err)
+	conflictPath := strings.TrimSuffix(filePath, ".c9r") + " (1).c9r"
+	require.NoError(t, os.WriteFile(filepath.Join(os.Getenv(vaultEnv), conflictPath), content, 0o644))
+
+	out, code = runCmd(t, "", "check", pw, "-json")
+	assert.NotZero(t, code)
+
+	result = checkJSON{}
+	assert.NoError(t, json.Unmarshal([]byte(out), &result))
+	assert.Equal(t, 2, result.Files)
+	require.Len(t, result.Problems, 1)
+	assert.Equal(t, "/a/file (Conflict 1).txt", result.Problems[0].Path)
+
+	out, code = runCmd(t, "", "resolve-conflicts", pw, "-json")
+	assert.Zero(t, code)
+
+	var resolved resolveJSON
+	assert.NoError(t, json.Unmarshal([]byte(out), &resolved))
+	assert.Equal(t, []string{"/a/file (Conflict 1).txt"}, resolved.Resolved)
+	assert.Empty(t, resolved.Problems)
+
+	out, code = runCmd(t, "", "check", pw, "-json")
+	assert.Zero(t, code)
+
+	out, code = runCmd(t, "", "normalize-names", pw, "-json")
+	assert.Zero(t, code)
+
+	var normalized normalizeJSON
+	assert.NoError(t, json.Unmarshal([]byte(out), &normalized))
+	assert.Empty(t, normalized.Normalized)
+
+	_, code = runCmd(t, "", "rm", pw, "a")
+	assert.NotZero(t, code, "rm without -r must fail on non empty dirs")
+
+	_, code = runCmd(t, "", "rm", pw, "-r", "a")
+	assert.Zero(t, code)
+
+	out, code = runCmd(t, "", "ls", pw)
+	assert.Zero(t, code)
+	assert.Empty(t, out)
+
+	_, code = runCmd(t, "", "passwd", pw, "-new-password-env=TEST_NEW_PASSPHRASE")
+	assert.Zero(t, code)
+
+	_, code = runCmd(t, "", "info", pw)
+	assert.NotZero(t, code)
+
+	_, code = runCmd(t, "", "info", "-password-env=TEST_NEW_PASSPHRASE")
+	assert.Zero(t, code)
+}
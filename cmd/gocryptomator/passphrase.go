@@ -0,0 +1,99 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	"golang.org/x/term"
+)
+
+type passphraseSource struct {
+	env  string
+	fd   int
+	file string
+}
+
+func (s *passphraseSource) register(flags *flag.FlagSet, prefix, what string) {
+	flags.StringVar(&s.env, prefix+"password-env", "", "read the "+what+" from the environment variable `name`")
+	flags.IntVar(&s.fd, prefix+"password-fd", -1, "read the "+what+" from the file descriptor `fd`")
+	flags.StringVar(&s.file, prefix+"password-file", "", "read the "+what+" from the file at `path`")
+}
+
+// read reads the passphrase from the configured source, falling back to a
+// terminal prompt. With confirm set, a prompted passphrase has to be entered
+// twice.
+func (s *passphraseSource) read(w io.Writer, prompt string, confirm bool) (string, error) {
+	switch {
+	case s.fd >= 0:
+		f := os.NewFile(uintptr(s.fd), "passphrase")
+		if f == nil {
+			return "", fmt.Errorf("invalid passphrase file descriptor: %d", s.fd)
+		}
+		defer f.Close()
+
+		return readPassphraseLine(f)
+	case s.file != "":
+		f, err := os.Open(s.file)
+		if err != nil {
+			return "", err
+		}
+		defer f.Close()
+
+		return readPassphraseLine(f)
+	case s.env != "":
+		passphrase, ok := os.LookupEnv(s.env)
+		if !ok {
+			return "", fmt.Errorf("environment variable %s is not set", s.env)
+		}
+
+		return passphrase, nil
+	default:
+		return promptPassphrase(w, prompt, confirm)
+	}
+}
+
+func readPassphraseLine(r io.Reader) (string, error) {
+	line, err := bufio.NewReader(r).ReadString('\n')
+	if err != nil && err != io.EOF {
+		return "", err
+	}
+
+	return strings.TrimRight(line, "\r\n"), nil
+}
+
+func promptPassphrase(w io.Writer, prompt string, confirm bool) (string, error) {
+	fd := int(os.Stdin.Fd())
+
+	if !term.IsTerminal(fd) {
+		return "", errors.New("no passphrase source, use -password-env, -password-fd or -password-file")
+	}
+
+	fmt.Fprint(w, prompt)
+	passphrase, err := term.ReadPassword(fd)
+	fmt.Fprintln(w)
+	if err != nil {
+		return "", err
+	}
+
+	if !confirm {
+		return string(passphrase), nil
+	}
+
+	fmt.Fprint(w, "Repeat "+strings.ToLower(prompt))
+	repeated, err := term.ReadPassword(fd)
+	fmt.Fprintln(w)
+	if err != nil {
+		return "", err
+	}
+
+	if string(passphrase) != string(repeated) {
+		return "", errors.New("passphrases do not match")
+	}
+
+	return string(passphrase), nil
+}
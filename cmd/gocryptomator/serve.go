@@ -0,0 +1,185 @@
+package main
+
+import (
+	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"syscall"
+
+	"github.com/fhilgers/gocryptomator/pkg/httpserver"
+	"github.com/fhilgers/gocryptomator/pkg/sftpserver"
+	"github.com/fhilgers/gocryptomator/pkg/webdavserver"
+	"golang.org/x/crypto/ssh"
+)
+
+func runServe(o *options, args []string) error {
+	if len(args) == 0 {
+		return usageError{errors.New("missing protocol")}
+	}
+
+	switch args[0] {
+	case "webdav":
+		return serveWebdav(o, args[1:])
+	case "http":
+		return serveHTTP(o, args[1:])
+	case "sftp":
+		return serveSftp(o, args[1:])
+	default:
+		return usageError{fmt.Errorf("unknown protocol %q", args[0])}
+	}
+}
+
+func serveWebdav(o *options, args []string) error {
+	addr := o.flags.String("addr", "127.0.0.1:8080", "listen on `address`")
+	user := o.flags.String("user", "", "require basic auth with this `user`")
+
+	var auth passphraseSource
+	auth.register(o.flags, "auth-", "basic auth password")
+
+	if _, err := o.parse(args, 0, 0); err != nil {
+		return err
+	}
+
+	v, _, err := o.openVault()
+	if err != nil {
+		return err
+	}
+	defer v.Close()
+
+	handler := http.Handler(webdavserver.NewHandler(v, ""))
+
+	if *user != "" {
+		password, err := auth.read(o.stderr, "Basic auth password: ", true)
+		if err != nil {
+			return err
+		}
+
+		handler = webdavserver.BasicAuth(handler, *user, password)
+	}
+
+	return listenAndServe(o, "webdav", *addr, handler)
+}
+
+func serveHTTP(o *options, args []string) error {
+	addr := o.flags.String("addr", "127.0.0.1:8080", "listen on `address`")
+
+	if _, err := o.parse(args, 0, 0); err != nil {
+		return err
+	}
+
+	v, _, err := o.openVault()
+	if err != nil {
+		return err
+	}
+	defer v.Close()
+
+	return listenAndServe(o, "http", *addr, httpserver.NewHandler(v))
+}
+
+func serveSftp(o *options, args []string) error {
+	home, _ := os.UserHomeDir()
+
+	addr := o.flags.String("addr", "127.0.0.1:2022", "listen on `address`")
+	authorizedKeysPath := o.flags.String("authorized-keys", filepath.Join(home, ".ssh", "authorized_keys"), "accept the public keys in the authorized_keys file at `path`")
+	hostKeyPath := o.flags.String("host-key", "", "read the private host key from `path` (default: generate an ephemeral key)")
+
+	if _, err := o.parse(args, 0, 0); err != nil {
+		return err
+	}
+
+	authorizedKeys, err := os.ReadFile(*authorizedKeysPath)
+	if err != nil {
+		return err
+	}
+
+	callback, err := sftpserver.AuthorizedKeys(authorizedKeys)
+	if err != nil {
+		return err
+	}
+
+	hostKey, err := loadHostKey(*hostKeyPath)
+	if err != nil {
+		return err
+	}
+
+	config := &ssh.ServerConfig{PublicKeyCallback: callback}
+	config.AddHostKey(hostKey)
+
+	v, _, err := o.openVault()
+	if err != nil {
+		return err
+	}
+	defer v.Close()
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	listener, err := net.Listen("tcp", *addr)
+	if err != nil {
+		return err
+	}
+
+	go func() {
+		<-ctx.Done()
+		listener.Close()
+	}()
+
+	fmt.Fprintf(o.stderr, "serving sftp on %s, host key %s\n", listener.Addr(), ssh.FingerprintSHA256(hostKey.PublicKey()))
+
+	if err := sftpserver.NewServer(v, config).Serve(listener); ctx.Err() == nil {
+		return err
+	}
+
+	return nil
+}
+
+func loadHostKey(path string) (ssh.Signer, error) {
+	if path == "" {
+		_, key, err := ed25519.GenerateKey(rand.Reader)
+		if err != nil {
+			return nil, err
+		}
+
+		return ssh.NewSignerFromKey(key)
+	}
+
+	pem, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	return ssh.ParsePrivateKey(pem)
+}
+
+// listenAndServe serves handler on addr until the process is interrupted.
+func listenAndServe(o *options, protocol, addr string, handler http.Handler) error {
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	listener, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+
+	server := &http.Server{Handler: handler}
+
+	go func() {
+		<-ctx.Done()
+		server.Shutdown(context.Background())
+	}()
+
+	fmt.Fprintf(o.stderr, "serving %s on http://%s\n", protocol, listener.Addr())
+
+	if err := server.Serve(listener); !errors.Is(err, http.ErrServerClosed) {
+		return err
+	}
+
+	return nil
+}
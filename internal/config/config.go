@@ -1,15 +1,30 @@
 package config
 
 import (
+	"errors"
 	"fmt"
 	"io"
 	"strings"
 
 	"github.com/fhilgers/gocryptomator/internal/constants"
+	"github.com/fhilgers/gocryptomator/internal/wipe"
 	"github.com/golang-jwt/jwt/v4"
 	"github.com/google/uuid"
 )
 
+var (
+	// ErrUnsupported is returned for vaults with a format, shortening
+	// threshold or cipher combo other than the supported ones.
+	ErrUnsupported = errors.New("config: unsupported vault")
+
+	// ErrTampered is returned by Verify if the signature does not match the
+	// keys, because the config was modified or belongs to another vault.
+	ErrTampered = errors.New("config: signature verification failed")
+
+	// ErrMalformed is returned for configs that are not a valid token.
+	ErrMalformed = errors.New("config: malformed token")
+)
+
 type keyID string
 
 func (kid keyID) Scheme() string {
@@ -42,22 +57,25 @@ func New(encKey, macKey []byte) (c Config, err error) {
 	token := jwt.NewWithClaims(jwt.SigningMethodHS256, &c)
 	token.Header[constants.ConfigKeyIDTag] = string(c.KeyID)
 
-	c.rawToken, err = token.SignedString(append(encKey, macKey...))
+	key := wipe.Concat(encKey, macKey)
+	defer wipe.Bytes(key)
+
+	c.rawToken, err = token.SignedString(key)
 
 	return
 }
 
 func (c *Config) Valid() error {
 	if c.Format != constants.ConfigVaultFormat {
-		return fmt.Errorf("unsupported vault format: %d, wanted: %d", c.Format, constants.ConfigVaultFormat)
+		return fmt.Errorf("%w: format %d, wanted: %d", ErrUnsupported, c.Format, constants.ConfigVaultFormat)
 	}
 
 	if c.ShorteningThreshold != constants.ConfigShorteningThreshold {
-		return fmt.Errorf("unsupported shortening threshold: %d, wanted: %d", c.ShorteningThreshold, constants.ConfigShorteningThreshold)
+		return fmt.Errorf("%w: shortening threshold %d, wanted: %d", ErrUnsupported, c.ShorteningThreshold, constants.ConfigShorteningThreshold)
 	}
 
 	if c.CipherCombo != constants.ConfigCipherCombo {
-		return fmt.Errorf("unsupported cipher combo: %s, wanted: %s", c.CipherCombo, constants.ConfigCipherCombo)
+		return fmt.Errorf("%w: cipher combo %s, wanted: %s", ErrUnsupported, c.CipherCombo, constants.ConfigCipherCombo)
 	}
 
 	return nil
@@ -70,10 +88,17 @@ func (c Config) Marshal(w io.Writer, encKey, macKey []byte) error {
 }
 
 func (c Config) Verify(encKey, macKey []byte) error {
+	key := wipe.Concat(encKey, macKey)
+	defer wipe.Bytes(key)
+
 	_, err := jwt.Parse(c.rawToken, func(t *jwt.Token) (interface{}, error) {
-		return append(encKey, macKey...), nil
+		return key, nil
 	})
 
+	if err != nil && !errors.Is(err, ErrUnsupported) {
+		return fmt.Errorf("%w: %v", ErrTampered, err)
+	}
+
 	return err
 }
 
@@ -84,12 +109,22 @@ func UnmarshalUnverified(r io.Reader) (c Config, err error) {
 	}
 
 	token, _, err := jwt.NewParser().ParseUnverified(string(tokenBytes), &c)
+	if err != nil {
+		err = fmt.Errorf("%w: %v", ErrMalformed, err)
+		return
+	}
 
 	if err = token.Claims.Valid(); err != nil {
 		return
 	}
 
-	c.KeyID = keyID(token.Header[constants.ConfigKeyIDTag].(string))
+	kid, ok := token.Header[constants.ConfigKeyIDTag].(string)
+	if !ok {
+		err = fmt.Errorf("%w: missing %s header", ErrMalformed, constants.ConfigKeyIDTag)
+		return
+	}
+
+	c.KeyID = keyID(kid)
 	c.rawToken = token.Raw
 
 	return
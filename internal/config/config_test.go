@@ -7,6 +7,7 @@ import (
 	"github.com/fhilgers/gocryptomator/internal/config"
 	"github.com/fhilgers/gocryptomator/internal/constants"
 	"github.com/fhilgers/gocryptomator/internal/testutils"
+	"github.com/golang-jwt/jwt/v4"
 	"github.com/stretchr/testify/assert"
 	"pgregory.net/rapid"
 )
@@ -34,3 +35,27 @@ func TestRoundTrip(t *testing.T) {
 		assert.NoError(t, err)
 	})
 }
+
+func TestErrors(t *testing.T) {
+	encKey := bytes.Repeat([]byte{1}, constants.MasterEncryptKeySize)
+	macKey := bytes.Repeat([]byte{2}, constants.MasterMacKeySize)
+
+	c, err := config.New(encKey, macKey)
+	assert.NoError(t, err)
+
+	buf := &bytes.Buffer{}
+	assert.NoError(t, c.Marshal(buf, encKey, macKey))
+	assert.ErrorIs(t, c.Verify(encKey, bytes.Repeat([]byte{3}, constants.MasterMacKeySize)), config.ErrTampered)
+
+	c.Format = 7
+	token := jwt.NewWithClaims(jwt.SigningMethodHS256, &c)
+	token.Header[constants.ConfigKeyIDTag] = string(c.KeyID)
+	raw, err := token.SignedString(append(encKey, macKey...))
+	assert.NoError(t, err)
+
+	_, err = config.UnmarshalUnverified(bytes.NewBufferString(raw))
+	assert.ErrorIs(t, err, config.ErrUnsupported)
+
+	_, err = config.UnmarshalUnverified(bytes.NewBufferString("not a token"))
+	assert.ErrorIs(t, err, config.ErrMalformed)
+}
@@ -28,6 +28,7 @@ const (
 	ContentsFile          = "contents.c9r"
 	DirFile               = "dir.c9r"
 	SymlinkFile           = "symlink.c9r"
+	DirIDBackupFile       = "dirid.c9r"
 
 	ConfigKeyIDTag            = "kid"
 	ConfigCipherCombo         = "SIV_CTRMAC"
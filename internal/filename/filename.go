@@ -8,11 +8,15 @@ import (
 	"strings"
 
 	"github.com/fhilgers/gocryptomator/internal/constants"
+	"github.com/fhilgers/gocryptomator/internal/wipe"
 	"github.com/jacobsa/crypto/siv"
 )
 
 func Encrypt(name, dirID string, encKey, macKey []byte) (string, error) {
-	encNameBytes, err := siv.Encrypt(nil, append(macKey, encKey...), []byte(name), [][]byte{[]byte(dirID)})
+	key := wipe.Concat(macKey, encKey)
+	defer wipe.Bytes(key)
+
+	encNameBytes, err := siv.Encrypt(nil, key, []byte(name), [][]byte{[]byte(dirID)})
 	if err != nil {
 		return "", err
 	}
@@ -34,7 +38,10 @@ func Decrypt(name, dirID string, encKey, macKey []byte) (string, error) {
 		return "", err
 	}
 
-	decName, err := siv.Decrypt(append(macKey, encKey...), decoded, [][]byte{[]byte(dirID)})
+	key := wipe.Concat(macKey, encKey)
+	defer wipe.Bytes(key)
+
+	decName, err := siv.Decrypt(key, decoded, [][]byte{[]byte(dirID)})
 
 	return string(decName), err
 }
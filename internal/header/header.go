@@ -8,10 +8,11 @@ import (
 	"crypto/rand"
 	"crypto/sha256"
 	"encoding/binary"
-	"fmt"
+	"errors"
 	"io"
 
 	"github.com/fhilgers/gocryptomator/internal/constants"
+	"github.com/fhilgers/gocryptomator/internal/wipe"
 )
 
 type FileHeader struct {
@@ -63,6 +64,10 @@ func New() (header FileHeader, err error) {
 	return
 }
 
+// ErrAuthentication is returned by Unmarshal if the mac of the header does
+// not match, because it was modified or belongs to another vault.
+var ErrAuthentication = errors.New("header: authentication failed")
+
 func Unmarshal(r io.Reader, encKey, macKey []byte) (header FileHeader, err error) {
 	var encHeader encryptedFileHeader
 
@@ -80,7 +85,7 @@ func Unmarshal(r io.Reader, encKey, macKey []byte) (header FileHeader, err error
 	expectedMac := hash.Sum(nil)
 
 	if !hmac.Equal(expectedMac, encHeader.Mac()) {
-		return header, fmt.Errorf("invalid hmac: wanted %s, got %s", expectedMac, encHeader.Mac())
+		return header, ErrAuthentication
 	}
 
 	block, err := aes.NewCipher(encKey)
@@ -100,7 +105,7 @@ func Unmarshal(r io.Reader, encKey, macKey []byte) (header FileHeader, err error
 }
 
 func (h FileHeader) Marshal(w io.Writer, encKey, macKey []byte) (err error) {
-	payload := append(h.Reserved, h.ContentKey...)
+	payload := wipe.Concat(h.Reserved, h.ContentKey)
 
 	block, err := aes.NewCipher(encKey)
 	if err != nil {
@@ -88,3 +88,20 @@ func TestUnmarshalReference(t *testing.T) {
 		}
 	}
 }
+
+func TestUnmarshalTampered(t *testing.T) {
+	encKey := bytes.Repeat([]byte{1}, constants.MasterEncryptKeySize)
+	macKey := bytes.Repeat([]byte{2}, constants.MasterMacKeySize)
+
+	h, err := header.New()
+	assert.NoError(t, err)
+
+	buf := &bytes.Buffer{}
+	assert.NoError(t, h.Marshal(buf, encKey, macKey))
+
+	tampered := buf.Bytes()
+	tampered[constants.HeaderNonceSize] ^= 0xFF
+
+	_, err = header.Unmarshal(bytes.NewReader(tampered), encKey, macKey)
+	assert.ErrorIs(t, err, header.ErrAuthentication)
+}
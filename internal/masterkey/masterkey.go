@@ -7,13 +7,47 @@ import (
 	"crypto/sha256"
 	"encoding/binary"
 	"encoding/json"
+	"errors"
+	"fmt"
 	"io"
 
 	aesWrap "github.com/NickBall/go-aes-key-wrap"
 	"github.com/fhilgers/gocryptomator/internal/constants"
+	"github.com/fhilgers/gocryptomator/internal/wipe"
 	"golang.org/x/crypto/scrypt"
 )
 
+var (
+	// ErrInvalidPassphrase is returned by Unmarshal if the primary key of an
+	// otherwise well-formed file cannot be unwrapped with the key derived
+	// from the passphrase. If only the hmac key fails to unwrap, the file is
+	// corrupt and a FieldError is returned instead.
+	ErrInvalidPassphrase = errors.New("masterkey: invalid passphrase")
+
+	// ErrMalformed is returned by Unmarshal for files that are not valid
+	// json and matched by every FieldError.
+	ErrMalformed = errors.New("masterkey: malformed file")
+)
+
+// FieldError is returned by Unmarshal if the json field Field is missing or
+// holds an invalid value.
+type FieldError struct {
+	Field string
+	Err   error
+}
+
+func (e *FieldError) Error() string {
+	return fmt.Sprintf("masterkey: invalid field %s: %v", e.Field, e.Err)
+}
+
+func (e *FieldError) Unwrap() error {
+	return e.Err
+}
+
+func (e *FieldError) Is(target error) bool {
+	return target == ErrMalformed
+}
+
 type MasterKey struct {
 	EncryptKey []byte
 	MacKey     []byte
@@ -42,6 +76,12 @@ func New() (m MasterKey, err error) {
 	return
 }
 
+// Wipe overwrites both keys with zeros.
+func (m MasterKey) Wipe() {
+	wipe.Bytes(m.EncryptKey)
+	wipe.Bytes(m.MacKey)
+}
+
 func (m MasterKey) Marshal(w io.Writer, passphrase string) (err error) {
 	encKey := encryptedMasterKey{
 		Version:         constants.MasterVersion,
@@ -59,6 +99,7 @@ func (m MasterKey) Marshal(w io.Writer, passphrase string) (err error) {
 	if err != nil {
 		return
 	}
+	defer wipe.Bytes(kek)
 
 	cipher, err := aes.NewCipher(kek)
 	if err != nil {
@@ -85,16 +126,16 @@ func (m MasterKey) Marshal(w io.Writer, passphrase string) (err error) {
 }
 
 func Unmarshal(r io.Reader, passphrase string) (m MasterKey, err error) {
-	encKey := &encryptedMasterKey{}
-
-	if err = json.NewDecoder(r).Decode(encKey); err != nil {
+	encKey, err := decode(r)
+	if err != nil {
 		return
 	}
 
 	kek, err := scrypt.Key([]byte(passphrase), encKey.ScryptSalt, encKey.ScryptCostParam, encKey.ScryptBlockSize, 1, constants.MasterEncryptKeySize)
 	if err != nil {
-		return
+		return m, fmt.Errorf("%w: %v", ErrMalformed, err)
 	}
+	defer wipe.Bytes(kek)
 
 	cipher, err := aes.NewCipher(kek)
 	if err != nil {
@@ -102,11 +143,72 @@ func Unmarshal(r io.Reader, passphrase string) (m MasterKey, err error) {
 	}
 
 	if m.EncryptKey, err = aesWrap.Unwrap(cipher, encKey.PrimaryMasterKey); err != nil {
-		return
+		return MasterKey{}, ErrInvalidPassphrase
 	}
+	// The passphrase unwrapped the primary key, so the hmac key is corrupt
 	if m.MacKey, err = aesWrap.Unwrap(cipher, encKey.HmacMasterKey); err != nil {
+		m.Wipe()
+		return MasterKey{}, &FieldError{Field: "hmacMasterKey", Err: errors.New("does not unwrap with the passphrase")}
+	}
+
+	hash := hmac.New(sha256.New, m.MacKey)
+	if err = binary.Write(hash, binary.BigEndian, encKey.Version); err != nil {
 		return
 	}
 
+	if !hmac.Equal(hash.Sum(nil), encKey.VersionMac) {
+		m.Wipe()
+		return MasterKey{}, &FieldError{Field: "versionMac", Err: errors.New("does not match version")}
+	}
+
+	return
+}
+
+// decode reads the fields of an encrypted masterkey one by one, so that
+// problems can be attributed to a field, and checks everything that can be
+// checked before unwrapping the keys.
+func decode(r io.Reader) (encKey encryptedMasterKey, err error) {
+	var fields map[string]json.RawMessage
+	if err = json.NewDecoder(r).Decode(&fields); err != nil {
+		return encKey, fmt.Errorf("%w: %v", ErrMalformed, err)
+	}
+
+	for _, field := range []struct {
+		name  string
+		value any
+	}{
+		{"version", &encKey.Version},
+		{"scryptSalt", &encKey.ScryptSalt},
+		{"scryptCostParam", &encKey.ScryptCostParam},
+		{"scryptBlockSize", &encKey.ScryptBlockSize},
+		{"primaryMasterKey", &encKey.PrimaryMasterKey},
+		{"hmacMasterKey", &encKey.HmacMasterKey},
+		{"versionMac", &encKey.VersionMac},
+	} {
+		raw, ok := fields[field.name]
+		if !ok {
+			return encKey, &FieldError{Field: field.name, Err: errors.New("missing")}
+		}
+
+		if err = json.Unmarshal(raw, field.value); err != nil {
+			return encKey, &FieldError{Field: field.name, Err: err}
+		}
+	}
+
+	switch {
+	case len(encKey.ScryptSalt) == 0:
+		err = &FieldError{Field: "scryptSalt", Err: errors.New("empty")}
+	case encKey.ScryptCostParam <= 1 || encKey.ScryptCostParam&(encKey.ScryptCostParam-1) != 0:
+		err = &FieldError{Field: "scryptCostParam", Err: fmt.Errorf("%d is not a power of two greater than one", encKey.ScryptCostParam)}
+	case encKey.ScryptBlockSize <= 0:
+		err = &FieldError{Field: "scryptBlockSize", Err: fmt.Errorf("%d is not positive", encKey.ScryptBlockSize)}
+	case len(encKey.PrimaryMasterKey) != constants.MasterEncryptKeySize+8:
+		err = &FieldError{Field: "primaryMasterKey", Err: fmt.Errorf("wrapped key has %d bytes, wanted: %d", len(encKey.PrimaryMasterKey), constants.MasterEncryptKeySize+8)}
+	case len(encKey.HmacMasterKey) != constants.MasterMacKeySize+8:
+		err = &FieldError{Field: "hmacMasterKey", Err: fmt.Errorf("wrapped key has %d bytes, wanted: %d", len(encKey.HmacMasterKey), constants.MasterMacKeySize+8)}
+	case len(encKey.VersionMac) != sha256.Size:
+		err = &FieldError{Field: "versionMac", Err: fmt.Errorf("has %d bytes, wanted: %d", len(encKey.VersionMac), sha256.Size)}
+	}
+
 	return
 }
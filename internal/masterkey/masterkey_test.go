@@ -87,3 +87,80 @@ func TestUnmarshalReference(t *testing.T) {
 		}
 	}
 }
+
+func TestUnmarshalErrors(t *testing.T) {
+	k, err := masterkey.New()
+	assert.NoError(t, err)
+
+	buf := &bytes.Buffer{}
+	assert.NoError(t, k.Marshal(buf, "passphrase"))
+
+	_, err = masterkey.Unmarshal(bytes.NewReader(buf.Bytes()), "wrong")
+	assert.ErrorIs(t, err, masterkey.ErrInvalidPassphrase)
+
+	_, err = masterkey.Unmarshal(strings.NewReader("{"), "passphrase")
+	assert.ErrorIs(t, err, masterkey.ErrMalformed)
+	assert.NotErrorIs(t, err, masterkey.ErrInvalidPassphrase)
+
+	for field, value := range map[string]any{
+		"version":          "999",
+		"scryptSalt":       "not base64!",
+		"scryptCostParam":  1000,
+		"scryptBlockSize":  0,
+		"primaryMasterKey": []byte{1, 2, 3},
+		"hmacMasterKey":    nil,
+		"versionMac":       make([]byte, 32),
+	} {
+		t.Run(field, func(t *testing.T) {
+			var fields map[string]any
+			assert.NoError(t, json.Unmarshal(buf.Bytes(), &fields))
+
+			if value == nil {
+				delete(fields, field)
+			} else {
+				fields[field] = value
+			}
+
+			corrupt, err := json.Marshal(fields)
+			assert.NoError(t, err)
+
+			_, err = masterkey.Unmarshal(bytes.NewReader(corrupt), "passphrase")
+			assert.ErrorIs(t, err, masterkey.ErrMalformed)
+			assert.NotErrorIs(t, err, masterkey.ErrInvalidPassphrase)
+
+			var fieldErr *masterkey.FieldError
+			if assert.ErrorAs(t, err, &fieldErr) {
+				assert.Equal(t, field, fieldErr.Field)
+			}
+		})
+	}
+}
+
+func TestUnmarshalCorruptHmacKey(t *testing.T) {
+	k, err := masterkey.New()
+	assert.NoError(t, err)
+
+	buf := &bytes.Buffer{}
+	assert.NoError(t, k.Marshal(buf, "passphrase"))
+
+	var fields map[string]any
+	assert.NoError(t, json.Unmarshal(buf.Bytes(), &fields))
+
+	// Only the hmac key is damaged, the primary key still unwraps
+	fields["hmacMasterKey"] = bytes.Repeat([]byte{7}, 40)
+
+	corrupt, err := json.Marshal(fields)
+	assert.NoError(t, err)
+
+	_, err = masterkey.Unmarshal(bytes.NewReader(corrupt), "passphrase")
+	assert.ErrorIs(t, err, masterkey.ErrMalformed)
+	assert.NotErrorIs(t, err, masterkey.ErrInvalidPassphrase)
+
+	var fieldErr *masterkey.FieldError
+	if assert.ErrorAs(t, err, &fieldErr) {
+		assert.Equal(t, "hmacMasterKey", fieldErr.Field)
+	}
+
+	_, err = masterkey.Unmarshal(bytes.NewReader(corrupt), "wrong")
+	assert.ErrorIs(t, err, masterkey.ErrInvalidPassphrase, "a wrong passphrase fails on the primary key first")
+}
@@ -5,11 +5,15 @@ import (
 	"encoding/base32"
 	"path/filepath"
 
+	"github.com/fhilgers/gocryptomator/internal/wipe"
 	"github.com/jacobsa/crypto/siv"
 )
 
 func FromDirID(dirID string, encKey, macKey []byte) (string, error) {
-	encID, err := siv.Encrypt(nil, append(macKey, encKey...), []byte(dirID), nil)
+	key := wipe.Concat(macKey, encKey)
+	defer wipe.Bytes(key)
+
+	encID, err := siv.Encrypt(nil, key, []byte(dirID), nil)
 	if err != nil {
 		return "", err
 	}
@@ -0,0 +1,29 @@
+package stream
+
+import (
+	"errors"
+	"fmt"
+)
+
+// ErrTruncated is returned for chunks too short to hold a nonce, a mac and
+// at least one byte of payload, which happens if the ciphertext was cut off.
+// Writers never write empty chunks, so Reader, SalvageReader, ReadSeeker and
+// PlaintextSize all reject them.
+var ErrTruncated = errors.New("stream: truncated ciphertext")
+
+// ErrChunkAuthentication is matched by every ChunkAuthError.
+var ErrChunkAuthentication = errors.New("stream: chunk authentication failed")
+
+// ChunkAuthError is returned for a chunk whose mac does not match, because
+// it was modified, reordered or moved from another file.
+type ChunkAuthError struct {
+	ChunkNr uint64
+}
+
+func (e *ChunkAuthError) Error() string {
+	return fmt.Sprintf("stream: authentication of chunk %d failed", e.ChunkNr)
+}
+
+func (e *ChunkAuthError) Is(target error) bool {
+	return target == ErrChunkAuthentication
+}
@@ -0,0 +1,160 @@
+package stream
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/sha256"
+	"fmt"
+	"hash"
+	"io"
+
+	"github.com/fhilgers/gocryptomator/internal/constants"
+)
+
+// SalvageMode controls what a SalvageReader emits in place of chunks that
+// fail authentication.
+type SalvageMode int
+
+const (
+	// SalvageZero replaces every unrecoverable chunk with zeros, so the
+	// output keeps the size and offsets of the original plaintext.
+	SalvageZero SalvageMode = iota
+
+	// SalvageOmit drops unrecoverable chunks from the output entirely.
+	SalvageOmit
+)
+
+// Damage describes a range of the original plaintext that could not be
+// recovered. Offset and Length always refer to the original plaintext, even
+// when the damaged range was omitted from the output.
+type Damage struct {
+	ChunkNr uint64
+	Offset  int64
+	Length  int64
+	Err     error
+}
+
+// SalvageReader decrypts a content stream like Reader, but does not abort on
+// chunks with an invalid mac. Every chunk carries its own nonce and the mac
+// only depends on the header nonce and the chunk number, so the remaining
+// chunks can still be decrypted after a damaged one.
+type SalvageReader struct {
+	block cipher.Block
+	mac   hash.Hash
+	nonce []byte
+	mode  SalvageMode
+
+	src io.Reader
+
+	unread []byte
+	buf    [constants.ChunkEncryptedSize]byte
+
+	chunkNr uint64
+	damaged []Damage
+
+	err error
+}
+
+func NewSalvageReader(src io.Reader, contentKey, nonce, macKey []byte, mode SalvageMode) (*SalvageReader, error) {
+	block, err := aes.NewCipher(contentKey)
+	if err != nil {
+		return nil, err
+	}
+	mac := hmac.New(sha256.New, macKey)
+
+	return &SalvageReader{
+		block: block,
+		mac:   mac,
+		src:   src,
+		nonce: nonce,
+		mode:  mode,
+	}, nil
+}
+
+// Damaged returns the plaintext ranges that could not be recovered so far.
+// It is complete once Read returned io.EOF.
+func (r *SalvageReader) Damaged() []Damage {
+	return r.damaged
+}
+
+func (r *SalvageReader) Read(p []byte) (int, error) {
+	for len(r.unread) == 0 {
+		if r.err != nil {
+			return 0, r.err
+		}
+		if len(p) == 0 {
+			return 0, nil
+		}
+
+		if r.err = r.readChunk(); r.err != nil && r.err != io.EOF {
+			return 0, r.err
+		}
+	}
+
+	n := copy(p, r.unread)
+	r.unread = r.unread[n:]
+
+	return n, nil
+}
+
+func (r *SalvageReader) readChunk() error {
+	in := r.buf[:]
+	n, err := io.ReadFull(r.src, in)
+
+	last := false
+	switch {
+	case err == io.EOF:
+		return io.EOF
+	case err == io.ErrUnexpectedEOF:
+		last = true
+		in = in[:n]
+	case err != nil:
+		return err
+	}
+
+	chunkNr := r.chunkNr
+	r.chunkNr++
+
+	offset := int64(chunkNr) * constants.ChunkPayloadSize
+
+	if len(in) <= constants.ChunkNonceSize+constants.ChunkMacSize {
+		r.damaged = append(r.damaged, Damage{
+			ChunkNr: chunkNr,
+			Offset:  offset,
+			Err:     fmt.Errorf("%w: chunk %d has %d bytes", ErrTruncated, chunkNr, len(in)),
+		})
+		return io.EOF
+	}
+
+	chunkNonce := in[:constants.ChunkNonceSize]
+	payload := in[constants.ChunkNonceSize : len(in)-constants.ChunkMacSize]
+	tag := in[len(in)-constants.ChunkMacSize:]
+
+	if !hmac.Equal(chunkMac(r.mac, r.nonce, chunkNr, chunkNonce, payload), tag) {
+		r.damaged = append(r.damaged, Damage{
+			ChunkNr: chunkNr,
+			Offset:  offset,
+			Length:  int64(len(payload)),
+			Err:     &ChunkAuthError{ChunkNr: chunkNr},
+		})
+
+		if r.mode == SalvageZero {
+			for i := range payload {
+				payload[i] = 0
+			}
+			r.unread = r.buf[:copy(r.buf[:], payload)]
+		}
+	} else {
+		ctr := cipher.NewCTR(r.block, chunkNonce)
+		ctr.XORKeyStream(payload, payload)
+
+		r.unread = r.buf[:copy(r.buf[:], payload)]
+	}
+
+	if last {
+		return io.EOF
+	}
+
+	return nil
+}
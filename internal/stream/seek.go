@@ -0,0 +1,182 @@
+package stream
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+
+	"github.com/fhilgers/gocryptomator/internal/constants"
+)
+
+// ReadSeeker decrypts a content stream with random access. Only the chunk
+// containing the current offset is read and authenticated.
+type ReadSeeker struct {
+	block cipher.Block
+	mac   hash.Hash
+	nonce []byte
+
+	src  io.ReadSeeker
+	base int64
+	size int64
+
+	offset int64
+
+	chunkNr int64
+	chunk   []byte
+	buf     [constants.ChunkEncryptedSize]byte
+}
+
+// NewReadSeeker returns a ReadSeeker for the content stream starting at the
+// current offset of src, which is usually right after the file header.
+func NewReadSeeker(src io.ReadSeeker, contentKey, nonce, macKey []byte) (*ReadSeeker, error) {
+	block, err := aes.NewCipher(contentKey)
+	if err != nil {
+		return nil, err
+	}
+	mac := hmac.New(sha256.New, macKey)
+
+	base, err := src.Seek(0, io.SeekCurrent)
+	if err != nil {
+		return nil, err
+	}
+
+	end, err := src.Seek(0, io.SeekEnd)
+	if err != nil {
+		return nil, err
+	}
+
+	size, err := PlaintextSize(end - base)
+	if err != nil {
+		return nil, err
+	}
+
+	return &ReadSeeker{
+		block:   block,
+		mac:     mac,
+		nonce:   nonce,
+		src:     src,
+		base:    base,
+		size:    size,
+		chunkNr: -1,
+	}, nil
+}
+
+// PlaintextSize returns the size of the plaintext of a content stream with
+// the given size. It fails for sizes that no valid stream can have.
+func PlaintextSize(size int64) (int64, error) {
+	if size < 0 {
+		return 0, fmt.Errorf("stream: invalid ciphertext size: %d", size)
+	}
+
+	nFullChunks := size / constants.ChunkEncryptedSize
+	rest := size % constants.ChunkEncryptedSize
+
+	if rest > 0 && rest <= constants.ChunkNonceSize+constants.ChunkMacSize {
+		return 0, fmt.Errorf("%w: invalid ciphertext size: %d", ErrTruncated, size)
+	}
+
+	plaintextSize := nFullChunks * constants.ChunkPayloadSize
+	if rest > 0 {
+		plaintextSize += rest - constants.ChunkNonceSize - constants.ChunkMacSize
+	}
+
+	return plaintextSize, nil
+}
+
+// Size returns the size of the plaintext.
+func (r *ReadSeeker) Size() int64 {
+	return r.size
+}
+
+// Nonce returns the header nonce the stream was opened with.
+func (r *ReadSeeker) Nonce() []byte {
+	return append([]byte(nil), r.nonce...)
+}
+
+func (r *ReadSeeker) Read(p []byte) (int, error) {
+	if r.offset >= r.size {
+		return 0, io.EOF
+	}
+	if len(p) == 0 {
+		return 0, nil
+	}
+
+	chunkNr := r.offset / constants.ChunkPayloadSize
+	if chunkNr != r.chunkNr {
+		if err := r.loadChunk(chunkNr); err != nil {
+			return 0, err
+		}
+	}
+
+	n := copy(p, r.chunk[r.offset%constants.ChunkPayloadSize:])
+	r.offset += int64(n)
+
+	return n, nil
+}
+
+func (r *ReadSeeker) Seek(offset int64, whence int) (int64, error) {
+	switch whence {
+	case io.SeekStart:
+	case io.SeekCurrent:
+		offset += r.offset
+	case io.SeekEnd:
+		offset += r.size
+	default:
+		return 0, errors.New("stream: invalid whence")
+	}
+
+	if offset < 0 {
+		return 0, errors.New("stream: negative position")
+	}
+
+	r.offset = offset
+
+	return offset, nil
+}
+
+func (r *ReadSeeker) loadChunk(chunkNr int64) error {
+	r.chunkNr = -1
+
+	if _, err := r.src.Seek(r.base+chunkNr*constants.ChunkEncryptedSize, io.SeekStart); err != nil {
+		return err
+	}
+
+	in := r.buf[:]
+	n, err := io.ReadFull(r.src, in)
+
+	switch {
+	case err == io.ErrUnexpectedEOF:
+		in = in[:n]
+	case err == io.EOF:
+		return fmt.Errorf("%w: chunk %d is missing", ErrTruncated, chunkNr)
+	case err != nil:
+		return err
+	}
+
+	if len(in) <= constants.ChunkNonceSize+constants.ChunkMacSize {
+		return fmt.Errorf("%w: chunk %d has %d bytes", ErrTruncated, chunkNr, len(in))
+	}
+
+	chunkNonce := in[:constants.ChunkNonceSize]
+	payload := in[constants.ChunkNonceSize : len(in)-constants.ChunkMacSize]
+	tag := in[len(in)-constants.ChunkMacSize:]
+
+	expectedTag := chunkMac(r.mac, r.nonce, uint64(chunkNr), chunkNonce, payload)
+
+	if !hmac.Equal(expectedTag, tag) {
+		return &ChunkAuthError{ChunkNr: uint64(chunkNr)}
+	}
+
+	ctr := cipher.NewCTR(r.block, chunkNonce)
+	ctr.XORKeyStream(payload, payload)
+
+	r.chunk = payload
+	r.chunkNr = chunkNr
+
+	return nil
+}
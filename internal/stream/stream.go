@@ -106,20 +106,18 @@ func (r *Reader) readChunk() (last bool, err error) {
 		return false, err
 	}
 
+	if len(in) <= constants.ChunkNonceSize+constants.ChunkMacSize {
+		return false, fmt.Errorf("%w: chunk %d has %d bytes", ErrTruncated, r.chunkNr, len(in))
+	}
+
 	chunkNonce := in[:constants.ChunkNonceSize]
 	payload := in[constants.ChunkNonceSize : len(in)-constants.ChunkMacSize]
 	tag := in[len(in)-constants.ChunkMacSize:]
 
-	r.mac.Reset()
-	r.mac.Write(r.nonce)
-	binary.Write(r.mac, binary.BigEndian, r.chunkNr)
-	r.mac.Write(chunkNonce)
-	r.mac.Write(payload)
-
-	expectedTag := r.mac.Sum(nil)
+	expectedTag := chunkMac(r.mac, r.nonce, r.chunkNr, chunkNonce, payload)
 
 	if !hmac.Equal(expectedTag, tag) {
-		return false, fmt.Errorf("stream: internal error: invalid hmac tag: wanted %#v, got %#v", expectedTag, tag)
+		return false, &ChunkAuthError{ChunkNr: r.chunkNr}
 	}
 
 	ctr := cipher.NewCTR(r.block, chunkNonce)
@@ -221,13 +219,7 @@ func (w *Writer) flushChunk(last bool) error {
 	ctr := cipher.NewCTR(w.block, chunkNonce)
 	ctr.XORKeyStream(payload, w.unwritten)
 
-	w.mac.Reset()
-	w.mac.Write(w.nonce)
-	binary.Write(w.mac, binary.BigEndian, w.chunkNr)
-	w.mac.Write(chunkNonce)
-	w.mac.Write(payload)
-
-	tag := w.mac.Sum(nil)
+	tag := chunkMac(w.mac, w.nonce, w.chunkNr, chunkNonce, payload)
 
 	n := copy(w.buf[0:], chunkNonce)
 	n += copy(w.buf[n:], payload)
@@ -239,3 +231,15 @@ func (w *Writer) flushChunk(last bool) error {
 	w.chunkNr++
 	return err
 }
+
+// chunkMac computes the tag of a single chunk. It binds the chunk to the
+// file via the header nonce and to its position via the chunk number.
+func chunkMac(mac hash.Hash, nonce []byte, chunkNr uint64, chunkNonce, payload []byte) []byte {
+	mac.Reset()
+	mac.Write(nonce)
+	binary.Write(mac, binary.BigEndian, chunkNr)
+	mac.Write(chunkNonce)
+	mac.Write(payload)
+
+	return mac.Sum(nil)
+}
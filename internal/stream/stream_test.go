@@ -117,3 +117,197 @@ func TestRoundTrip(t *testing.T) {
 		}
 	})
 }
+
+func encryptForTest(t assert.TestingT, src, contentKey, nonce, macKey []byte) []byte {
+	buf := &bytes.Buffer{}
+
+	w, err := stream.NewWriter(buf, contentKey, nonce, macKey)
+	assert.NoError(t, err)
+
+	_, err = w.Write(src)
+	assert.NoError(t, err)
+	assert.NoError(t, w.Close())
+
+	return buf.Bytes()
+}
+
+func TestSalvage(t *testing.T) {
+	contentKey := bytes.Repeat([]byte{1}, constants.HeaderContentKeySize)
+	macKey := bytes.Repeat([]byte{2}, constants.MasterMacKeySize)
+	nonce := bytes.Repeat([]byte{3}, constants.HeaderNonceSize)
+
+	src := make([]byte, 3*cs+100)
+	for i := range src {
+		src[i] = byte(i % 251)
+	}
+
+	ciphertext := encryptForTest(t, src, contentKey, nonce, macKey)
+	// Flip a payload byte in the second chunk
+	ciphertext[constants.ChunkEncryptedSize+constants.ChunkNonceSize+10] ^= 0xFF
+
+	reader, err := stream.NewReader(bytes.NewReader(ciphertext), contentKey, nonce, macKey)
+	assert.NoError(t, err)
+
+	_, err = io.ReadAll(reader)
+	assert.Error(t, err, "regular reader must reject the damaged chunk")
+
+	t.Run("zero", func(t *testing.T) {
+		r, err := stream.NewSalvageReader(bytes.NewReader(ciphertext), contentKey, nonce, macKey, stream.SalvageZero)
+		assert.NoError(t, err)
+
+		output, err := io.ReadAll(r)
+		assert.NoError(t, err)
+
+		expected := append([]byte{}, src...)
+		copy(expected[cs:2*cs], make([]byte, cs))
+		assert.Equal(t, expected, output)
+
+		assert.Len(t, r.Damaged(), 1)
+		assert.Equal(t, uint64(1), r.Damaged()[0].ChunkNr)
+		assert.Equal(t, int64(cs), r.Damaged()[0].Offset)
+		assert.Equal(t, int64(cs), r.Damaged()[0].Length)
+	})
+
+	t.Run("omit", func(t *testing.T) {
+		r, err := stream.NewSalvageReader(bytes.NewReader(ciphertext), contentKey, nonce, macKey, stream.SalvageOmit)
+		assert.NoError(t, err)
+
+		output, err := io.ReadAll(r)
+		assert.NoError(t, err)
+
+		expected := append(append([]byte{}, src[:cs]...), src[2*cs:]...)
+		assert.Equal(t, expected, output)
+
+		assert.Len(t, r.Damaged(), 1)
+	})
+
+	t.Run("truncated", func(t *testing.T) {
+		truncated := ciphertext[:3*constants.ChunkEncryptedSize+10]
+
+		r, err := stream.NewSalvageReader(bytes.NewReader(truncated), contentKey, nonce, macKey, stream.SalvageOmit)
+		assert.NoError(t, err)
+
+		_, err = io.ReadAll(r)
+		assert.NoError(t, err)
+
+		assert.Len(t, r.Damaged(), 2)
+		assert.Equal(t, uint64(3), r.Damaged()[1].ChunkNr)
+	})
+}
+
+func TestReadSeeker(t *testing.T) {
+	contentKey := bytes.Repeat([]byte{1}, constants.HeaderContentKeySize)
+	macKey := bytes.Repeat([]byte{2}, constants.MasterMacKeySize)
+	nonce := bytes.Repeat([]byte{3}, constants.HeaderNonceSize)
+
+	rapid.Check(t, func(t *rapid.T) {
+		length := rapid.IntRange(0, 4*cs).Draw(t, "length")
+		src := testutils.FixedSizeByteArray(length).Draw(t, "src")
+
+		prefix := []byte("header")
+		ciphertext := append(prefix, encryptForTest(t, src, contentKey, nonce, macKey)...)
+
+		file := bytes.NewReader(ciphertext)
+		_, err := file.Seek(int64(len(prefix)), io.SeekStart)
+		assert.NoError(t, err)
+
+		r, err := stream.NewReadSeeker(file, contentKey, nonce, macKey)
+		assert.NoError(t, err)
+		assert.Equal(t, int64(length), r.Size())
+
+		for i := 0; i < 5; i++ {
+			offset := rapid.IntRange(0, length).Draw(t, "offset")
+			n := rapid.IntRange(0, length-offset).Draw(t, "n")
+
+			pos, err := r.Seek(int64(offset), io.SeekStart)
+			assert.NoError(t, err)
+			assert.Equal(t, int64(offset), pos)
+
+			buf := make([]byte, n)
+			_, err = io.ReadFull(r, buf)
+			assert.NoError(t, err)
+			assert.Equal(t, src[offset:offset+n], buf)
+		}
+
+		_, err = r.Seek(0, io.SeekEnd)
+		assert.NoError(t, err)
+
+		n, err := r.Read(make([]byte, 1))
+		assert.Zero(t, n)
+		assert.Equal(t, io.EOF, err)
+	})
+}
+
+func TestPlaintextSize(t *testing.T) {
+	for _, size := range []int64{-1, 1, constants.ChunkNonceSize + constants.ChunkMacSize, constants.ChunkEncryptedSize + 10} {
+		_, err := stream.PlaintextSize(size)
+		assert.Errorf(t, err, "size %d must be rejected", size)
+	}
+
+	for ciphertextSize, plaintextSize := range map[int64]int64{
+		0:                                   0,
+		constants.ChunkEncryptedSize:        cs,
+		constants.ChunkEncryptedSize + 49:   cs + 1,
+		2 * constants.ChunkEncryptedSize:    2 * cs,
+		constants.ChunkNonceSize + 32 + 100: 100,
+	} {
+		size, err := stream.PlaintextSize(ciphertextSize)
+		assert.NoError(t, err)
+		assert.Equal(t, plaintextSize, size)
+	}
+}
+
+func TestErrors(t *testing.T) {
+	contentKey := bytes.Repeat([]byte{1}, constants.HeaderContentKeySize)
+	macKey := bytes.Repeat([]byte{2}, constants.MasterMacKeySize)
+	nonce := bytes.Repeat([]byte{3}, constants.HeaderNonceSize)
+
+	ciphertext := encryptForTest(t, make([]byte, 2*cs+100), contentKey, nonce, macKey)
+
+	damaged := append([]byte{}, ciphertext...)
+	damaged[constants.ChunkEncryptedSize+constants.ChunkNonceSize+10] ^= 0xFF
+
+	r, err := stream.NewReader(bytes.NewReader(damaged), contentKey, nonce, macKey)
+	assert.NoError(t, err)
+
+	_, err = io.ReadAll(r)
+	assert.ErrorIs(t, err, stream.ErrChunkAuthentication)
+
+	var authErr *stream.ChunkAuthError
+	if assert.ErrorAs(t, err, &authErr) {
+		assert.Equal(t, uint64(1), authErr.ChunkNr)
+	}
+
+	r, err = stream.NewReader(bytes.NewReader(ciphertext[:2*constants.ChunkEncryptedSize+10]), contentKey, nonce, macKey)
+	assert.NoError(t, err)
+
+	_, err = io.ReadAll(r)
+	assert.ErrorIs(t, err, stream.ErrTruncated)
+
+	_, err = stream.PlaintextSize(constants.ChunkEncryptedSize + 10)
+	assert.ErrorIs(t, err, stream.ErrTruncated)
+
+	// An empty final chunk is rejected everywhere, before its mac is checked
+	emptyChunk := append(encryptForTest(t, make([]byte, cs), contentKey, nonce, macKey), make([]byte, constants.ChunkNonceSize+constants.ChunkMacSize)...)
+
+	r, err = stream.NewReader(bytes.NewReader(emptyChunk), contentKey, nonce, macKey)
+	assert.NoError(t, err)
+
+	_, err = io.ReadAll(r)
+	assert.ErrorIs(t, err, stream.ErrTruncated)
+
+	salvage, err := stream.NewSalvageReader(bytes.NewReader(emptyChunk), contentKey, nonce, macKey, stream.SalvageOmit)
+	assert.NoError(t, err)
+
+	_, err = io.ReadAll(salvage)
+	assert.NoError(t, err)
+	if assert.Len(t, salvage.Damaged(), 1) {
+		assert.ErrorIs(t, salvage.Damaged()[0].Err, stream.ErrTruncated)
+	}
+
+	_, err = stream.NewReadSeeker(bytes.NewReader(emptyChunk), contentKey, nonce, macKey)
+	assert.ErrorIs(t, err, stream.ErrTruncated)
+
+	_, err = stream.PlaintextSize(int64(len(emptyChunk)))
+	assert.ErrorIs(t, err, stream.ErrTruncated)
+}
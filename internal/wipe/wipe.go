@@ -0,0 +1,18 @@
+// Package wipe overwrites key material that is no longer needed.
+package wipe
+
+// Bytes sets every byte of b to zero.
+func Bytes(b []byte) {
+	for i := range b {
+		b[i] = 0
+	}
+}
+
+// Concat returns a new slice holding a followed by b. Unlike append, it
+// never writes into the backing array of a, so the result can be wiped
+// without touching a.
+func Concat(a, b []byte) []byte {
+	c := make([]byte, 0, len(a)+len(b))
+
+	return append(append(c, a...), b...)
+}
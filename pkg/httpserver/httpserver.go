@@ -0,0 +1,214 @@
+// Package httpserver serves the files of an unlocked vault read-only over
+// HTTP.
+package httpserver
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"html/template"
+	"io/fs"
+	"net/http"
+	"net/url"
+	gopath "path"
+	"strings"
+	"time"
+
+	"github.com/fhilgers/gocryptomator/pkg/vault"
+)
+
+// Handler serves decrypted files with support for range and conditional
+// requests. Directories are served as an html index page, or as a json
+// listing if the client accepts application/json or the query contains
+// format=json.
+type Handler struct {
+	v *vault.Vault
+}
+
+func NewHandler(v *vault.Vault) *Handler {
+	return &Handler{v: v}
+}
+
+type entryJSON struct {
+	Name    string    `json:"name"`
+	Type    string    `json:"type"`
+	Size    int64     `json:"size"`
+	ModTime time.Time `json:"modTime"`
+}
+
+var indexTemplate = template.Must(template.New("index").Parse(`<!DOCTYPE html>
+<html>
+<head><meta charset="utf-8"><title>Index of {{.Path}}</title></head>
+<body>
+<h1>Index of {{.Path}}</h1>
+<table>
+<tr><th>Name</th><th>Size</th><th>Modified</th></tr>
+{{- if ne .Path "/"}}
+<tr><td><a href="../">../</a></td><td></td><td></td></tr>
+{{- end}}
+{{- range .Entries}}
+<tr><td><a href="{{.Href}}">{{.Name}}</a></td><td>{{if not .IsDir}}{{.Size}}{{end}}</td><td>{{.ModTime.UTC.Format "2006-01-02 15:04:05"}}</td></tr>
+{{- end}}
+</table>
+</body>
+</html>
+`))
+
+type indexEntry struct {
+	Name    string
+	Href    string
+	IsDir   bool
+	Size    int64
+	ModTime time.Time
+}
+
+func (h *Handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		w.Header().Set("Allow", "GET, HEAD")
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	name := strings.Trim(gopath.Clean("/"+r.URL.Path), "/")
+
+	if _, err := h.v.GetDirIDContext(r.Context(), name); err == nil {
+		if !strings.HasSuffix(r.URL.Path, "/") {
+			target := gopath.Base(r.URL.Path) + "/"
+			if r.URL.RawQuery != "" {
+				target += "?" + r.URL.RawQuery
+			}
+
+			http.Redirect(w, r, target, http.StatusMovedPermanently)
+			return
+		}
+
+		h.serveDir(w, r, name)
+		return
+	}
+
+	h.serveFile(w, r, name)
+}
+
+func (h *Handler) serveDir(w http.ResponseWriter, r *http.Request, name string) {
+	entries, err := h.v.ReadDirContext(r.Context(), name)
+	if err != nil {
+		serveError(w, err)
+		return
+	}
+
+	if r.URL.Query().Get("format") == "json" || strings.Contains(r.Header.Get("Accept"), "application/json") {
+		listing := make([]entryJSON, 0, len(entries))
+		for _, entry := range entries {
+			info, err := entry.Info()
+			if err != nil {
+				serveError(w, err)
+				return
+			}
+
+			listing = append(listing, newEntryJSON(info))
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(listing)
+		return
+	}
+
+	index := struct {
+		Path    string
+		Entries []indexEntry
+	}{Path: "/" + name}
+
+	if name != "" {
+		index.Path += "/"
+	}
+
+	for _, entry := range entries {
+		info, err := entry.Info()
+		if err != nil {
+			serveError(w, err)
+			return
+		}
+
+		href := (&url.URL{Path: entry.Name()}).String()
+		displayName := entry.Name()
+		if entry.IsDir() {
+			href += "/"
+			displayName += "/"
+		}
+
+		index.Entries = append(index.Entries, indexEntry{
+			Name:    displayName,
+			Href:    href,
+			IsDir:   entry.IsDir(),
+			Size:    info.Size(),
+			ModTime: info.ModTime(),
+		})
+	}
+
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	indexTemplate.Execute(w, index)
+}
+
+func (h *Handler) serveFile(w http.ResponseWriter, r *http.Request, name string) {
+	info, err := h.v.StatContext(r.Context(), name)
+	if err != nil {
+		serveError(w, err)
+		return
+	}
+
+	if !info.Mode().IsRegular() {
+		http.Error(w, "not found", http.StatusNotFound)
+		return
+	}
+
+	content, err := h.v.OpenSeekableFileContext(r.Context(), name)
+	if err != nil {
+		serveError(w, err)
+		return
+	}
+	defer content.Close()
+
+	// The ETag comes from the header of the reader serving the body, so
+	// both always belong to the same version of the file
+	if versioned, ok := content.(interface{ Nonce() []byte }); ok {
+		w.Header().Set("ETag", `"`+base64.RawURLEncoding.EncodeToString(versioned.Nonce())+`"`)
+	}
+
+	http.ServeContent(w, r, info.Name(), info.ModTime(), content)
+}
+
+func newEntryJSON(info fs.FileInfo) entryJSON {
+	entry := entryJSON{
+		Name:    info.Name(),
+		Type:    "file",
+		Size:    info.Size(),
+		ModTime: info.ModTime(),
+	}
+
+	switch {
+	case info.IsDir():
+		entry.Type = "dir"
+	case info.Mode()&fs.ModeSymlink != 0:
+		entry.Type = "symlink"
+	}
+
+	return entry
+}
+
+func serveError(w http.ResponseWriter, err error) {
+	switch {
+	case errors.Is(err, fs.ErrNotExist), errors.Is(err, vault.ErrNotDirectory):
+		http.Error(w, "not found", http.StatusNotFound)
+	case errors.Is(err, fs.ErrPermission):
+		http.Error(w, "forbidden", http.StatusForbidden)
+	case errors.Is(err, fs.ErrInvalid):
+		http.Error(w, "bad request", http.StatusBadRequest)
+	case errors.Is(err, vault.ErrHeaderAuthentication), errors.Is(err, vault.ErrChunkAuthentication), errors.Is(err, vault.ErrTruncated):
+		http.Error(w, "file is damaged", http.StatusInternalServerError)
+	case errors.Is(err, context.DeadlineExceeded):
+		http.Error(w, "gateway timeout", http.StatusGatewayTimeout)
+	default:
+		http.Error(w, "internal server error", http.StatusInternalServerError)
+	}
+}
@@ -0,0 +1,143 @@
+package httpserver_test
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+
+	"github.com/fhilgers/gocryptomator/pkg/httpserver"
+	"github.com/fhilgers/gocryptomator/pkg/osfs"
+	"github.com/fhilgers/gocryptomator/pkg/vault"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func get(t *testing.T, url string, header map[string]string) (*http.Response, []byte) {
+	req, err := http.NewRequest(http.MethodGet, url, nil)
+	require.NoError(t, err)
+
+	for key, value := range header {
+		req.Header.Set(key, value)
+	}
+
+	resp, err := http.DefaultTransport.RoundTrip(req)
+	require.NoError(t, err)
+	defer resp.Body.Close()
+
+	body, err := io.ReadAll(resp.Body)
+	require.NoError(t, err)
+
+	return resp, body
+}
+
+func TestHandler(t *testing.T) {
+	v, err := vault.Create(osfs.New(t.TempDir()), "passphrase")
+	require.NoError(t, err)
+	require.NoError(t, v.MkRootDir())
+
+	content := make([]byte, 70000)
+	for i := range content {
+		content[i] = byte(i % 241)
+	}
+
+	require.NoError(t, v.Mkdir("artifacts"))
+	require.NoError(t, v.WriteFile("artifacts/build 1.bin", bytes.NewReader(content)))
+
+	server := httptest.NewServer(httpserver.NewHandler(v))
+	defer server.Close()
+
+	fileURL := server.URL + "/artifacts/build%201.bin"
+
+	resp, body := get(t, fileURL, nil)
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Equal(t, strconv.Itoa(len(content)), resp.Header.Get("Content-Length"))
+	assert.Equal(t, content, body)
+
+	etag := resp.Header.Get("ETag")
+	assert.NotEmpty(t, etag)
+
+	resp, _ = get(t, fileURL, nil)
+	assert.Equal(t, etag, resp.Header.Get("ETag"), "etag must be stable")
+
+	resp, body = get(t, fileURL, map[string]string{"Range": "bytes=32760-32800"})
+	assert.Equal(t, http.StatusPartialContent, resp.StatusCode)
+	assert.Equal(t, "bytes 32760-32800/70000", resp.Header.Get("Content-Range"))
+	assert.Equal(t, content[32760:32801], body)
+
+	resp, _ = get(t, fileURL, map[string]string{"If-None-Match": etag})
+	assert.Equal(t, http.StatusNotModified, resp.StatusCode)
+
+	resp, body = get(t, fileURL, map[string]string{"Range": "bytes=0-9", "If-Range": etag})
+	assert.Equal(t, http.StatusPartialContent, resp.StatusCode)
+	assert.Equal(t, content[:10], body)
+
+	resp, body = get(t, fileURL, map[string]string{"Range": "bytes=0-9", "If-Range": `"stale"`})
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Equal(t, content, body)
+
+	require.NoError(t, v.ReplaceFile("artifacts/build 1.bin", bytes.NewReader(content)))
+
+	resp, _ = get(t, fileURL, map[string]string{"If-None-Match": etag})
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.NotEqual(t, etag, resp.Header.Get("ETag"), "etag must change with the file")
+
+	resp, body = get(t, server.URL+"/artifacts/?format=json", nil)
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+
+	var listing []map[string]any
+	assert.NoError(t, json.Unmarshal(body, &listing))
+	assert.Len(t, listing, 1)
+	assert.Equal(t, "build 1.bin", listing[0]["name"])
+	assert.Equal(t, float64(len(content)), listing[0]["size"])
+
+	resp, body = get(t, server.URL+"/", nil)
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Contains(t, string(body), `<a href="artifacts/">artifacts/</a>`)
+
+	resp, _ = get(t, server.URL+"/artifacts?format=json", nil)
+	assert.Equal(t, http.StatusMovedPermanently, resp.StatusCode)
+	assert.Equal(t, "/artifacts/?format=json", resp.Header.Get("Location"))
+
+	resp, _ = get(t, server.URL+"/missing", nil)
+	assert.Equal(t, http.StatusNotFound, resp.StatusCode)
+
+	resp, err = http.Post(fileURL, "text/plain", nil)
+	require.NoError(t, err)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusMethodNotAllowed, resp.StatusCode)
+}
+
+func TestErrorStatus(t *testing.T) {
+	fsys := osfs.New(t.TempDir())
+
+	v, err := vault.Create(fsys, "passphrase")
+	require.NoError(t, err)
+	require.NoError(t, v.MkRootDir())
+	require.NoError(t, v.WriteFile("file", bytes.NewReader(make([]byte, 100))))
+
+	server := httptest.NewServer(httpserver.NewHandler(v))
+	defer server.Close()
+
+	resp, _ := get(t, server.URL+"/file/below", nil)
+	assert.Equal(t, http.StatusNotFound, resp.StatusCode)
+
+	encrypted, _, err := v.GetFilePath("file")
+	require.NoError(t, err)
+
+	r, err := fsys.Open(encrypted)
+	require.NoError(t, err)
+	ciphertext, err := io.ReadAll(r)
+	require.NoError(t, err)
+	r.Close()
+
+	require.NoError(t, fsys.RemoveFile(encrypted))
+	require.NoError(t, fsys.WriteString(encrypted, string(ciphertext[:10])))
+
+	resp, body := get(t, server.URL+"/file", nil)
+	assert.Equal(t, http.StatusInternalServerError, resp.StatusCode)
+	assert.Contains(t, string(body), "damaged")
+}
@@ -0,0 +1,208 @@
+// Package osfs implements the vault Fs interface on top of a directory of
+// the local filesystem.
+package osfs
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"syscall"
+
+	"github.com/fsnotify/fsnotify"
+)
+
+type Fs struct {
+	root string
+}
+
+// New returns an Fs rooted at root. All names passed to the Fs are slash
+// separated and relative to root.
+func New(root string) *Fs {
+	return &Fs{root: root}
+}
+
+func (f *Fs) Root() string {
+	return f.root
+}
+
+func (f *Fs) Open(name string) (io.ReadCloser, error) {
+	file, err := os.Open(f.path(name))
+	if err != nil {
+		return nil, notExist(err)
+	}
+
+	return file, nil
+}
+
+func (f *Fs) WriteString(name, content string) (err error) {
+	file, err := os.OpenFile(f.path(name), os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0o644)
+	if err != nil {
+		return
+	}
+
+	if _, err = io.WriteString(file, content); err != nil {
+		file.Close()
+		os.Remove(file.Name())
+		return
+	}
+
+	return file.Close()
+}
+
+func (f *Fs) RemoveDir(name string) error {
+	info, err := os.Stat(f.path(name))
+	if err != nil {
+		return notExist(err)
+	}
+
+	if !info.IsDir() {
+		return &fs.PathError{Op: "removedir", Path: name, Err: fmt.Errorf("not a directory")}
+	}
+
+	return os.Remove(f.path(name))
+}
+
+func (f *Fs) RemoveFile(name string) error {
+	info, err := os.Lstat(f.path(name))
+	if err != nil {
+		return notExist(err)
+	}
+
+	if info.IsDir() {
+		return &fs.PathError{Op: "removefile", Path: name, Err: fmt.Errorf("is a directory")}
+	}
+
+	return os.Remove(f.path(name))
+}
+
+func (f *Fs) MkdirAll(name string) error {
+	return os.MkdirAll(f.path(name), 0o755)
+}
+
+func (f *Fs) ReadDir(name string) ([]fs.DirEntry, error) {
+	return os.ReadDir(f.path(name))
+}
+
+// Stat returns the info of a single file or directory.
+func (f *Fs) Stat(name string) (fs.FileInfo, error) {
+	info, err := os.Stat(f.path(name))
+	if err != nil {
+		return nil, notExist(err)
+	}
+
+	return info, nil
+}
+
+// Rename moves a file or directory, failing if newName exists.
+func (f *Fs) Rename(oldName, newName string) error {
+	return renameNoReplace(f.path(oldName), f.path(newName))
+}
+
+// Replace moves the file oldName over newName, which os.Rename does
+// atomically.
+func (f *Fs) Replace(oldName, newName string) error {
+	return os.Rename(f.path(oldName), f.path(newName))
+}
+
+// Create creates a new file for writing, failing if it exists.
+func (f *Fs) Create(name string) (io.WriteCloser, error) {
+	return os.OpenFile(f.path(name), os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0o644)
+}
+
+// Watch reports the names of files and directories below the root that are
+// changed by anyone, using inotify or its equivalent. New directories are
+// watched as they appear, and whatever was created in them before is
+// reported as well.
+func (f *Fs) Watch(ctx context.Context) (<-chan string, error) {
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		return nil, err
+	}
+
+	if _, err = f.watchAll(watcher, f.root); err != nil {
+		watcher.Close()
+		return nil, err
+	}
+
+	names := make(chan string)
+
+	go func() {
+		defer close(names)
+		defer watcher.Close()
+
+		for {
+			var event fsnotify.Event
+			select {
+			case <-ctx.Done():
+				return
+			case <-watcher.Errors:
+				continue
+			case event = <-watcher.Events:
+			}
+
+			changed := []string{event.Name}
+			if event.Op&fsnotify.Create != 0 {
+				if info, err := os.Lstat(event.Name); err == nil && info.IsDir() {
+					created, _ := f.watchAll(watcher, event.Name)
+					changed = append(changed, created...)
+				}
+			}
+
+			for _, path := range changed {
+				name, err := filepath.Rel(f.root, path)
+				if err != nil {
+					continue
+				}
+
+				select {
+				case names <- filepath.ToSlash(name):
+				case <-ctx.Done():
+					return
+				}
+			}
+		}
+	}()
+
+	return names, nil
+}
+
+// watchAll adds dir and all directories below it to watcher and returns
+// the paths of everything below dir.
+func (f *Fs) watchAll(watcher *fsnotify.Watcher, dir string) (paths []string, err error) {
+	err = filepath.WalkDir(dir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+
+		if path != dir {
+			paths = append(paths, path)
+		}
+
+		if d.IsDir() {
+			return watcher.Add(path)
+		}
+
+		return nil
+	})
+
+	return
+}
+
+func (f *Fs) path(name string) string {
+	return filepath.Join(f.root, filepath.FromSlash(name))
+}
+
+// notExist reports paths below files as not existing, like the other
+// backends do.
+func notExist(err error) error {
+	var pathErr *fs.PathError
+	if errors.As(err, &pathErr) && errors.Is(pathErr.Err, syscall.ENOTDIR) {
+		return &fs.PathError{Op: pathErr.Op, Path: pathErr.Path, Err: fs.ErrNotExist}
+	}
+
+	return err
+}
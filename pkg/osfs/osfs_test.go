@@ -0,0 +1,21 @@
+package osfs_test
+
+import (
+	"testing"
+
+	"github.com/fhilgers/gocryptomator/pkg/osfs"
+	"github.com/fhilgers/gocryptomator/pkg/vault"
+	"github.com/fhilgers/gocryptomator/pkg/vault/fstest"
+)
+
+func TestConformance(t *testing.T) {
+	fstest.TestFs(t, func() vault.Fs {
+		return osfs.New(t.TempDir())
+	})
+}
+
+func TestVault(t *testing.T) {
+	fstest.TestVault(t, func() vault.Fs {
+		return osfs.New(t.TempDir())
+	})
+}
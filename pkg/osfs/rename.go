@@ -0,0 +1,35 @@
+package osfs
+
+import (
+	"errors"
+	"io/fs"
+	"os"
+)
+
+// renameLink moves a file by hard linking it to newPath and removing
+// oldPath, as linking fails if newPath exists. Directories, and files on
+// file systems without hard links, are only moved after checking that
+// newPath does not exist.
+func renameLink(oldPath, newPath string) error {
+	info, err := os.Lstat(oldPath)
+	if err != nil {
+		return err
+	}
+
+	if !info.IsDir() {
+		err := os.Link(oldPath, newPath)
+		if err == nil {
+			return os.Remove(oldPath)
+		}
+
+		if errors.Is(err, fs.ErrExist) {
+			return err
+		}
+	}
+
+	if _, err := os.Lstat(newPath); err == nil {
+		return &os.LinkError{Op: "rename", Old: oldPath, New: newPath, Err: fs.ErrExist}
+	}
+
+	return os.Rename(oldPath, newPath)
+}
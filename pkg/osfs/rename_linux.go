@@ -0,0 +1,21 @@
+package osfs
+
+import (
+	"os"
+
+	"golang.org/x/sys/unix"
+)
+
+// renameNoReplace moves oldPath to newPath in one step, failing if newPath
+// exists. File systems without RENAME_NOREPLACE fall back to renameLink.
+func renameNoReplace(oldPath, newPath string) error {
+	err := unix.Renameat2(unix.AT_FDCWD, oldPath, unix.AT_FDCWD, newPath, unix.RENAME_NOREPLACE)
+	switch err {
+	case nil:
+		return nil
+	case unix.ENOSYS, unix.EINVAL:
+		return renameLink(oldPath, newPath)
+	default:
+		return &os.LinkError{Op: "rename", Old: oldPath, New: newPath, Err: err}
+	}
+}
@@ -0,0 +1,8 @@
+//go:build !linux
+
+package osfs
+
+// renameNoReplace moves oldPath to newPath, failing if newPath exists.
+func renameNoReplace(oldPath, newPath string) error {
+	return renameLink(oldPath, newPath)
+}
@@ -0,0 +1,208 @@
+package s3fs
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"io/fs"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"time"
+)
+
+const amzDateFormat = "20060102T150405Z"
+
+// Error is an error response returned by the S3 API.
+type Error struct {
+	StatusCode int
+	Code       string `xml:"Code"`
+	Message    string `xml:"Message"`
+}
+
+func (e *Error) Error() string {
+	if e.Code == "" {
+		return fmt.Sprintf("s3: status %d", e.StatusCode)
+	}
+
+	return fmt.Sprintf("s3: %s: %s (status %d)", e.Code, e.Message, e.StatusCode)
+}
+
+// Is maps not found and failed preconditions onto fs.ErrNotExist and
+// fs.ErrExist, as conditional writes only fail if the object exists.
+func (e *Error) Is(target error) bool {
+	switch target {
+	case fs.ErrNotExist:
+		return e.StatusCode == http.StatusNotFound
+	case fs.ErrExist:
+		return e.StatusCode == http.StatusPreconditionFailed
+	case fs.ErrPermission:
+		return e.StatusCode == http.StatusForbidden
+	}
+
+	return false
+}
+
+type request struct {
+	method string
+	key    string
+	query  url.Values
+	header http.Header
+	body   []byte
+}
+
+// do signs and sends req. Responses with a status code >= 300 are returned
+// as *Error.
+func (f *Fs) do(ctx context.Context, req request) (*http.Response, error) {
+	u, err := url.Parse(f.cfg.Endpoint)
+	if err != nil {
+		return nil, err
+	}
+
+	objectPath := "/" + f.cfg.Bucket
+	if req.key != "" {
+		objectPath += "/" + req.key
+	}
+
+	u.Path = strings.TrimSuffix(u.Path, "/") + objectPath
+	u.RawPath = uriEncode(u.Path, false)
+	u.RawQuery = canonicalQuery(req.query)
+
+	httpReq, err := http.NewRequestWithContext(ctx, req.method, u.String(), bytes.NewReader(req.body))
+	if err != nil {
+		return nil, err
+	}
+
+	for key, values := range req.header {
+		httpReq.Header[key] = values
+	}
+
+	f.sign(httpReq, req.body, time.Now().UTC())
+
+	resp, err := f.client.Do(httpReq)
+	if err != nil {
+		return nil, err
+	}
+
+	if resp.StatusCode >= 300 {
+		defer resp.Body.Close()
+
+		s3Err := &Error{StatusCode: resp.StatusCode}
+		if body, err := io.ReadAll(io.LimitReader(resp.Body, 64*1024)); err == nil && len(body) > 0 {
+			xml.Unmarshal(body, s3Err)
+		}
+
+		return nil, s3Err
+	}
+
+	return resp, nil
+}
+
+// sign adds an AWS signature version 4 authorization header to req.
+func (f *Fs) sign(req *http.Request, body []byte, now time.Time) {
+	payloadHash := sha256.Sum256(body)
+	payloadHashHex := hex.EncodeToString(payloadHash[:])
+
+	amzDate := now.Format(amzDateFormat)
+	date := amzDate[:8]
+
+	req.Header.Set("X-Amz-Date", amzDate)
+	req.Header.Set("X-Amz-Content-Sha256", payloadHashHex)
+	if f.cfg.SessionToken != "" {
+		req.Header.Set("X-Amz-Security-Token", f.cfg.SessionToken)
+	}
+
+	signedHeaders := []string{"host"}
+	canonicalHeaders := "host:" + req.URL.Host + "\n"
+
+	var amzHeaders []string
+	for key := range req.Header {
+		if lower := strings.ToLower(key); strings.HasPrefix(lower, "x-amz-") || lower == "if-none-match" || lower == "range" {
+			amzHeaders = append(amzHeaders, lower)
+		}
+	}
+	sort.Strings(amzHeaders)
+
+	for _, key := range amzHeaders {
+		signedHeaders = append(signedHeaders, key)
+		canonicalHeaders += key + ":" + strings.TrimSpace(req.Header.Get(key)) + "\n"
+	}
+
+	canonicalRequest := strings.Join([]string{
+		req.Method,
+		req.URL.EscapedPath(),
+		req.URL.RawQuery,
+		canonicalHeaders,
+		strings.Join(signedHeaders, ";"),
+		payloadHashHex,
+	}, "\n")
+
+	scope := date + "/" + f.cfg.Region + "/s3/aws4_request"
+	canonicalRequestHash := sha256.Sum256([]byte(canonicalRequest))
+
+	stringToSign := "AWS4-HMAC-SHA256\n" + amzDate + "\n" + scope + "\n" + hex.EncodeToString(canonicalRequestHash[:])
+
+	key := hmacSHA256([]byte("AWS4"+f.cfg.SecretAccessKey), date)
+	key = hmacSHA256(key, f.cfg.Region)
+	key = hmacSHA256(key, "s3")
+	key = hmacSHA256(key, "aws4_request")
+
+	signature := hex.EncodeToString(hmacSHA256(key, stringToSign))
+
+	req.Header.Set("Authorization", fmt.Sprintf("AWS4-HMAC-SHA256 Credential=%s/%s, SignedHeaders=%s, Signature=%s",
+		f.cfg.AccessKeyID, scope, strings.Join(signedHeaders, ";"), signature))
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	h := hmac.New(sha256.New, key)
+	h.Write([]byte(data))
+
+	return h.Sum(nil)
+}
+
+func canonicalQuery(query url.Values) string {
+	keys := make([]string, 0, len(query))
+	for key := range query {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	var parts []string
+	for _, key := range keys {
+		values := append([]string{}, query[key]...)
+		sort.Strings(values)
+
+		for _, value := range values {
+			parts = append(parts, uriEncode(key, true)+"="+uriEncode(value, true))
+		}
+	}
+
+	return strings.Join(parts, "&")
+}
+
+// uriEncode encodes s as required by signature version 4, leaving slashes
+// alone unless encodeSlash is set.
+func uriEncode(s string, encodeSlash bool) string {
+	var b strings.Builder
+
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+
+		switch {
+		case 'A' <= c && c <= 'Z', 'a' <= c && c <= 'z', '0' <= c && c <= '9', c == '-', c == '_', c == '.', c == '~':
+			b.WriteByte(c)
+		case c == '/' && !encodeSlash:
+			b.WriteByte(c)
+		default:
+			fmt.Fprintf(&b, "%%%02X", c)
+		}
+	}
+
+	return b.String()
+}
@@ -0,0 +1,649 @@
+// Package s3fs implements the vault Fs interface on top of an S3 compatible
+// object store. Directories are emulated with key prefixes and empty marker
+// objects whose keys end with a slash.
+package s3fs
+
+import (
+	"bytes"
+	"context"
+	"encoding/xml"
+	"errors"
+	"io"
+	"io/fs"
+	"net/http"
+	"net/url"
+	gopath "path"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/fhilgers/gocryptomator/pkg/vault"
+)
+
+const DefaultPartSize = 16 * 1024 * 1024
+
+type Config struct {
+	// Endpoint is the base url of the service, buckets are addressed path
+	// style below it.
+	Endpoint string
+	Region   string
+	Bucket   string
+
+	// Prefix is prepended to all keys, so the vault can live in a
+	// subdirectory of the bucket.
+	Prefix string
+
+	AccessKeyID     string
+	SecretAccessKey string
+	SessionToken    string
+
+	// PartSize is the part size of multipart uploads. Smaller files are
+	// uploaded with a single PutObject. Defaults to DefaultPartSize.
+	PartSize int
+
+	// Client is used for all requests. Defaults to http.DefaultClient.
+	Client *http.Client
+}
+
+type Fs struct {
+	cfg    Config
+	client *http.Client
+	ctx    context.Context
+}
+
+func New(cfg Config) *Fs {
+	if cfg.PartSize <= 0 {
+		cfg.PartSize = DefaultPartSize
+	}
+
+	client := cfg.Client
+	if client == nil {
+		client = http.DefaultClient
+	}
+
+	return &Fs{cfg: cfg, client: client}
+}
+
+// WithContext returns a copy of the Fs that makes all requests with ctx.
+func (f *Fs) WithContext(ctx context.Context) vault.Fs {
+	c := *f
+	c.ctx = ctx
+
+	return &c
+}
+
+func (f *Fs) context() context.Context {
+	if f.ctx == nil {
+		return context.Background()
+	}
+
+	return f.ctx
+}
+
+func (f *Fs) Open(name string) (io.ReadCloser, error) {
+	obj := &object{f: f, key: f.key(name)}
+
+	if err := obj.get(); err != nil {
+		return nil, &fs.PathError{Op: "open", Path: name, Err: err}
+	}
+
+	return obj, nil
+}
+
+// WriteString uploads the content with If-None-Match: *, so the upload fails
+// with fs.ErrExist if the object already exists.
+func (f *Fs) WriteString(name, content string) error {
+	var err error
+	if len(content) <= f.cfg.PartSize {
+		err = f.putObject(f.context(), f.key(name), []byte(content), true)
+	} else {
+		err = f.uploadMultipart(f.context(), f.key(name), strings.NewReader(content))
+	}
+
+	if err != nil {
+		return &fs.PathError{Op: "write", Path: name, Err: err}
+	}
+
+	return nil
+}
+
+func (f *Fs) RemoveDir(name string) error {
+	result, err := f.list(f.context(), f.dirKey(name), "", 2)
+	if err != nil {
+		return &fs.PathError{Op: "removedir", Path: name, Err: err}
+	}
+
+	hasMarker := false
+	for _, content := range result.Contents {
+		if content.Key == f.dirKey(name) {
+			hasMarker = true
+		} else {
+			return &fs.PathError{Op: "removedir", Path: name, Err: errors.New("directory not empty")}
+		}
+	}
+
+	if len(result.CommonPrefixes) > 0 {
+		return &fs.PathError{Op: "removedir", Path: name, Err: errors.New("directory not empty")}
+	}
+
+	if !hasMarker {
+		return &fs.PathError{Op: "removedir", Path: name, Err: fs.ErrNotExist}
+	}
+
+	if err := f.deleteObject(f.context(), f.dirKey(name)); err != nil {
+		return &fs.PathError{Op: "removedir", Path: name, Err: err}
+	}
+
+	return nil
+}
+
+func (f *Fs) RemoveFile(name string) error {
+	if _, err := f.headObject(f.context(), f.key(name)); err != nil {
+		return &fs.PathError{Op: "removefile", Path: name, Err: err}
+	}
+
+	if err := f.deleteObject(f.context(), f.key(name)); err != nil {
+		return &fs.PathError{Op: "removefile", Path: name, Err: err}
+	}
+
+	return nil
+}
+
+// MkdirAll creates a marker object for the directory. Parents don't need
+// markers, as they implicitly exist as prefixes.
+func (f *Fs) MkdirAll(name string) error {
+	if f.dirKey(name) == "" {
+		return nil
+	}
+
+	if err := f.putObject(f.context(), f.dirKey(name), nil, false); err != nil {
+		return &fs.PathError{Op: "mkdir", Path: name, Err: err}
+	}
+
+	return nil
+}
+
+func (f *Fs) ReadDir(name string) ([]fs.DirEntry, error) {
+	var (
+		entries           []fs.DirEntry
+		continuationToken string
+		exists            = f.dirKey(name) == ""
+	)
+
+	for {
+		result, err := f.list(f.context(), f.dirKey(name), continuationToken, 0)
+		if err != nil {
+			return nil, &fs.PathError{Op: "readdir", Path: name, Err: err}
+		}
+
+		for _, content := range result.Contents {
+			exists = true
+
+			if content.Key == f.dirKey(name) {
+				continue
+			}
+
+			entries = append(entries, fs.FileInfoToDirEntry(&fileInfo{
+				name:    gopath.Base(content.Key),
+				size:    content.Size,
+				modTime: content.LastModified,
+			}))
+		}
+
+		for _, prefix := range result.CommonPrefixes {
+			exists = true
+
+			entries = append(entries, fs.FileInfoToDirEntry(&fileInfo{
+				name: gopath.Base(prefix.Prefix),
+				dir:  true,
+			}))
+		}
+
+		if !result.IsTruncated {
+			break
+		}
+		continuationToken = result.NextContinuationToken
+	}
+
+	if !exists {
+		return nil, &fs.PathError{Op: "readdir", Path: name, Err: fs.ErrNotExist}
+	}
+
+	sort.Slice(entries, func(i, j int) bool {
+		return entries[i].Name() < entries[j].Name()
+	})
+
+	return entries, nil
+}
+
+// Stat returns the info of an object or of a directory, which exists if it
+// has a marker or any object below it.
+func (f *Fs) Stat(name string) (fs.FileInfo, error) {
+	if f.key(name) == "" {
+		return &fileInfo{name: ".", dir: true}, nil
+	}
+
+	resp, err := f.headObject(f.context(), f.key(name))
+	if err == nil {
+		modTime, _ := http.ParseTime(resp.Header.Get("Last-Modified"))
+		return &fileInfo{name: gopath.Base(f.key(name)), size: resp.ContentLength, modTime: modTime}, nil
+	}
+
+	if !errors.Is(err, fs.ErrNotExist) {
+		return nil, &fs.PathError{Op: "stat", Path: name, Err: err}
+	}
+
+	result, err := f.list(f.context(), f.dirKey(name), "", 1)
+	if err != nil {
+		return nil, &fs.PathError{Op: "stat", Path: name, Err: err}
+	}
+
+	if len(result.Contents) == 0 && len(result.CommonPrefixes) == 0 {
+		return nil, &fs.PathError{Op: "stat", Path: name, Err: fs.ErrNotExist}
+	}
+
+	return &fileInfo{name: gopath.Base(f.key(name)), dir: true}, nil
+}
+
+// Copy copies an object on the server side with CopyObject, failing if dst
+// exists.
+func (f *Fs) Copy(src, dst string) error {
+	if _, err := f.headObject(f.context(), f.key(dst)); err == nil {
+		return &fs.PathError{Op: "copy", Path: dst, Err: fs.ErrExist}
+	} else if !errors.Is(err, fs.ErrNotExist) {
+		return &fs.PathError{Op: "copy", Path: dst, Err: err}
+	}
+
+	return f.copyObject("copy", src, dst)
+}
+
+// Replace copies the object oldName over newName and removes oldName. The
+// copy replaces newName in one step, so it always exists with either
+// content.
+func (f *Fs) Replace(oldName, newName string) error {
+	if err := f.copyObject("replace", oldName, newName); err != nil {
+		return err
+	}
+
+	return f.RemoveFile(oldName)
+}
+
+func (f *Fs) copyObject(op, src, dst string) error {
+	header := http.Header{}
+	header.Set("X-Amz-Copy-Source", uriEncode("/"+f.cfg.Bucket+"/"+f.key(src), false))
+
+	resp, err := f.do(f.context(), request{method: http.MethodPut, key: f.key(dst), header: header})
+	if err != nil {
+		return &fs.PathError{Op: op, Path: src, Err: err}
+	}
+	defer resp.Body.Close()
+
+	// Like completions, copies may report errors in a 200 response
+	var copyErr Error
+	if respBody, err := io.ReadAll(resp.Body); err == nil && bytes.Contains(respBody, []byte("<Error>")) {
+		xml.Unmarshal(respBody, &copyErr)
+		copyErr.StatusCode = resp.StatusCode
+		return &fs.PathError{Op: op, Path: src, Err: &copyErr}
+	}
+
+	return nil
+}
+
+// Create returns a writer that uploads the object on Close with a single
+// PutObject, or as a multipart upload streamed in the background once the
+// content exceeds PartSize. Aborting the writer aborts the multipart upload.
+func (f *Fs) Create(name string) (io.WriteCloser, error) {
+	if _, err := f.headObject(f.context(), f.key(name)); err == nil {
+		return nil, &fs.PathError{Op: "create", Path: name, Err: fs.ErrExist}
+	} else if !errors.Is(err, fs.ErrNotExist) {
+		return nil, &fs.PathError{Op: "create", Path: name, Err: err}
+	}
+
+	return &writer{f: f, name: name}, nil
+}
+
+func (f *Fs) key(name string) string {
+	return strings.Trim(gopath.Join(f.cfg.Prefix, name), "/")
+}
+
+func (f *Fs) dirKey(name string) string {
+	if key := f.key(name); key != "" {
+		return key + "/"
+	}
+
+	return ""
+}
+
+func (f *Fs) putObject(ctx context.Context, key string, body []byte, exclusive bool) error {
+	header := http.Header{}
+	if exclusive {
+		header.Set("If-None-Match", "*")
+	}
+
+	resp, err := f.do(ctx, request{method: http.MethodPut, key: key, header: header, body: body})
+	if err != nil {
+		return err
+	}
+
+	return resp.Body.Close()
+}
+
+func (f *Fs) headObject(ctx context.Context, key string) (*http.Response, error) {
+	resp, err := f.do(ctx, request{method: http.MethodHead, key: key})
+	if err != nil {
+		return nil, err
+	}
+
+	return resp, resp.Body.Close()
+}
+
+func (f *Fs) deleteObject(ctx context.Context, key string) error {
+	resp, err := f.do(ctx, request{method: http.MethodDelete, key: key})
+	if err != nil {
+		return err
+	}
+
+	return resp.Body.Close()
+}
+
+type listBucketResult struct {
+	IsTruncated           bool   `xml:"IsTruncated"`
+	NextContinuationToken string `xml:"NextContinuationToken"`
+	Contents              []struct {
+		Key          string    `xml:"Key"`
+		LastModified time.Time `xml:"LastModified"`
+		Size         int64     `xml:"Size"`
+	} `xml:"Contents"`
+	CommonPrefixes []struct {
+		Prefix string `xml:"Prefix"`
+	} `xml:"CommonPrefixes"`
+}
+
+func (f *Fs) list(ctx context.Context, prefix, continuationToken string, maxKeys int) (result listBucketResult, err error) {
+	query := url.Values{
+		"list-type": {"2"},
+		"prefix":    {prefix},
+		"delimiter": {"/"},
+	}
+	if continuationToken != "" {
+		query.Set("continuation-token", continuationToken)
+	}
+	if maxKeys > 0 {
+		query.Set("max-keys", strconv.Itoa(maxKeys))
+	}
+
+	resp, err := f.do(ctx, request{method: http.MethodGet, query: query})
+	if err != nil {
+		return
+	}
+	defer resp.Body.Close()
+
+	err = xml.NewDecoder(resp.Body).Decode(&result)
+
+	return
+}
+
+type completeMultipartUpload struct {
+	XMLName xml.Name        `xml:"CompleteMultipartUpload"`
+	Parts   []completedPart `xml:"Part"`
+}
+
+type completedPart struct {
+	PartNumber int    `xml:"PartNumber"`
+	ETag       string `xml:"ETag"`
+}
+
+// uploadMultipart uploads everything from r in parts of PartSize. The upload
+// is completed with If-None-Match: *, so it fails if the object exists.
+func (f *Fs) uploadMultipart(ctx context.Context, key string, r io.Reader) (err error) {
+	resp, err := f.do(ctx, request{method: http.MethodPost, key: key, query: url.Values{"uploads": {""}}})
+	if err != nil {
+		return
+	}
+
+	var initiated struct {
+		UploadID string `xml:"UploadId"`
+	}
+	err = xml.NewDecoder(resp.Body).Decode(&initiated)
+	resp.Body.Close()
+	if err != nil {
+		return
+	}
+
+	defer func() {
+		if err != nil {
+			if resp, abortErr := f.do(ctx, request{method: http.MethodDelete, key: key, query: url.Values{"uploadId": {initiated.UploadID}}}); abortErr == nil {
+				resp.Body.Close()
+			}
+		}
+	}()
+
+	var complete completeMultipartUpload
+
+	buf := make([]byte, f.cfg.PartSize)
+	for partNumber := 1; ; partNumber++ {
+		n, readErr := io.ReadFull(r, buf)
+		if readErr == io.EOF && partNumber > 1 {
+			break
+		}
+		if readErr != nil && readErr != io.EOF && readErr != io.ErrUnexpectedEOF {
+			return readErr
+		}
+
+		resp, err := f.do(ctx, request{
+			method: http.MethodPut,
+			key:    key,
+			query:  url.Values{"partNumber": {strconv.Itoa(partNumber)}, "uploadId": {initiated.UploadID}},
+			body:   buf[:n],
+		})
+		if err != nil {
+			return err
+		}
+		resp.Body.Close()
+
+		complete.Parts = append(complete.Parts, completedPart{PartNumber: partNumber, ETag: resp.Header.Get("ETag")})
+
+		if readErr != nil {
+			break
+		}
+	}
+
+	body, err := xml.Marshal(complete)
+	if err != nil {
+		return
+	}
+
+	resp, err = f.do(ctx, request{
+		method: http.MethodPost,
+		key:    key,
+		query:  url.Values{"uploadId": {initiated.UploadID}},
+		header: http.Header{"If-None-Match": {"*"}},
+		body:   body,
+	})
+	if err != nil {
+		return
+	}
+	defer resp.Body.Close()
+
+	// S3 may report errors of the completion in a 200 response
+	var completeErr Error
+	if respBody, err := io.ReadAll(resp.Body); err == nil && bytes.Contains(respBody, []byte("<Error>")) {
+		xml.Unmarshal(respBody, &completeErr)
+		completeErr.StatusCode = resp.StatusCode
+		return &completeErr
+	}
+
+	return nil
+}
+
+type fileInfo struct {
+	name    string
+	size    int64
+	modTime time.Time
+	dir     bool
+}
+
+func (fi *fileInfo) Name() string       { return fi.name }
+func (fi *fileInfo) Size() int64        { return fi.size }
+func (fi *fileInfo) ModTime() time.Time { return fi.modTime }
+func (fi *fileInfo) IsDir() bool        { return fi.dir }
+func (fi *fileInfo) Sys() any           { return nil }
+
+func (fi *fileInfo) Mode() fs.FileMode {
+	if fi.dir {
+		return fs.ModeDir | 0o755
+	}
+
+	return 0o644
+}
+
+// object reads an object with range requests, so it can be seeked without
+// downloading the skipped parts.
+type object struct {
+	f    *Fs
+	key  string
+	size int64
+
+	offset int64
+	body   io.ReadCloser
+}
+
+func (o *object) get() error {
+	header := http.Header{}
+	if o.offset > 0 {
+		header.Set("Range", "bytes="+strconv.FormatInt(o.offset, 10)+"-")
+	}
+
+	resp, err := o.f.do(o.f.context(), request{method: http.MethodGet, key: o.key, header: header})
+	if err != nil {
+		return err
+	}
+
+	if o.offset == 0 {
+		o.size = resp.ContentLength
+	}
+	o.body = resp.Body
+
+	return nil
+}
+
+func (o *object) Read(p []byte) (int, error) {
+	if o.offset >= o.size {
+		return 0, io.EOF
+	}
+
+	if o.body == nil {
+		if err := o.get(); err != nil {
+			return 0, err
+		}
+	}
+
+	n, err := o.body.Read(p)
+	o.offset += int64(n)
+
+	return n, err
+}
+
+func (o *object) Seek(offset int64, whence int) (int64, error) {
+	switch whence {
+	case io.SeekStart:
+	case io.SeekCurrent:
+		offset += o.offset
+	case io.SeekEnd:
+		offset += o.size
+	default:
+		return 0, errors.New("s3fs: invalid whence")
+	}
+
+	if offset < 0 {
+		return 0, errors.New("s3fs: negative position")
+	}
+
+	if offset != o.offset && o.body != nil {
+		o.body.Close()
+		o.body = nil
+	}
+	o.offset = offset
+
+	return offset, nil
+}
+
+func (o *object) Close() error {
+	if o.body == nil {
+		return nil
+	}
+
+	return o.body.Close()
+}
+
+type writer struct {
+	f    *Fs
+	name string
+	buf  []byte
+
+	pipe *io.PipeWriter
+	done chan error
+}
+
+func (w *writer) Write(p []byte) (int, error) {
+	if w.pipe != nil {
+		return w.pipe.Write(p)
+	}
+
+	w.buf = append(w.buf, p...)
+	if len(w.buf) <= w.f.cfg.PartSize {
+		return len(p), nil
+	}
+
+	pipeReader, pipeWriter := io.Pipe()
+	w.pipe, w.done = pipeWriter, make(chan error, 1)
+
+	go func() {
+		err := w.f.uploadMultipart(w.f.context(), w.f.key(w.name), pipeReader)
+		pipeReader.CloseWithError(err)
+		w.done <- err
+	}()
+
+	buf := w.buf
+	w.buf = nil
+	if _, err := w.pipe.Write(buf); err != nil {
+		return 0, err
+	}
+
+	return len(p), nil
+}
+
+// errAborted ends the upload of an aborted writer.
+var errAborted = errors.New("s3fs: upload aborted")
+
+// Abort discards the buffered content, or aborts the multipart upload.
+func (w *writer) Abort() error {
+	if w.pipe == nil {
+		w.buf = nil
+		return nil
+	}
+
+	w.pipe.CloseWithError(errAborted)
+
+	if err := <-w.done; err != nil && !errors.Is(err, errAborted) {
+		return &fs.PathError{Op: "abort", Path: w.name, Err: err}
+	}
+
+	return nil
+}
+
+func (w *writer) Close() (err error) {
+	if w.pipe == nil {
+		err = w.f.putObject(w.f.context(), w.f.key(w.name), w.buf, true)
+	} else {
+		w.pipe.Close()
+		err = <-w.done
+	}
+
+	if err != nil {
+		return &fs.PathError{Op: "write", Path: w.name, Err: err}
+	}
+
+	return nil
+}
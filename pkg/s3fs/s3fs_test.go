@@ -0,0 +1,211 @@
+package s3fs_test
+
+import (
+	"bytes"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/fhilgers/gocryptomator/pkg/s3fs"
+	"github.com/fhilgers/gocryptomator/pkg/vault"
+	"github.com/fhilgers/gocryptomator/pkg/vault/fstest"
+)
+
+// fakeS3 is a minimal in-memory stand-in for the parts of the S3 API used by
+// s3fs, with path style addressing of a single bucket.
+type fakeS3 struct {
+	mu      sync.Mutex
+	objects map[string][]byte
+	uploads map[string]map[int][]byte
+	nextID  int
+}
+
+func newFakeS3(t *testing.T) *httptest.Server {
+	server := httptest.NewServer(&fakeS3{
+		objects: map[string][]byte{},
+		uploads: map[string]map[int][]byte{},
+	})
+	t.Cleanup(server.Close)
+
+	return server
+}
+
+func writeError(w http.ResponseWriter, status int, code string) {
+	w.WriteHeader(status)
+	fmt.Fprintf(w, "<Error><Code>%s</Code><Message>%s</Message></Error>", code, code)
+}
+
+func (s *fakeS3) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if !strings.HasPrefix(r.Header.Get("Authorization"), "AWS4-HMAC-SHA256 Credential=access/") {
+		writeError(w, http.StatusForbidden, "AccessDenied")
+		return
+	}
+
+	bucket, key, _ := strings.Cut(strings.TrimPrefix(r.URL.Path, "/"), "/")
+	if bucket != "bucket" {
+		writeError(w, http.StatusNotFound, "NoSuchBucket")
+		return
+	}
+
+	query := r.URL.Query()
+	body, _ := io.ReadAll(r.Body)
+
+	switch {
+	case key == "" && r.Method == http.MethodGet:
+		s.list(w, query)
+	case r.Method == http.MethodGet || r.Method == http.MethodHead:
+		data, ok := s.objects[key]
+		if !ok {
+			writeError(w, http.StatusNotFound, "NoSuchKey")
+			return
+		}
+		http.ServeContent(w, r, "", time.Time{}, bytes.NewReader(data))
+	case r.Method == http.MethodPut && query.Has("uploadId"):
+		partNumber, _ := strconv.Atoi(query.Get("partNumber"))
+		s.uploads[query.Get("uploadId")][partNumber] = body
+		w.Header().Set("ETag", fmt.Sprintf(`"%d"`, partNumber))
+	case r.Method == http.MethodPut && r.Header.Get("X-Amz-Copy-Source") != "":
+		source, _ := url.PathUnescape(r.Header.Get("X-Amz-Copy-Source"))
+		data, ok := s.objects[strings.TrimPrefix(source, "/bucket/")]
+		if !ok {
+			writeError(w, http.StatusNotFound, "NoSuchKey")
+			return
+		}
+		s.objects[key] = data
+		fmt.Fprint(w, "<CopyObjectResult></CopyObjectResult>")
+	case r.Method == http.MethodPut:
+		if _, exists := s.objects[key]; exists && r.Header.Get("If-None-Match") == "*" {
+			writeError(w, http.StatusPreconditionFailed, "PreconditionFailed")
+			return
+		}
+		s.objects[key] = body
+	case r.Method == http.MethodPost && query.Has("uploads"):
+		s.nextID++
+		id := strconv.Itoa(s.nextID)
+		s.uploads[id] = map[int][]byte{}
+		fmt.Fprintf(w, "<InitiateMultipartUploadResult><UploadId>%s</UploadId></InitiateMultipartUploadResult>", id)
+	case r.Method == http.MethodPost && query.Has("uploadId"):
+		if _, exists := s.objects[key]; exists && r.Header.Get("If-None-Match") == "*" {
+			writeError(w, http.StatusPreconditionFailed, "PreconditionFailed")
+			return
+		}
+
+		var complete struct {
+			Parts []struct {
+				PartNumber int
+			} `xml:"Part"`
+		}
+		xml.Unmarshal(body, &complete)
+
+		var data []byte
+		for _, part := range complete.Parts {
+			data = append(data, s.uploads[query.Get("uploadId")][part.PartNumber]...)
+		}
+		s.objects[key] = data
+		delete(s.uploads, query.Get("uploadId"))
+		fmt.Fprint(w, "<CompleteMultipartUploadResult></CompleteMultipartUploadResult>")
+	case r.Method == http.MethodDelete && query.Has("uploadId"):
+		delete(s.uploads, query.Get("uploadId"))
+		w.WriteHeader(http.StatusNoContent)
+	case r.Method == http.MethodDelete:
+		delete(s.objects, key)
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		writeError(w, http.StatusNotImplemented, "NotImplemented")
+	}
+}
+
+func (s *fakeS3) list(w http.ResponseWriter, query map[string][]string) {
+	get := func(key string) string {
+		if values := query[key]; len(values) > 0 {
+			return values[0]
+		}
+		return ""
+	}
+
+	prefix, delimiter, after := get("prefix"), get("delimiter"), get("continuation-token")
+	maxKeys, err := strconv.Atoi(get("max-keys"))
+	if err != nil {
+		maxKeys = 1000
+	}
+
+	keys := make([]string, 0, len(s.objects))
+	for key := range s.objects {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	var (
+		result   strings.Builder
+		prefixes = map[string]bool{}
+		count    int
+		last     string
+		more     bool
+	)
+
+	for _, key := range keys {
+		if !strings.HasPrefix(key, prefix) || key <= after {
+			continue
+		}
+
+		entry := fmt.Sprintf("<Contents><Key>%s</Key><LastModified>2023-01-01T00:00:00.000Z</LastModified><Size>%d</Size></Contents>", key, len(s.objects[key]))
+		if i := strings.Index(key[len(prefix):], delimiter); delimiter != "" && i >= 0 {
+			commonPrefix := key[:len(prefix)+i+1]
+			if prefixes[commonPrefix] {
+				last = key
+				continue
+			}
+			prefixes[commonPrefix] = true
+			entry = fmt.Sprintf("<CommonPrefixes><Prefix>%s</Prefix></CommonPrefixes>", commonPrefix)
+		}
+
+		if count == maxKeys {
+			more = true
+			break
+		}
+
+		result.WriteString(entry)
+		last = key
+		count++
+	}
+
+	fmt.Fprintf(w, "<ListBucketResult><IsTruncated>%t</IsTruncated><NextContinuationToken>%s</NextContinuationToken>%s</ListBucketResult>", more, last, result.String())
+}
+
+func newTestFs(t *testing.T, partSize int) *s3fs.Fs {
+	server := newFakeS3(t)
+
+	return s3fs.New(s3fs.Config{
+		Endpoint:        server.URL,
+		Region:          "us-east-1",
+		Bucket:          "bucket",
+		Prefix:          "vaults/test",
+		AccessKeyID:     "access",
+		SecretAccessKey: "secret",
+		PartSize:        partSize,
+	})
+}
+
+func TestConformance(t *testing.T) {
+	fstest.TestFs(t, func() vault.Fs {
+		return newTestFs(t, 1024)
+	})
+}
+
+func TestVault(t *testing.T) {
+	fstest.TestVault(t, func() vault.Fs {
+		return newTestFs(t, 1024)
+	})
+}
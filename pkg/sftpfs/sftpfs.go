@@ -0,0 +1,234 @@
+// Package sftpfs implements the vault Fs interface on top of a remote
+// directory accessed over SFTP.
+package sftpfs
+
+import (
+	"errors"
+	"io"
+	"io/fs"
+	"os"
+	gopath "path"
+	"sort"
+
+	"github.com/pkg/sftp"
+	"golang.org/x/crypto/ssh"
+)
+
+// DefaultConcurrency is the default number of concurrent requests per file
+// used by Dial.
+const DefaultConcurrency = 64
+
+type Fs struct {
+	client *sftp.Client
+	conn   *ssh.Client
+	root   string
+}
+
+// New returns an Fs rooted at root on the remote host. The client can be
+// shared by many goroutines, requests are pipelined over its connection.
+func New(client *sftp.Client, root string) *Fs {
+	return &Fs{client: client, root: root}
+}
+
+// Dial opens a single ssh connection to addr and starts an sftp session on
+// it with concurrent reads and writes enabled. Further options are passed to
+// sftp.NewClient.
+func Dial(addr string, config *ssh.ClientConfig, root string, opts ...sftp.ClientOption) (*Fs, error) {
+	conn, err := ssh.Dial("tcp", addr, config)
+	if err != nil {
+		return nil, err
+	}
+
+	opts = append([]sftp.ClientOption{
+		sftp.MaxConcurrentRequestsPerFile(DefaultConcurrency),
+		sftp.UseConcurrentReads(true),
+		sftp.UseConcurrentWrites(true),
+	}, opts...)
+
+	client, err := sftp.NewClient(conn, opts...)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	return &Fs{client: client, conn: conn, root: root}, nil
+}
+
+// Close closes the sftp session and, if the Fs was created by Dial, the ssh
+// connection.
+func (f *Fs) Close() error {
+	err := f.client.Close()
+
+	if f.conn != nil {
+		if connErr := f.conn.Close(); err == nil {
+			err = connErr
+		}
+	}
+
+	return err
+}
+
+func (f *Fs) Open(name string) (io.ReadCloser, error) {
+	file, err := f.client.Open(f.path(name))
+	if err != nil {
+		return nil, f.notExist("open", name, err)
+	}
+
+	return file, nil
+}
+
+func (f *Fs) WriteString(name, content string) error {
+	file, err := f.Create(name)
+	if err != nil {
+		return err
+	}
+
+	if _, err = io.WriteString(file, content); err != nil {
+		file.Close()
+		f.client.Remove(f.path(name))
+		return err
+	}
+
+	return file.Close()
+}
+
+func (f *Fs) RemoveDir(name string) error {
+	info, err := f.client.Lstat(f.path(name))
+	if err != nil {
+		return f.notExist("removedir", name, err)
+	}
+
+	if !info.IsDir() {
+		return &fs.PathError{Op: "removedir", Path: name, Err: errors.New("not a directory")}
+	}
+
+	return f.client.RemoveDirectory(f.path(name))
+}
+
+func (f *Fs) RemoveFile(name string) error {
+	info, err := f.client.Lstat(f.path(name))
+	if err != nil {
+		return f.notExist("removefile", name, err)
+	}
+
+	if info.IsDir() {
+		return &fs.PathError{Op: "removefile", Path: name, Err: errors.New("is a directory")}
+	}
+
+	return f.client.Remove(f.path(name))
+}
+
+func (f *Fs) MkdirAll(name string) error {
+	return f.client.MkdirAll(f.path(name))
+}
+
+func (f *Fs) ReadDir(name string) ([]fs.DirEntry, error) {
+	infos, err := f.client.ReadDir(f.path(name))
+	if err != nil {
+		return nil, err
+	}
+
+	entries := make([]fs.DirEntry, len(infos))
+	for i, info := range infos {
+		entries[i] = fs.FileInfoToDirEntry(info)
+	}
+
+	sort.Slice(entries, func(i, j int) bool {
+		return entries[i].Name() < entries[j].Name()
+	})
+
+	return entries, nil
+}
+
+// Stat returns the info of a single file or directory.
+func (f *Fs) Stat(name string) (fs.FileInfo, error) {
+	info, err := f.client.Stat(f.path(name))
+	if err != nil {
+		return nil, f.notExist("stat", name, err)
+	}
+
+	return info, nil
+}
+
+// Rename moves a file or directory, failing if newName exists. Files are
+// hard linked to newName and removed, as linking fails if newName exists.
+// Directories, and files on servers without the hardlink extension, use the
+// plain SFTP rename, which must not replace newName by the protocol. As some
+// servers replace it anyway, they are only renamed if newName does not
+// exist.
+func (f *Fs) Rename(oldName, newName string) error {
+	oldPath, newPath := f.path(oldName), f.path(newName)
+
+	info, err := f.client.Lstat(oldPath)
+	if err != nil {
+		return f.notExist("rename", oldName, err)
+	}
+
+	if !info.IsDir() {
+		err := f.client.Link(oldPath, newPath)
+		if err == nil {
+			return f.client.Remove(oldPath)
+		}
+
+		var statusErr *sftp.StatusError
+		if !errors.As(err, &statusErr) || statusErr.FxCode() != sftp.ErrSSHFxOpUnsupported {
+			return f.exists("rename", newName, err)
+		}
+	}
+
+	if _, err := f.client.Lstat(newPath); err == nil {
+		return &fs.PathError{Op: "rename", Path: newName, Err: fs.ErrExist}
+	}
+
+	return f.exists("rename", newName, f.client.Rename(oldPath, newPath))
+}
+
+// exists turns err into fs.ErrExist if name exists, as servers report
+// existing targets as generic failures.
+func (f *Fs) exists(op, name string, err error) error {
+	if err == nil {
+		return nil
+	}
+
+	if _, statErr := f.client.Lstat(f.path(name)); statErr == nil {
+		return &fs.PathError{Op: op, Path: name, Err: fs.ErrExist}
+	}
+
+	return err
+}
+
+// Create creates a new file for writing, failing if it exists.
+func (f *Fs) Create(name string) (io.WriteCloser, error) {
+	file, err := f.client.OpenFile(f.path(name), os.O_WRONLY|os.O_CREATE|os.O_EXCL)
+	if err != nil {
+		return nil, f.exists("create", name, err)
+	}
+
+	return file, nil
+}
+
+func (f *Fs) path(name string) string {
+	return gopath.Join(f.root, name)
+}
+
+// notExist reports paths below files as not existing. Servers answer them
+// with generic failures, so the closest existing parent is checked.
+func (f *Fs) notExist(op, name string, err error) error {
+	if errors.Is(err, fs.ErrNotExist) {
+		return err
+	}
+
+	for dir := gopath.Dir(name); dir != "." && dir != "/"; dir = gopath.Dir(dir) {
+		info, statErr := f.client.Lstat(f.path(dir))
+		if statErr != nil {
+			continue
+		}
+
+		if !info.IsDir() {
+			return &fs.PathError{Op: op, Path: name, Err: fs.ErrNotExist}
+		}
+		break
+	}
+
+	return err
+}
@@ -0,0 +1,140 @@
+package sftpfs_test
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"io"
+	"net"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/fhilgers/gocryptomator/pkg/sftpfs"
+	"github.com/fhilgers/gocryptomator/pkg/vault"
+	"github.com/fhilgers/gocryptomator/pkg/vault/fstest"
+	"github.com/pkg/sftp"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/crypto/ssh"
+)
+
+// serveSftp starts an in-process ssh server exposing the local filesystem
+// through the sftp subsystem.
+func serveSftp(t *testing.T) string {
+	_, hostKey, err := ed25519.GenerateKey(rand.Reader)
+	require.NoError(t, err)
+	signer, err := ssh.NewSignerFromKey(hostKey)
+	require.NoError(t, err)
+
+	config := &ssh.ServerConfig{
+		PasswordCallback: func(conn ssh.ConnMetadata, password []byte) (*ssh.Permissions, error) {
+			return nil, nil
+		},
+	}
+	config.AddHostKey(signer)
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	t.Cleanup(func() { listener.Close() })
+
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+
+			go func() {
+				_, channels, requests, err := ssh.NewServerConn(conn, config)
+				if err != nil {
+					return
+				}
+				go ssh.DiscardRequests(requests)
+
+				for newChannel := range channels {
+					channel, requests, err := newChannel.Accept()
+					if err != nil {
+						return
+					}
+
+					go func() {
+						for req := range requests {
+							req.Reply(req.Type == "subsystem", nil)
+							if req.Type != "subsystem" {
+								continue
+							}
+
+							server, err := sftp.NewServer(channel)
+							if err != nil {
+								return
+							}
+							server.Serve()
+							channel.Close()
+							return
+						}
+					}()
+				}
+			}()
+		}
+	}()
+
+	return listener.Addr().String()
+}
+
+func newTestFs(t *testing.T) *sftpfs.Fs {
+	f, err := sftpfs.Dial(serveSftp(t), &ssh.ClientConfig{
+		User:            "user",
+		Auth:            []ssh.AuthMethod{ssh.Password("password")},
+		HostKeyCallback: ssh.InsecureIgnoreHostKey(),
+	}, t.TempDir())
+	require.NoError(t, err)
+	t.Cleanup(func() { f.Close() })
+
+	return f
+}
+
+func TestConcurrent(t *testing.T) {
+	f := newTestFs(t)
+
+	v, err := vault.Create(f, "passphrase")
+	require.NoError(t, err)
+	require.NoError(t, v.MkRootDir())
+
+	var wg sync.WaitGroup
+	for _, name := range []string{"a", "b", "c", "d", "e", "f", "g", "h"} {
+		wg.Add(1)
+		go func(name string) {
+			defer wg.Done()
+
+			assert.NoError(t, v.Mkdir(name))
+			assert.NoError(t, v.WriteFile(name+"/file", strings.NewReader(name)))
+		}(name)
+	}
+	wg.Wait()
+
+	v, err = vault.Open(f, "passphrase")
+	require.NoError(t, err)
+
+	entries, err := v.ReadDir("")
+	require.NoError(t, err)
+	assert.Len(t, entries, 8)
+
+	r, err := v.OpenFile("c/file")
+	require.NoError(t, err)
+	content, err := io.ReadAll(r)
+	assert.NoError(t, err)
+	assert.Equal(t, "c", string(content))
+	r.Close()
+}
+
+func TestConformance(t *testing.T) {
+	fstest.TestFs(t, func() vault.Fs {
+		return newTestFs(t)
+	})
+}
+
+func TestVault(t *testing.T) {
+	fstest.TestVault(t, func() vault.Fs {
+		return newTestFs(t)
+	})
+}
@@ -0,0 +1,446 @@
+// Package sftpserver serves an unlocked vault over SFTP.
+package sftpserver
+
+import (
+	"errors"
+	"io"
+	"io/fs"
+	"os"
+	gopath "path"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/fhilgers/gocryptomator/pkg/vault"
+	"github.com/pkg/sftp"
+)
+
+type handler struct {
+	v *vault.Vault
+}
+
+// Handlers returns sftp request handlers that map file operations onto v.
+func Handlers(v *vault.Vault) sftp.Handlers {
+	h := &handler{v: v}
+
+	return sftp.Handlers{
+		FileGet:  h,
+		FilePut:  h,
+		FileCmd:  h,
+		FileList: h,
+	}
+}
+
+func (h *handler) Fileread(r *sftp.Request) (io.ReaderAt, error) {
+	f, err := h.v.OpenSeekableFile(r.Filepath)
+	if err != nil {
+		return nil, convertError(err)
+	}
+
+	return &readerAt{r: f}, nil
+}
+
+func (h *handler) Filewrite(r *sftp.Request) (io.WriterAt, error) {
+	flags := r.Pflags()
+
+	info, err := h.stat(r.Filepath)
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return nil, convertError(err)
+	}
+
+	switch {
+	case info == nil && !flags.Creat:
+		return nil, convertError(err)
+	case info != nil && flags.Creat && flags.Excl:
+		return nil, os.ErrExist
+	case info != nil && info.IsDir():
+		return nil, &fs.PathError{Op: "open", Path: r.Filepath, Err: errors.New("is a directory")}
+	}
+
+	if _, err := h.v.GetDirID(gopath.Dir(cleanName(r.Filepath))); err != nil {
+		return nil, convertError(err)
+	}
+
+	var old io.ReadCloser
+	if info != nil && !flags.Trunc {
+		if old, err = h.v.OpenFile(r.Filepath); err != nil {
+			return nil, convertError(err)
+		}
+	}
+
+	return newWriterAt(h.v, r.Filepath, info != nil, old), nil
+}
+
+func (h *handler) Filecmd(r *sftp.Request) error {
+	switch r.Method {
+	case "Setstat":
+		// Only size changes are applied, there is nothing to store the
+		// other attributes in
+		if r.AttrFlags().Size {
+			return convertError(h.truncate(r.Filepath, int64(r.Attributes().Size)))
+		}
+		return nil
+	case "Rename":
+		return convertError(h.v.Rename(r.Filepath, r.Target))
+	case "Rmdir":
+		if cleanName(r.Filepath) == "" {
+			return &fs.PathError{Op: "rmdir", Path: r.Filepath, Err: errors.New("cannot remove the root directory")}
+		}
+		return convertError(h.v.Rmdir(r.Filepath))
+	case "Mkdir":
+		if _, err := h.v.GetDirID(r.Filepath); err == nil {
+			return os.ErrExist
+		}
+		return convertError(h.v.Mkdir(r.Filepath))
+	case "Remove":
+		return convertError(h.v.Remove(r.Filepath))
+	default:
+		return sftp.ErrSSHFxOpUnsupported
+	}
+}
+
+func (h *handler) Filelist(r *sftp.Request) (sftp.ListerAt, error) {
+	switch r.Method {
+	case "List":
+		entries, err := h.v.ReadDir(r.Filepath)
+		if err != nil {
+			return nil, convertError(err)
+		}
+
+		infos := make(listerAt, 0, len(entries))
+		for _, entry := range entries {
+			info, err := entry.Info()
+			if err != nil {
+				return nil, err
+			}
+
+			infos = append(infos, info)
+		}
+
+		return infos, nil
+	case "Stat":
+		info, err := h.stat(r.Filepath)
+		if err != nil {
+			return nil, convertError(err)
+		}
+
+		return listerAt{info}, nil
+	default:
+		return nil, sftp.ErrSSHFxOpUnsupported
+	}
+}
+
+// truncate changes the size of the file name, cutting it off or padding it
+// with zeros. The file is rewritten completely, as the vault can only
+// write files from the start.
+func (h *handler) truncate(name string, size int64) error {
+	info, err := h.stat(name)
+	if err != nil {
+		return err
+	}
+
+	if info.IsDir() {
+		return &fs.PathError{Op: "truncate", Path: name, Err: errors.New("is a directory")}
+	}
+
+	if info.Size() == size && !vault.IsTruncated(info) {
+		return nil
+	}
+
+	// Damaged files cannot be read, but can be cut off completely
+	if size == 0 {
+		return h.v.ReplaceFile(name, strings.NewReader(""))
+	}
+
+	old, err := h.v.OpenFile(name)
+	if err != nil {
+		return err
+	}
+	defer old.Close()
+
+	content := io.MultiReader(io.LimitReader(old, size), io.LimitReader(zeroReader{}, size-info.Size()))
+
+	return h.v.ReplaceFile(name, content)
+}
+
+func (h *handler) stat(name string) (fs.FileInfo, error) {
+	name = cleanName(name)
+	if name == "" {
+		return rootInfo{}, nil
+	}
+
+	return h.v.Stat(name)
+}
+
+// convertError strips wrapping from not exist errors, as the sftp package
+// checks them with os.IsNotExist.
+func convertError(err error) error {
+	switch {
+	case err == nil:
+		return nil
+	case errors.Is(err, fs.ErrNotExist), errors.Is(err, vault.ErrNotDirectory):
+		return os.ErrNotExist
+	case errors.Is(err, fs.ErrPermission):
+		return os.ErrPermission
+	default:
+		return err
+	}
+}
+
+func cleanName(name string) string {
+	return strings.Trim(gopath.Clean("/"+name), "/")
+}
+
+type listerAt []fs.FileInfo
+
+func (l listerAt) ListAt(infos []fs.FileInfo, offset int64) (int, error) {
+	if offset >= int64(len(l)) {
+		return 0, io.EOF
+	}
+
+	n := copy(infos, l[offset:])
+	if n < len(infos) {
+		return n, io.EOF
+	}
+
+	return n, nil
+}
+
+type rootInfo struct{}
+
+func (rootInfo) Name() string       { return "/" }
+func (rootInfo) Size() int64        { return 0 }
+func (rootInfo) Mode() fs.FileMode  { return fs.ModeDir | 0o755 }
+func (rootInfo) ModTime() time.Time { return time.Time{} }
+func (rootInfo) IsDir() bool        { return true }
+func (rootInfo) Sys() any           { return nil }
+
+// readerAt serializes random access reads on a decrypting reader.
+type readerAt struct {
+	mu sync.Mutex
+	r  io.ReadSeekCloser
+}
+
+func (r *readerAt) ReadAt(p []byte, off int64) (int, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if _, err := r.r.Seek(off, io.SeekStart); err != nil {
+		return 0, err
+	}
+
+	n, err := io.ReadFull(r.r, p)
+	if err == io.ErrUnexpectedEOF {
+		err = io.EOF
+	}
+
+	return n, err
+}
+
+func (r *readerAt) Close() error {
+	return r.r.Close()
+}
+
+// maxPendingWrites limits how much data written ahead of the current
+// offset is buffered, which clients with several requests in flight do.
+const maxPendingWrites = 16 << 20
+
+var errRandomWrite = errors.New("writing before the current offset is not supported")
+
+// writerAt encrypts the written plaintext in order while it arrives, so
+// nothing is stored unencrypted. Writes ahead of the current offset are kept
+// in memory until the gap is filled, and gaps left at Close are filled with
+// the old content or zeros. When opened without truncation, the old content
+// is streamed in between the writes, which allows overwriting parts of a
+// file as long as it happens front to back. An existing file is only
+// replaced once the new content is stored completely, and any failed write
+// aborts the upload on Close.
+type writerAt struct {
+	name string
+	w    *io.PipeWriter
+	done chan error
+
+	mu      sync.Mutex
+	old     io.ReadCloser
+	offset  int64
+	pending map[int64][]byte
+	size    int
+	err     error
+	closed  bool
+}
+
+func newWriterAt(v *vault.Vault, name string, exists bool, old io.ReadCloser) *writerAt {
+	r, w := io.Pipe()
+
+	wa := &writerAt{name: name, w: w, done: make(chan error, 1), old: old, pending: map[int64][]byte{}}
+
+	go func() {
+		var err error
+		if exists {
+			err = v.ReplaceFile(name, r)
+		} else {
+			err = v.WriteFile(name, r)
+		}
+
+		// Fail the writes still waiting if the vault gave up early
+		r.CloseWithError(err)
+		wa.done <- err
+	}()
+
+	return wa
+}
+
+func (w *writerAt) WriteAt(p []byte, off int64) (n int, err error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	if w.closed {
+		return 0, fs.ErrClosed
+	}
+
+	if w.err != nil {
+		return 0, w.err
+	}
+
+	defer func() {
+		if err != nil && w.err == nil {
+			w.err = err
+		}
+	}()
+
+	switch {
+	case off < w.offset:
+		err = &fs.PathError{Op: "write", Path: w.name, Err: errRandomWrite}
+		return
+	case off > w.offset:
+		if _, ok := w.pending[off]; ok || w.size+len(p) > maxPendingWrites {
+			err = &fs.PathError{Op: "write", Path: w.name, Err: errRandomWrite}
+			return
+		}
+
+		w.pending[off] = append([]byte(nil), p...)
+		w.size += len(p)
+		n = len(p)
+		return
+	}
+
+	if err = w.write(p); err != nil {
+		return
+	}
+	n = len(p)
+
+	err = w.flush(false)
+
+	return
+}
+
+func (w *writerAt) Close() (err error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	if w.closed {
+		return fs.ErrClosed
+	}
+	w.closed = true
+
+	if w.old != nil {
+		defer w.old.Close()
+	}
+
+	if w.err == nil {
+		w.err = w.flush(true)
+	}
+
+	if w.err == nil && w.old != nil {
+		_, w.err = io.Copy(w.w, w.old)
+	}
+
+	if w.err != nil {
+		w.w.CloseWithError(w.err)
+		<-w.done
+
+		return w.err
+	}
+
+	w.w.Close()
+
+	return convertError(<-w.done)
+}
+
+// flush writes the pending writes that continue at the current offset. With
+// gaps set, the gaps between them are filled as well.
+func (w *writerAt) flush(gaps bool) error {
+	offsets := make([]int64, 0, len(w.pending))
+	for off := range w.pending {
+		offsets = append(offsets, off)
+	}
+	sort.Slice(offsets, func(i, j int) bool { return offsets[i] < offsets[j] })
+
+	for _, off := range offsets {
+		switch {
+		case off < w.offset:
+			return &fs.PathError{Op: "write", Path: w.name, Err: errRandomWrite}
+		case off > w.offset && !gaps:
+			return nil
+		case off > w.offset:
+			if err := w.fill(off); err != nil {
+				return err
+			}
+		}
+
+		p := w.pending[off]
+		delete(w.pending, off)
+		w.size -= len(p)
+
+		if err := w.write(p); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// write writes p at the current offset, skipping the old content it
+// replaces.
+func (w *writerAt) write(p []byte) error {
+	if _, err := w.w.Write(p); err != nil {
+		return err
+	}
+	w.offset += int64(len(p))
+
+	if w.old != nil {
+		if _, err := io.CopyN(io.Discard, w.old, int64(len(p))); err != nil && err != io.EOF {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// fill writes the old content up to off, or zeros past its end.
+func (w *writerAt) fill(off int64) error {
+	if w.old != nil {
+		n, err := io.CopyN(w.w, w.old, off-w.offset)
+		w.offset += n
+
+		if err != nil && err != io.EOF {
+			return err
+		}
+	}
+
+	n, err := io.CopyN(w.w, zeroReader{}, off-w.offset)
+	w.offset += n
+
+	return err
+}
+
+type zeroReader struct{}
+
+func (zeroReader) Read(p []byte) (int, error) {
+	for i := range p {
+		p[i] = 0
+	}
+
+	return len(p), nil
+}
@@ -0,0 +1,129 @@
+package sftpserver
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"net"
+
+	"github.com/fhilgers/gocryptomator/pkg/vault"
+	"github.com/pkg/sftp"
+	"golang.org/x/crypto/ssh"
+)
+
+// Server accepts ssh connections and serves the vault to clients requesting
+// the sftp subsystem.
+type Server struct {
+	v      *vault.Vault
+	config *ssh.ServerConfig
+}
+
+// NewServer returns a Server for v. The config must contain at least one
+// host key and the authentication callbacks.
+func NewServer(v *vault.Vault, config *ssh.ServerConfig) *Server {
+	return &Server{v: v, config: config}
+}
+
+// Serve accepts connections on l until it is closed.
+func (s *Server) Serve(l net.Listener) error {
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			return err
+		}
+
+		go s.serveConn(conn)
+	}
+}
+
+func (s *Server) serveConn(conn net.Conn) {
+	defer conn.Close()
+
+	_, channels, requests, err := ssh.NewServerConn(conn, s.config)
+	if err != nil {
+		return
+	}
+
+	go ssh.DiscardRequests(requests)
+
+	for newChannel := range channels {
+		if newChannel.ChannelType() != "session" {
+			newChannel.Reject(ssh.UnknownChannelType, "unknown channel type")
+			continue
+		}
+
+		channel, requests, err := newChannel.Accept()
+		if err != nil {
+			continue
+		}
+
+		go s.serveSession(channel, requests)
+	}
+}
+
+func (s *Server) serveSession(channel ssh.Channel, requests <-chan *ssh.Request) {
+	defer channel.Close()
+
+	for req := range requests {
+		if req.Type != "subsystem" || subsystem(req.Payload) != "sftp" {
+			req.Reply(false, nil)
+			continue
+		}
+		req.Reply(true, nil)
+
+		go ssh.DiscardRequests(requests)
+
+		server := sftp.NewRequestServer(channel, Handlers(s.v))
+		server.Serve()
+		server.Close()
+
+		return
+	}
+}
+
+func subsystem(payload []byte) string {
+	if len(payload) < 4 {
+		return ""
+	}
+
+	length := binary.BigEndian.Uint32(payload)
+	if uint32(len(payload)-4) < length {
+		return ""
+	}
+
+	return string(payload[4 : 4+length])
+}
+
+// AuthorizedKeys parses the contents of an authorized_keys file and returns
+// a callback for ssh.ServerConfig.PublicKeyCallback accepting those keys.
+func AuthorizedKeys(authorizedKeys []byte) (func(ssh.ConnMetadata, ssh.PublicKey) (*ssh.Permissions, error), error) {
+	keys := make(map[string]bool)
+
+	scanner := bufio.NewScanner(bytes.NewReader(authorizedKeys))
+	for lineNr := 1; scanner.Scan(); lineNr++ {
+		line := bytes.TrimSpace(scanner.Bytes())
+		if len(line) == 0 || line[0] == '#' {
+			continue
+		}
+
+		key, _, _, _, err := ssh.ParseAuthorizedKey(line)
+		if err != nil {
+			return nil, fmt.Errorf("invalid authorized key in line %d: %w", lineNr, err)
+		}
+
+		keys[string(key.Marshal())] = true
+	}
+
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	return func(conn ssh.ConnMetadata, key ssh.PublicKey) (*ssh.Permissions, error) {
+		if !keys[string(key.Marshal())] {
+			return nil, fmt.Errorf("unknown public key for %s", conn.User())
+		}
+
+		return &ssh.Permissions{}, nil
+	}, nil
+}
@@ -0,0 +1,229 @@
+package sftpserver_test
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"io"
+	"net"
+	"os"
+	"sort"
+	"testing"
+
+	"github.com/fhilgers/gocryptomator/pkg/osfs"
+	"github.com/fhilgers/gocryptomator/pkg/sftpserver"
+	"github.com/fhilgers/gocryptomator/pkg/vault"
+	"github.com/pkg/sftp"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/crypto/ssh"
+)
+
+func newSigner(t *testing.T) ssh.Signer {
+	_, key, err := ed25519.GenerateKey(rand.Reader)
+	require.NoError(t, err)
+
+	signer, err := ssh.NewSignerFromKey(key)
+	require.NoError(t, err)
+
+	return signer
+}
+
+func newTestClient(t *testing.T, v *vault.Vault) *sftp.Client {
+	clientKey := newSigner(t)
+
+	callback, err := sftpserver.AuthorizedKeys(ssh.MarshalAuthorizedKey(clientKey.PublicKey()))
+	require.NoError(t, err)
+
+	config := &ssh.ServerConfig{PublicKeyCallback: callback}
+	config.AddHostKey(newSigner(t))
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	t.Cleanup(func() { listener.Close() })
+
+	go sftpserver.NewServer(v, config).Serve(listener)
+
+	_, err = ssh.Dial("tcp", listener.Addr().String(), &ssh.ClientConfig{
+		User:            "user",
+		Auth:            []ssh.AuthMethod{ssh.PublicKeys(newSigner(t))},
+		HostKeyCallback: ssh.InsecureIgnoreHostKey(),
+	})
+	assert.Error(t, err, "unknown keys must be rejected")
+
+	conn, err := ssh.Dial("tcp", listener.Addr().String(), &ssh.ClientConfig{
+		User:            "user",
+		Auth:            []ssh.AuthMethod{ssh.PublicKeys(clientKey)},
+		HostKeyCallback: ssh.InsecureIgnoreHostKey(),
+	})
+	require.NoError(t, err)
+	t.Cleanup(func() { conn.Close() })
+
+	client, err := sftp.NewClient(conn)
+	require.NoError(t, err)
+	t.Cleanup(func() { client.Close() })
+
+	return client
+}
+
+func writeFile(t *testing.T, client *sftp.Client, name string, content []byte) {
+	f, err := client.Create(name)
+	require.NoError(t, err)
+
+	_, err = f.Write(content)
+	require.NoError(t, err)
+	require.NoError(t, f.Close())
+}
+
+func readFile(t *testing.T, client *sftp.Client, name string) []byte {
+	f, err := client.Open(name)
+	require.NoError(t, err)
+	defer f.Close()
+
+	content, err := io.ReadAll(f)
+	require.NoError(t, err)
+
+	return content
+}
+
+func TestSftp(t *testing.T) {
+	v, err := vault.Create(osfs.New(t.TempDir()), "passphrase")
+	require.NoError(t, err)
+	require.NoError(t, v.MkRootDir())
+
+	client := newTestClient(t, v)
+
+	content := make([]byte, 200000)
+	for i := range content {
+		content[i] = byte(i % 239)
+	}
+
+	assert.NoError(t, client.Mkdir("/dir"))
+	assert.Error(t, client.Mkdir("/dir"))
+
+	writeFile(t, client, "/dir/file.bin", content)
+	assert.Equal(t, content, readFile(t, client, "/dir/file.bin"))
+
+	f, err := client.Open("/dir/file.bin")
+	require.NoError(t, err)
+	part := make([]byte, 100)
+	_, err = f.ReadAt(part, 32760)
+	assert.NoError(t, err)
+	assert.Equal(t, content[32760:32860], part)
+	f.Close()
+
+	info, err := client.Stat("/dir/file.bin")
+	assert.NoError(t, err)
+	assert.Equal(t, int64(len(content)), info.Size())
+	assert.False(t, info.IsDir())
+
+	f, err = client.OpenFile("/dir/file.bin", os.O_WRONLY)
+	require.NoError(t, err)
+	_, err = f.WriteAt([]byte("patched"), 10)
+	assert.NoError(t, err)
+	assert.NoError(t, f.Close())
+	copy(content[10:], "patched")
+	assert.Equal(t, content, readFile(t, client, "/dir/file.bin"))
+
+	writeFile(t, client, "/dir/other.txt", []byte("other"))
+
+	infos, err := client.ReadDir("/dir")
+	assert.NoError(t, err)
+	names := []string{}
+	for _, info := range infos {
+		names = append(names, info.Name())
+	}
+	sort.Strings(names)
+	assert.Equal(t, []string{"file.bin", "other.txt"}, names)
+
+	assert.NoError(t, client.Rename("/dir/other.txt", "/moved.txt"))
+	assert.Equal(t, []byte("other"), readFile(t, client, "/moved.txt"))
+
+	_, err = client.Stat("/dir/other.txt")
+	assert.ErrorIs(t, err, os.ErrNotExist)
+
+	assert.Error(t, client.RemoveDirectory("/dir"), "non empty dirs must not be removed")
+	assert.NoError(t, client.Remove("/dir/file.bin"))
+	assert.NoError(t, client.RemoveDirectory("/dir"))
+
+	_, err = client.Stat("/dir")
+	assert.ErrorIs(t, err, os.ErrNotExist)
+}
+
+func TestWrites(t *testing.T) {
+	v, err := vault.Create(osfs.New(t.TempDir()), "passphrase")
+	require.NoError(t, err)
+	require.NoError(t, v.MkRootDir())
+
+	client := newTestClient(t, v)
+
+	f, err := client.Create("/file")
+	require.NoError(t, err)
+	_, err = f.WriteAt([]byte("world"), 6)
+	assert.NoError(t, err)
+	_, err = f.WriteAt([]byte("hello "), 0)
+	assert.NoError(t, err)
+	assert.NoError(t, f.Close())
+	assert.Equal(t, []byte("hello world"), readFile(t, client, "/file"))
+
+	f, err = client.OpenFile("/file", os.O_WRONLY)
+	require.NoError(t, err)
+	_, err = f.WriteAt([]byte("!"), 14)
+	assert.NoError(t, err)
+	assert.NoError(t, f.Close())
+	assert.Equal(t, []byte("hello world\x00\x00\x00!"), readFile(t, client, "/file"))
+
+	f, err = client.OpenFile("/file", os.O_WRONLY)
+	require.NoError(t, err)
+	_, err = f.WriteAt([]byte("H"), 0)
+	assert.NoError(t, err)
+	_, err = f.WriteAt([]byte("h"), 0)
+	assert.Error(t, err, "writes before the current offset are not supported")
+	assert.Error(t, f.Close())
+	assert.Equal(t, []byte("hello world\x00\x00\x00!"), readFile(t, client, "/file"), "failed writes must keep the file")
+
+	assert.NoError(t, client.Truncate("/file", 5))
+	assert.Equal(t, []byte("hello"), readFile(t, client, "/file"))
+
+	assert.NoError(t, client.Truncate("/file", 7))
+	assert.Equal(t, []byte("hello\x00\x00"), readFile(t, client, "/file"))
+
+	assert.Error(t, client.Truncate("/missing", 7))
+}
+
+func TestDamagedFile(t *testing.T) {
+	storage := osfs.New(t.TempDir())
+
+	v, err := vault.Create(storage, "passphrase")
+	require.NoError(t, err)
+	require.NoError(t, v.MkRootDir())
+
+	client := newTestClient(t, v)
+
+	for _, name := range []string{"replaced", "truncated"} {
+		writeFile(t, client, "/"+name, []byte("original"))
+
+		encrypted, _, err := v.GetFilePath(name)
+		require.NoError(t, err)
+		require.NoError(t, os.Truncate(storage.Root()+"/"+encrypted, 10))
+	}
+
+	// Damaged files are listed like Stat reports them and can be replaced
+	infos, err := client.ReadDir("/")
+	require.NoError(t, err)
+	require.Len(t, infos, 2)
+	assert.Equal(t, int64(0), infos[0].Size())
+
+	info, err := client.Stat("/replaced")
+	require.NoError(t, err)
+	assert.Equal(t, int64(0), info.Size())
+
+	_, err = client.Open("/replaced")
+	assert.Error(t, err)
+
+	writeFile(t, client, "/replaced", []byte("replaced"))
+	assert.Equal(t, []byte("replaced"), readFile(t, client, "/replaced"))
+
+	assert.Error(t, client.Truncate("/truncated", 5))
+	assert.NoError(t, client.Truncate("/truncated", 0))
+	assert.Empty(t, readFile(t, client, "/truncated"))
+}
@@ -0,0 +1,309 @@
+package vault
+
+import (
+	"container/list"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// CacheEntry is what a Cache stores for a cleaned vault path.
+type CacheEntry struct {
+	// DirID is the directory id of the path.
+	DirID string
+
+	// Missing records that nothing exists at the path.
+	Missing bool
+}
+
+// CacheStats counts the lookups of a Cache.
+type CacheStats struct {
+	Hits      uint64
+	Misses    uint64
+	Evictions uint64
+	Len       int
+}
+
+// Cache maps the cleaned vault paths of directories to their directory ids.
+// Implementations must be safe for concurrent use.
+type Cache interface {
+	Get(name string) (entry CacheEntry, ok bool)
+	Set(name string, entry CacheEntry)
+
+	// RemovePrefix removes name and every path below it. The root
+	// directory "" is a prefix of every path.
+	RemovePrefix(name string)
+
+	Clear()
+	Stats() CacheStats
+}
+
+// The bounds of the cache a vault starts with. Directory ids only change
+// when directories are moved, so entries can live long, but other clients
+// of a shared vault may move them.
+const (
+	DefaultCacheSize = 4096
+	DefaultCacheTTL  = 5 * time.Minute
+)
+
+// LRUCache is a Cache holding up to size directories, evicting the least
+// recently used one first. It does not store missing paths, wrap it with a
+// NegativeCache for that.
+type LRUCache struct {
+	size int
+	ttl  time.Duration
+
+	mu      sync.Mutex
+	order   *list.List
+	entries map[string]*list.Element
+
+	// The entries are also kept in a tree of path segments, so RemovePrefix
+	// only visits the entries below the prefix
+	root *lruNode
+
+	hits, misses, evictions uint64
+}
+
+type lruEntry struct {
+	name    string
+	entry   CacheEntry
+	expires time.Time
+	node    *lruNode
+}
+
+type lruNode struct {
+	parent   *lruNode
+	segment  string
+	children map[string]*lruNode
+	elem     *list.Element
+}
+
+// NewLRUCache returns a cache bounded to size entries whose entries expire
+// ttl after they were set. Zero disables the respective limit.
+func NewLRUCache(size int, ttl time.Duration) *LRUCache {
+	return &LRUCache{
+		size:    size,
+		ttl:     ttl,
+		order:   list.New(),
+		entries: map[string]*list.Element{},
+		root:    &lruNode{},
+	}
+}
+
+func (c *LRUCache) Get(name string) (entry CacheEntry, ok bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	elem, ok := c.entries[name]
+	if ok && c.ttl > 0 && time.Now().After(elem.Value.(*lruEntry).expires) {
+		c.remove(elem)
+		ok = false
+	}
+
+	if !ok {
+		c.misses++
+		return
+	}
+
+	c.hits++
+	c.order.MoveToFront(elem)
+
+	return elem.Value.(*lruEntry).entry, true
+}
+
+func (c *LRUCache) Set(name string, entry CacheEntry) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if entry.Missing {
+		if elem, ok := c.entries[name]; ok {
+			c.remove(elem)
+		}
+		return
+	}
+
+	e := &lruEntry{name: name, entry: entry}
+	if c.ttl > 0 {
+		e.expires = time.Now().Add(c.ttl)
+	}
+
+	if elem, ok := c.entries[name]; ok {
+		e.node = elem.Value.(*lruEntry).node
+		elem.Value = e
+		c.order.MoveToFront(elem)
+		return
+	}
+
+	e.node = c.node(name, true)
+	e.node.elem = c.order.PushFront(e)
+	c.entries[name] = e.node.elem
+
+	if c.size > 0 && c.order.Len() > c.size {
+		c.remove(c.order.Back())
+		c.evictions++
+	}
+}
+
+func (c *LRUCache) RemovePrefix(name string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	n := c.node(name, false)
+	if n == nil {
+		return
+	}
+
+	var removeAll func(n *lruNode)
+	removeAll = func(n *lruNode) {
+		if n.elem != nil {
+			c.order.Remove(n.elem)
+			delete(c.entries, n.elem.Value.(*lruEntry).name)
+		}
+
+		for _, child := range n.children {
+			removeAll(child)
+		}
+	}
+	removeAll(n)
+
+	if n == c.root {
+		c.root = &lruNode{}
+		return
+	}
+
+	delete(n.parent.children, n.segment)
+	c.prune(n.parent)
+}
+
+func (c *LRUCache) Clear() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.order.Init()
+	c.entries = map[string]*list.Element{}
+	c.root = &lruNode{}
+}
+
+func (c *LRUCache) Stats() CacheStats {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return CacheStats{
+		Hits:      c.hits,
+		Misses:    c.misses,
+		Evictions: c.evictions,
+		Len:       c.order.Len(),
+	}
+}
+
+func (c *LRUCache) remove(elem *list.Element) {
+	e := elem.Value.(*lruEntry)
+
+	c.order.Remove(elem)
+	delete(c.entries, e.name)
+
+	e.node.elem = nil
+	c.prune(e.node)
+}
+
+// node returns the tree node of name. Missing nodes are created if create
+// is set, otherwise nil is returned.
+func (c *LRUCache) node(name string, create bool) *lruNode {
+	n := c.root
+	if name == "" {
+		return n
+	}
+
+	for _, segment := range strings.Split(name, PathSeparator) {
+		child, ok := n.children[segment]
+		if !ok {
+			if !create {
+				return nil
+			}
+
+			if n.children == nil {
+				n.children = map[string]*lruNode{}
+			}
+
+			child = &lruNode{parent: n, segment: segment}
+			n.children[segment] = child
+		}
+
+		n = child
+	}
+
+	return n
+}
+
+// prune removes n and its parents as long as they are empty.
+func (c *LRUCache) prune(n *lruNode) {
+	for n != c.root && n.elem == nil && len(n.children) == 0 {
+		delete(n.parent.children, n.segment)
+		n = n.parent
+	}
+}
+
+// NegativeCache remembers paths that do not exist, so that repeated lookups
+// of them don't hit the Fs. Everything else is passed on to the wrapped
+// Cache. Missing paths are forgotten when the vault creates something
+// there, but not when something is created behind its back, so ttl should
+// be short for shared vaults.
+type NegativeCache struct {
+	Cache
+
+	missing *LRUCache
+	hits    uint64
+}
+
+// NewNegativeCache wraps next and remembers up to size missing paths for
+// ttl. Zero disables the respective limit.
+func NewNegativeCache(next Cache, size int, ttl time.Duration) *NegativeCache {
+	return &NegativeCache{
+		Cache:   next,
+		missing: NewLRUCache(size, ttl),
+	}
+}
+
+func (c *NegativeCache) Get(name string) (entry CacheEntry, ok bool) {
+	if _, ok = c.missing.Get(name); ok {
+		atomic.AddUint64(&c.hits, 1)
+		return CacheEntry{Missing: true}, true
+	}
+
+	return c.Cache.Get(name)
+}
+
+func (c *NegativeCache) Set(name string, entry CacheEntry) {
+	if entry.Missing {
+		c.missing.Set(name, CacheEntry{})
+		c.Cache.RemovePrefix(name)
+		return
+	}
+
+	c.missing.RemovePrefix(name)
+	c.Cache.Set(name, entry)
+}
+
+func (c *NegativeCache) RemovePrefix(name string) {
+	c.missing.RemovePrefix(name)
+	c.Cache.RemovePrefix(name)
+}
+
+func (c *NegativeCache) Clear() {
+	c.missing.Clear()
+	c.Cache.Clear()
+}
+
+// Stats counts hits of missing paths as hits, lookups that miss both caches
+// are only counted once.
+func (c *NegativeCache) Stats() CacheStats {
+	missing, next := c.missing.Stats(), c.Cache.Stats()
+
+	return CacheStats{
+		Hits:      next.Hits + atomic.LoadUint64(&c.hits),
+		Misses:    next.Misses,
+		Evictions: next.Evictions + missing.Evictions,
+		Len:       next.Len + missing.Len,
+	}
+}
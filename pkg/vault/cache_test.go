@@ -0,0 +1,142 @@
+package vault_test
+
+import (
+	"io/fs"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/fhilgers/gocryptomator/pkg/vault"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestLRUCache(t *testing.T) {
+	c := vault.NewLRUCache(2, 0)
+
+	c.Set("a", vault.CacheEntry{DirID: "1"})
+	c.Set("b", vault.CacheEntry{DirID: "2"})
+
+	_, ok := c.Get("a")
+	assert.True(t, ok)
+
+	c.Set("c", vault.CacheEntry{DirID: "3"})
+	_, ok = c.Get("b")
+	assert.False(t, ok, "least recently used entry must be evicted")
+
+	c.Set("a/x", vault.CacheEntry{DirID: "4"})
+	c.Set("missing", vault.CacheEntry{Missing: true})
+	_, ok = c.Get("missing")
+	assert.False(t, ok, "missing paths are not stored")
+
+	c.RemovePrefix("a")
+	_, ok = c.Get("a/x")
+	assert.False(t, ok)
+
+	assert.Equal(t, vault.CacheStats{Hits: 1, Misses: 3, Evictions: 2, Len: 1}, c.Stats())
+
+	c = vault.NewLRUCache(0, 10*time.Millisecond)
+	c.Set("a", vault.CacheEntry{DirID: "1"})
+	time.Sleep(20 * time.Millisecond)
+	_, ok = c.Get("a")
+	assert.False(t, ok, "entries must expire")
+}
+
+func TestLRUCacheRemovePrefix(t *testing.T) {
+	c := vault.NewLRUCache(0, 0)
+
+	for _, name := range []string{"a", "a/b", "a/b/c", "ab", "b/a"} {
+		c.Set(name, vault.CacheEntry{DirID: name})
+	}
+
+	c.RemovePrefix("a/b/c/d")
+	assert.Equal(t, 5, c.Stats().Len, "missing prefixes must not remove anything")
+
+	c.RemovePrefix("a")
+	for _, name := range []string{"a", "a/b", "a/b/c"} {
+		_, ok := c.Get(name)
+		assert.False(t, ok, name)
+	}
+	for _, name := range []string{"ab", "b/a"} {
+		_, ok := c.Get(name)
+		assert.True(t, ok, name)
+	}
+
+	c.Set("a/b", vault.CacheEntry{DirID: "new"})
+	entry, ok := c.Get("a/b")
+	assert.True(t, ok)
+	assert.Equal(t, "new", entry.DirID)
+
+	c.RemovePrefix("")
+	assert.Zero(t, c.Stats().Len)
+
+	c.Set("b/a", vault.CacheEntry{DirID: "b/a"})
+	_, ok = c.Get("b/a")
+	assert.True(t, ok)
+}
+
+func TestSetCacheConcurrent(t *testing.T) {
+	v, _ := newTestVault(t)
+	require.NoError(t, v.Mkdir("a"))
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+
+		for i := 0; i < 100; i++ {
+			v.SetCache(vault.NewLRUCache(10, 0))
+		}
+	}()
+
+	for i := 0; i < 100; i++ {
+		_, err := v.GetDirID("a")
+		assert.NoError(t, err)
+	}
+
+	<-done
+}
+
+func TestCacheStats(t *testing.T) {
+	v, _ := newTestVault(t)
+	require.NoError(t, v.Mkdir("a"))
+	require.NoError(t, v.Mkdir("a/b"))
+
+	v.SetCache(vault.NewLRUCache(0, 0))
+
+	_, err := v.GetDirID("a/b")
+	require.NoError(t, err)
+	assert.Equal(t, vault.CacheStats{Misses: 2, Len: 2}, v.CacheStats(), "a/b and a miss once")
+
+	_, err = v.GetDirID("a/b")
+	require.NoError(t, err)
+	assert.Equal(t, vault.CacheStats{Hits: 1, Misses: 2, Len: 2}, v.CacheStats(), "a/b hits once")
+}
+
+func TestNegativeCache(t *testing.T) {
+	v, _ := newTestVault(t)
+
+	cache := vault.NewNegativeCache(vault.NewLRUCache(0, 0), 0, 0)
+	v.SetCache(cache)
+
+	for i := 0; i < 2; i++ {
+		_, err := v.GetDirID("missing/below")
+		assert.ErrorIs(t, err, fs.ErrNotExist)
+	}
+
+	entry, ok := cache.Get("missing")
+	assert.True(t, ok)
+	assert.True(t, entry.Missing)
+	assert.Equal(t, uint64(2), v.CacheStats().Hits)
+
+	assert.NoError(t, v.Mkdir("missing"))
+	_, err := v.GetDirID("missing")
+	assert.NoError(t, err)
+
+	_, err = v.GetDirID("file")
+	assert.ErrorIs(t, err, fs.ErrNotExist)
+	assert.NoError(t, v.WriteFile("file", strings.NewReader("content")))
+	assert.ErrorIs(t, v.Mkdir("file"), fs.ErrExist, "writing a file must forget the missing path")
+
+	v.InvalidateCache("")
+	assert.Zero(t, v.CacheStats().Len)
+}
@@ -0,0 +1,374 @@
+package vault
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"io/fs"
+	gopath "path"
+	"regexp"
+	"sort"
+	"strings"
+
+	"github.com/fhilgers/gocryptomator/internal/constants"
+)
+
+// encryptedName matches the base64url encoded names of encrypted nodes
+// without their suffix.
+var encryptedName = regexp.MustCompile(`^(?:[A-Za-z0-9_-]{4})*[A-Za-z0-9_-]{20}[A-Za-z0-9_=-]{4}$`)
+
+// ConflictError reports a conflict copy. ReadDir reports the copies it
+// cannot list with ErrConflictNotResolved, ResolveConflicts the copies it
+// cannot resolve. The copy is left in place in both cases.
+type ConflictError struct {
+	// Path is the encrypted path of the conflict copy.
+	Path string
+
+	// Name is the cleartext path of the node it conflicts with.
+	Name string
+
+	Err error
+}
+
+func (e *ConflictError) Error() string {
+	return fmt.Sprintf("sync conflict %s of %s: %v", e.Path, e.Name, e.Err)
+}
+
+func (e *ConflictError) Unwrap() error {
+	return e.Err
+}
+
+// OnConflict sets a function that is called with the conflict copies found
+// by ReadDir and those ResolveConflicts cannot resolve. It is safe to call
+// while v is in use.
+func (v *Vault) OnConflict(fn func(err *ConflictError)) {
+	v.settings.mu.Lock()
+	defer v.settings.mu.Unlock()
+
+	v.settings.onConflict = fn
+}
+
+func (v *Vault) conflictHandler() func(err *ConflictError) {
+	v.settings.mu.RLock()
+	defer v.settings.mu.RUnlock()
+
+	return v.settings.onConflict
+}
+
+// ResolveConflicts resolves the conflict copies sync clients created in the
+// directory name, the way the desktop application does. A copy is moved to
+// the name of its original if that is gone, removed if it is a directory
+// identical to the original, and moved to a cleartext name like
+// "report (Conflict 1).txt" otherwise. It returns the cleartext paths of the
+// copies that were kept. As this moves nodes other clients may use, v must
+// be opened with OpenLocked.
+func (v *Vault) ResolveConflicts(name string) ([]string, error) {
+	return v.ResolveConflictsContext(context.Background(), name)
+}
+
+// ResolveConflictsContext is like ResolveConflicts, but stops when ctx is
+// done.
+func (v *Vault) ResolveConflictsContext(ctx context.Context, name string) (resolved []string, err error) {
+	if err = v.checkWritable(); err != nil {
+		return
+	}
+
+	if v.storageLock == nil {
+		return nil, ErrNotStorageLocked
+	}
+
+	fsys := v.fsys(ctx)
+
+	lister, ok := fsys.(Lister)
+	if !ok {
+		return nil, ErrNotSupported
+	}
+
+	if name, err = v.cleanName("resolve", name, false); err != nil {
+		return
+	}
+
+	dirPath, dirID, err := v.GetDirPathContext(ctx, name)
+	if err != nil {
+		return
+	}
+
+	// The copies were mapped to the names they are listed with
+	defer v.nameMap.forget(dirID)
+
+	encEntries, err := lister.ReadDir(dirPath)
+	if err != nil {
+		return
+	}
+
+	for _, encEntry := range encEntries {
+		if err = ctx.Err(); err != nil {
+			return
+		}
+
+		if _, err := v.DecryptFileName(encEntry.Name(), dirID); err == nil {
+			continue
+		}
+
+		if clearName, ok := v.resolveConflict(ctx, lister, name, dirPath, dirID, encEntry); ok {
+			resolved = append(resolved, gopath.Join(name, clearName))
+		}
+	}
+
+	return
+}
+
+// conflictOriginal returns the encrypted and cleartext name of the node the
+// conflict copy encName belongs to. Sync clients add their suffix to the
+// encrypted name, like "ABC...= (1).c9r" or "ABC... (conflicted copy).c9r".
+// As the suffix may start with characters of the base64 alphabet, all
+// prefixes are tried, longest first.
+func (v *Vault) conflictOriginal(encName, dirID string) (originalEncName, clearName string, ok bool) {
+	base := strings.TrimSuffix(encName, constants.RegularSuffix)
+	if base == encName {
+		return
+	}
+
+	for n := (len(base) - 1) / 4 * 4; n > 0; n -= 4 {
+		if !encryptedName.MatchString(base[:n]) {
+			continue
+		}
+
+		originalEncName = base[:n] + constants.RegularSuffix
+		if clearName, err := v.DecryptFileName(originalEncName, dirID); err == nil {
+			return originalEncName, clearName, true
+		}
+	}
+
+	return "", "", false
+}
+
+// conflictCopy is a conflict copy found while listing a directory.
+type conflictCopy struct {
+	encEntry        fs.DirEntry
+	originalEncName string
+	original        string
+	info            *fileInfo
+}
+
+// conflictNames returns the names the conflict copies in the directory
+// dirPath are listed with, the names the resolution by ResolveConflicts
+// would give them. taken holds the names of the other entries and is
+// updated. A copy is listed under the name of its original if that is not
+// taken, not at all if it is a directory identical to the original, and
+// under the first free name from conflictFreeName otherwise. Copies that
+// get no name have an error.
+func (v *Vault) conflictNames(ctx context.Context, dirPath, dirID string, copies []conflictCopy, taken map[string]bool) (names []string, errs []error) {
+	sort.Slice(copies, func(i, j int) bool {
+		return copies[i].encEntry.Name() < copies[j].encEntry.Name()
+	})
+
+	policy := v.namePolicy()
+	names, errs = make([]string, len(copies)), make([]error, len(copies))
+
+	for i, c := range copies {
+		original := c.original
+		if normalized, err := policy.normalize(original); err == nil {
+			original = normalized
+		}
+
+		if !taken[original] {
+			names[i], taken[original] = original, true
+			continue
+		}
+
+		copyPath, originalPath := gopath.Join(dirPath, c.encEntry.Name()), gopath.Join(dirPath, c.originalEncName)
+		if c.encEntry.IsDir() && v.sameDirFile(ctx, copyPath, originalPath) {
+			continue
+		}
+
+		for n := 1; ; n++ {
+			altName, _, err := v.conflictFreeName(original, dirID, n)
+			if err != nil {
+				errs[i] = fmt.Errorf("%w: %v", ErrConflictNotResolved, err)
+				break
+			}
+
+			if !taken[altName] {
+				names[i], taken[altName] = altName, true
+				break
+			}
+		}
+	}
+
+	return
+}
+
+// reportConflict calls the OnConflict function with the conflict copy c in
+// the directory name, which ReadDir cannot list.
+func (v *Vault) reportConflict(name, dirPath string, c conflictCopy, err error) {
+	if onConflict := v.conflictHandler(); onConflict != nil {
+		onConflict(&ConflictError{
+			Path: gopath.Join(dirPath, c.encEntry.Name()),
+			Name: gopath.Join(name, c.original),
+			Err:  err,
+		})
+	}
+}
+
+// resolveConflict resolves a single conflict copy, see ResolveConflicts. It
+// returns the cleartext name of the copy if it was kept.
+func (v *Vault) resolveConflict(ctx context.Context, lister Lister, name, dirPath, dirID string, encEntry fs.DirEntry) (string, bool) {
+	encName, clearName, ok := v.conflictOriginal(encEntry.Name(), dirID)
+	if !ok {
+		return "", false
+	}
+
+	conflictPath := gopath.Join(dirPath, encEntry.Name())
+
+	report := func(err error) (string, bool) {
+		if onConflict := v.conflictHandler(); onConflict != nil {
+			onConflict(&ConflictError{Path: conflictPath, Name: gopath.Join(name, clearName), Err: err})
+		}
+		return "", false
+	}
+
+	// Nobody must create the new names in the meantime
+	defer v.locks.lock(name)()
+
+	originalPath := gopath.Join(dirPath, encName)
+
+	exists, err := v.exists(ctx, originalPath)
+	if err != nil {
+		return report(err)
+	}
+
+	if !exists {
+		if err := v.renameNode(ctx, lister, conflictPath, originalPath, encEntry.IsDir()); err != nil {
+			return report(err)
+		}
+
+		v.cache().RemovePrefix(gopath.Join(name, clearName))
+
+		return clearName, true
+	}
+
+	if encEntry.IsDir() && v.sameDirFile(ctx, conflictPath, originalPath) {
+		if err := v.fsys(ctx).RemoveFile(gopath.Join(conflictPath, constants.DirFile)); err != nil {
+			return report(err)
+		}
+
+		if err := v.fsys(ctx).RemoveDir(conflictPath); err != nil {
+			return report(err)
+		}
+
+		return "", false
+	}
+
+	for n := 1; ; n++ {
+		if err := ctx.Err(); err != nil {
+			return report(err)
+		}
+
+		altName, altEncName, err := v.conflictFreeName(clearName, dirID, n)
+		if err != nil {
+			return report(err)
+		}
+
+		altPath := gopath.Join(dirPath, altEncName)
+
+		if exists, err := v.exists(ctx, altPath); err != nil {
+			return report(err)
+		} else if exists {
+			continue
+		}
+
+		if err := v.renameNode(ctx, lister, conflictPath, altPath, encEntry.IsDir()); err != nil {
+			return report(err)
+		}
+
+		v.cache().RemovePrefix(gopath.Join(name, altName))
+
+		return altName, true
+	}
+}
+
+// conflictFreeName inserts " (Conflict n)" before the extension of name and
+// returns it with its encryption. The part before is cut short until the
+// name fits the MaxLength of the NamePolicy and its encryption needs no
+// shortening, which is not implemented.
+func (v *Vault) conflictFreeName(name, dirID string, n int) (altName, altEncName string, err error) {
+	ext := gopath.Ext(name)
+	if ext == name {
+		ext = ""
+	}
+
+	stem := []rune(strings.TrimSuffix(name, ext))
+	suffix := fmt.Sprintf(" (Conflict %d)%s", n, ext)
+	maxLength := v.namePolicy().MaxLength
+
+	for ; len(stem) > 0; stem = stem[:len(stem)-1] {
+		altName = string(stem) + suffix
+		if maxLength > 0 && len(altName) > maxLength {
+			continue
+		}
+
+		if altEncName, err = v.EncryptFileName(altName, dirID); err != nil {
+			return
+		}
+
+		if len(altEncName) <= constants.ConfigShorteningThreshold {
+			return
+		}
+	}
+
+	return "", "", fmt.Errorf("%w: no conflict free name for %q fits", ErrInvalidName, name)
+}
+
+// sameDirFile reports whether both nodes are directories with the same
+// directory id.
+func (v *Vault) sameDirFile(ctx context.Context, nodePath, otherPath string) bool {
+	read := func(nodePath string) ([]byte, error) {
+		r, err := v.fsys(ctx).Open(gopath.Join(nodePath, constants.DirFile))
+		if err != nil {
+			return nil, err
+		}
+		defer r.Close()
+
+		return io.ReadAll(r)
+	}
+
+	dirID, err := read(nodePath)
+	if err != nil {
+		return false
+	}
+
+	otherDirID, err := read(otherPath)
+	if err != nil {
+		return false
+	}
+
+	return bytes.Equal(dirID, otherDirID)
+}
+
+// renameNode moves a file node, or a directory node with everything in it.
+func (v *Vault) renameNode(ctx context.Context, lister Lister, oldPath, newPath string, isDir bool) (err error) {
+	fsys := v.fsys(ctx)
+
+	if _, ok := fsys.(Renamer); ok || !isDir {
+		return v.renameFile(ctx, oldPath, newPath)
+	}
+
+	entries, err := lister.ReadDir(oldPath)
+	if err != nil {
+		return
+	}
+
+	if err = fsys.MkdirAll(newPath); err != nil {
+		return
+	}
+
+	for _, entry := range entries {
+		if err = v.renameFile(ctx, gopath.Join(oldPath, entry.Name()), gopath.Join(newPath, entry.Name())); err != nil {
+			return
+		}
+	}
+
+	return fsys.RemoveDir(oldPath)
+}
@@ -0,0 +1,285 @@
+package vault
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	gopath "path"
+	"strings"
+
+	"github.com/fhilgers/gocryptomator/internal/constants"
+)
+
+func (v *Vault) DecryptPath(encryptedPath string) (string, error) {
+	return v.DecryptPathContext(context.Background(), encryptedPath)
+}
+
+// DecryptPathContext returns the cleartext path of encryptedPath, a path
+// relative to the storage root as reported by sync clients, like
+// d/AB/CDEF.../xyz.c9r or any file inside such a node. The data directory is
+// identified by its dirid.c9r, and the names of its ancestors are decrypted up
+// to the root. Anything but the root directory needs a Lister.
+func (v *Vault) DecryptPathContext(ctx context.Context, encryptedPath string) (string, error) {
+	return v.newReverseLookup(ctx).decryptPath(encryptedPath)
+}
+
+func (v *Vault) DecryptPaths(encryptedPaths []string) ([]string, error) {
+	return v.DecryptPathsContext(context.Background(), encryptedPaths)
+}
+
+// DecryptPathsContext is like DecryptPathContext for several paths at once.
+// The directories scanned to find the parents of one path are remembered for
+// the next, so this is much cheaper than decrypting the paths one by one.
+func (v *Vault) DecryptPathsContext(ctx context.Context, encryptedPaths []string) (paths []string, err error) {
+	r := v.newReverseLookup(ctx)
+
+	paths = make([]string, len(encryptedPaths))
+	for i, encryptedPath := range encryptedPaths {
+		if paths[i], err = r.decryptPath(encryptedPath); err != nil {
+			return nil, err
+		}
+	}
+
+	return
+}
+
+// reverseLookup resolves data directories to directory ids and directory
+// ids to the nodes referencing them. Directory ids are read from the
+// dirid.c9r backups. There is no backup of the parent, so the directory
+// tree is scanned breadth first from the root, one data directory at a time
+// and only until the wanted directory is found. What was scanned is kept for
+// later lookups.
+type reverseLookup struct {
+	v    *Vault
+	ctx  context.Context
+	fsys Fs
+
+	rootDir string
+	dirIDs  map[string]string
+	parents map[string]dirNode
+	queued  map[string]bool
+	pending []string
+}
+
+// dirNode is the node of a directory in the data directory of its parent.
+type dirNode struct {
+	dataDir  string
+	encName  string
+	parentID string
+}
+
+func (v *Vault) newReverseLookup(ctx context.Context) *reverseLookup {
+	return &reverseLookup{
+		v:       v,
+		ctx:     ctx,
+		fsys:    v.fsys(ctx),
+		dirIDs:  map[string]string{},
+		parents: map[string]dirNode{},
+		queued:  map[string]bool{RootDirID: true},
+		pending: []string{RootDirID},
+	}
+}
+
+func (r *reverseLookup) decryptPath(encryptedPath string) (path string, err error) {
+	defer func() {
+		if err != nil {
+			err = &fs.PathError{Op: "decryptpath", Path: encryptedPath, Err: err}
+		}
+	}()
+
+	segments := splitPath(encryptedPath)
+	if len(segments) < 3 || segments[0] != DataDir {
+		return "", fmt.Errorf("%w: not inside the data directory", fs.ErrInvalid)
+	}
+
+	dataDir := gopath.Join(segments[:3]...)
+
+	dirID, err := r.dirID(dataDir)
+	if err != nil {
+		return
+	}
+
+	if path, err = r.dirPath(dirID); err != nil {
+		return
+	}
+
+	if len(segments) == 3 || segments[3] == constants.DirIDBackupFile {
+		return
+	}
+
+	name, err := r.nodeName(dataDir, segments[3], dirID)
+	if err != nil {
+		return "", err
+	}
+
+	return gopath.Join(path, name), nil
+}
+
+func (r *reverseLookup) dirID(dataDir string) (dirID string, err error) {
+	if r.rootDir == "" {
+		if r.rootDir, err = r.v.PathFromDirID(RootDirID); err != nil {
+			return
+		}
+	}
+
+	if dataDir == r.rootDir {
+		return RootDirID, nil
+	}
+
+	if dirID, err = r.readBackup(dataDir); err == nil {
+		return
+	}
+
+	for {
+		if dirID, ok := r.dirIDs[dataDir]; ok {
+			return dirID, nil
+		}
+
+		if ok, err := r.scan(); err != nil {
+			return "", err
+		} else if !ok {
+			return "", fmt.Errorf("%w: directory is not referenced by any node", fs.ErrNotExist)
+		}
+	}
+}
+
+// readBackup returns the directory id in the dirid.c9r of dataDir if it
+// belongs to dataDir.
+func (r *reverseLookup) readBackup(dataDir string) (dirID string, err error) {
+	f, err := r.fsys.Open(gopath.Join(dataDir, constants.DirIDBackupFile))
+	if err != nil {
+		return
+	}
+	defer f.Close()
+
+	decReader, err := r.v.NewDecryptReader(f)
+	if err != nil {
+		return
+	}
+
+	content, err := io.ReadAll(decReader)
+	if err != nil {
+		return
+	}
+
+	dirID = string(content)
+
+	if backupDir, err := r.v.PathFromDirID(dirID); err != nil {
+		return "", err
+	} else if backupDir != dataDir {
+		return "", fmt.Errorf("%w: directory id backup belongs to %s", fs.ErrInvalid, backupDir)
+	}
+
+	return
+}
+
+// dirPath decrypts the names of the directory dirID and its ancestors.
+func (r *reverseLookup) dirPath(dirID string) (path string, err error) {
+	var names []string
+
+	for dirID != RootDirID {
+		node, err := r.parent(dirID)
+		if err != nil {
+			return "", err
+		}
+
+		name, err := r.nodeName(node.dataDir, node.encName, node.parentID)
+		if err != nil {
+			return "", err
+		}
+
+		names = append(names, name)
+		dirID = node.parentID
+	}
+
+	for i, j := 0, len(names)-1; i < j; i, j = i+1, j-1 {
+		names[i], names[j] = names[j], names[i]
+	}
+
+	return strings.Join(names, PathSeparator), nil
+}
+
+// parent returns the node referencing dirID, scanning directories until it
+// is found.
+func (r *reverseLookup) parent(dirID string) (dirNode, error) {
+	for {
+		if node, ok := r.parents[dirID]; ok {
+			return node, nil
+		}
+
+		if ok, err := r.scan(); err != nil {
+			return dirNode{}, err
+		} else if !ok {
+			return dirNode{}, fmt.Errorf("%w: directory is not referenced by any node", fs.ErrNotExist)
+		}
+	}
+}
+
+func (r *reverseLookup) nodeName(dataDir, encName, dirID string) (string, error) {
+	if strings.HasSuffix(encName, constants.ShortenedSuffix) {
+		longName, err := readShortenedName(r.fsys, gopath.Join(dataDir, encName))
+		if err != nil {
+			return "", err
+		}
+		encName = longName
+	}
+
+	return r.v.DecryptFileName(encName, dirID)
+}
+
+// scan reads the dir.c9r of every directory node in the next pending data
+// directory. It returns false once the whole tree has been scanned.
+func (r *reverseLookup) scan() (ok bool, err error) {
+	lister, ok := r.fsys.(Lister)
+	if !ok {
+		return false, ErrNotSupported
+	}
+
+	if err = r.ctx.Err(); err != nil {
+		return
+	}
+
+	if len(r.pending) == 0 {
+		return false, nil
+	}
+
+	parentID := r.pending[0]
+	r.pending = r.pending[1:]
+
+	dataDir, err := r.v.PathFromDirID(parentID)
+	if err != nil {
+		return
+	}
+
+	nodes, err := lister.ReadDir(dataDir)
+	if errors.Is(err, fs.ErrNotExist) {
+		return true, nil
+	} else if err != nil {
+		return
+	}
+
+	for _, node := range nodes {
+		if !node.IsDir() {
+			continue
+		}
+
+		dirID, err := r.v.getDirIDFromPath(r.ctx, gopath.Join(dataDir, node.Name(), constants.DirFile))
+		if err != nil || r.queued[dirID] {
+			continue
+		}
+
+		childDir, err := r.v.PathFromDirID(dirID)
+		if err != nil {
+			return false, err
+		}
+
+		r.queued[dirID] = true
+		r.dirIDs[childDir] = dirID
+		r.parents[dirID] = dirNode{dataDir: dataDir, encName: node.Name(), parentID: parentID}
+		r.pending = append(r.pending, dirID)
+	}
+
+	return true, nil
+}
@@ -0,0 +1,244 @@
+package vault
+
+import (
+	"context"
+	"io"
+	"io/fs"
+	gopath "path"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/fhilgers/gocryptomator/internal/constants"
+)
+
+type fileInfo struct {
+	name      string
+	size      int64
+	mode      fs.FileMode
+	modTime   time.Time
+	sys       fs.FileInfo
+	truncated bool
+}
+
+func (fi *fileInfo) Name() string       { return fi.name }
+func (fi *fileInfo) Size() int64        { return fi.size }
+func (fi *fileInfo) Mode() fs.FileMode  { return fi.mode }
+func (fi *fileInfo) ModTime() time.Time { return fi.modTime }
+func (fi *fileInfo) IsDir() bool        { return fi.mode.IsDir() }
+
+// Sys returns the fs.FileInfo of the encrypted node as reported by the Fs.
+func (fi *fileInfo) Sys() any { return fi.sys }
+
+// IsTruncated reports whether info, as returned by Stat or ReadDir, is of a
+// file whose encrypted size no valid file can have. Such files are reported
+// with size zero, opening or reading them fails with ErrTruncated.
+func IsTruncated(info fs.FileInfo) bool {
+	fi, ok := info.(*fileInfo)
+	return ok && fi.truncated
+}
+
+type dirEntry struct {
+	info *fileInfo
+}
+
+func (e dirEntry) Name() string               { return e.info.name }
+func (e dirEntry) IsDir() bool                { return e.info.IsDir() }
+func (e dirEntry) Type() fs.FileMode          { return e.info.mode.Type() }
+func (e dirEntry) Info() (fs.FileInfo, error) { return e.info, nil }
+
+// ReadDir lists the cleartext entries of the directory name, sorted by
+// name. Entries whose names cannot be decrypted are skipped. Conflict copies
+// created by sync clients are listed and looked up under the name of their
+// original if that is gone, or a name like "report (Conflict 1).txt",
+// without moving them, see ResolveConflicts. Names that are not normalized
+// are listed and looked up normalized, but stay as they are in the vault,
+// see NormalizeNames.
+func (v *Vault) ReadDir(name string) ([]fs.DirEntry, error) {
+	return v.ReadDirContext(context.Background(), name)
+}
+
+// ReadDirContext is like ReadDir, but stops decrypting the entries when ctx
+// is done.
+func (v *Vault) ReadDirContext(ctx context.Context, name string) ([]fs.DirEntry, error) {
+	fsys := v.fsys(ctx)
+
+	lister, ok := fsys.(Lister)
+	if !ok {
+		return nil, ErrNotSupported
+	}
+
+	name, err := v.cleanName("readdir", name, false)
+	if err != nil {
+		return nil, err
+	}
+
+	dirPath, dirID, err := v.GetDirPathContext(ctx, name)
+	if err != nil {
+		return nil, err
+	}
+
+	encEntries, err := lister.ReadDir(dirPath)
+	if err != nil {
+		return nil, err
+	}
+
+	infos := make([]*fileInfo, 0, len(encEntries))
+	var clearNames, encNames []string
+	var copies []conflictCopy
+	for _, encEntry := range encEntries {
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+
+		if clearName, ok := v.decryptEntryName(fsys, dirPath, dirID, encEntry); ok {
+			info, err := v.nodeInfo(lister, dirPath, clearName, encEntry)
+			if err != nil {
+				return nil, err
+			}
+			if info != nil {
+				infos = append(infos, info)
+				clearNames = append(clearNames, info.name)
+				encNames = append(encNames, encEntry.Name())
+			}
+			continue
+		}
+
+		if originalEncName, original, ok := v.conflictOriginal(encEntry.Name(), dirID); ok {
+			info, err := v.nodeInfo(lister, dirPath, original, encEntry)
+			if err != nil {
+				return nil, err
+			}
+			if info != nil {
+				copies = append(copies, conflictCopy{encEntry: encEntry, originalEncName: originalEncName, original: original, info: info})
+			}
+		}
+	}
+
+	names, copyNames, copyErrs := v.mapNames(ctx, dirPath, dirID, clearNames, encNames, copies)
+
+	entries := make([]fs.DirEntry, len(infos), len(infos)+len(copies))
+	for i, name := range names {
+		infos[i].name = name
+		entries[i] = dirEntry{infos[i]}
+	}
+
+	for i, c := range copies {
+		if copyErrs[i] != nil {
+			v.reportConflict(name, dirPath, c, copyErrs[i])
+		} else if copyNames[i] != "" {
+			c.info.name = copyNames[i]
+			entries = append(entries, dirEntry{c.info})
+		}
+	}
+
+	sort.Slice(entries, func(i, j int) bool {
+		return entries[i].Name() < entries[j].Name()
+	})
+
+	return entries, nil
+}
+
+// decryptEntry returns the cleartext info of a single encrypted node, or nil
+// if the node is not part of the vault structure or cannot be decrypted.
+func (v *Vault) decryptEntry(fsys Fs, lister Lister, dirPath, dirID string, encEntry fs.DirEntry) (*fileInfo, error) {
+	name, ok := v.decryptEntryName(fsys, dirPath, dirID, encEntry)
+	if !ok {
+		return nil, nil
+	}
+
+	return v.nodeInfo(lister, dirPath, name, encEntry)
+}
+
+// nodeInfo returns the info of the encrypted node encEntry listed as name, or
+// nil if the node is not part of the vault structure.
+func (v *Vault) nodeInfo(lister Lister, dirPath, name string, encEntry fs.DirEntry) (*fileInfo, error) {
+	if !encEntry.IsDir() {
+		return newFileInfo(name, 0, encEntry)
+	}
+
+	nodeEntries, err := lister.ReadDir(gopath.Join(dirPath, encEntry.Name()))
+	if err != nil {
+		return nil, err
+	}
+
+	for _, nodeEntry := range nodeEntries {
+		switch nodeEntry.Name() {
+		case constants.DirFile:
+			return newFileInfo(name, fs.ModeDir|0o755, encEntry)
+		case constants.SymlinkFile:
+			return newFileInfo(name, fs.ModeSymlink|0o777, nodeEntry)
+		case constants.ContentsFile:
+			return newFileInfo(name, 0, nodeEntry)
+		}
+	}
+
+	return nil, nil
+}
+
+// decryptEntryName returns the cleartext name of a single encrypted node. It
+// reports false if the node is not part of the vault structure or its name
+// cannot be decrypted.
+func (v *Vault) decryptEntryName(fsys Fs, dirPath, dirID string, encEntry fs.DirEntry) (string, bool) {
+	encName := encEntry.Name()
+
+	switch {
+	case strings.HasSuffix(encName, constants.ShortenedSuffix):
+		if !encEntry.IsDir() {
+			return "", false
+		}
+
+		longName, err := readShortenedName(fsys, gopath.Join(dirPath, encName))
+		if err != nil {
+			return "", false
+		}
+		encName = longName
+	case strings.HasSuffix(encName, constants.RegularSuffix):
+	default:
+		return "", false
+	}
+
+	name, err := v.DecryptFileName(encName, dirID)
+	if err != nil {
+		return "", false
+	}
+
+	return name, true
+}
+
+func newFileInfo(name string, mode fs.FileMode, encEntry fs.DirEntry) (*fileInfo, error) {
+	encInfo, err := encEntry.Info()
+	if err != nil {
+		return nil, err
+	}
+
+	info := &fileInfo{
+		name:    name,
+		mode:    mode,
+		modTime: encInfo.ModTime(),
+		sys:     encInfo,
+	}
+
+	if mode.IsRegular() {
+		info.mode |= 0o644
+		info.size, err = CalculateRawFileSize(encInfo.Size())
+		info.truncated = err != nil
+	}
+
+	return info, nil
+}
+
+func readShortenedName(fsys Fs, nodePath string) (string, error) {
+	r, err := fsys.Open(gopath.Join(nodePath, constants.ShortenedMetadataFile))
+	if err != nil {
+		return "", err
+	}
+	defer r.Close()
+
+	longName, err := io.ReadAll(r)
+	if err != nil {
+		return "", err
+	}
+
+	return string(longName), nil
+}
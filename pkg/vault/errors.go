@@ -0,0 +1,87 @@
+package vault
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+
+	"github.com/fhilgers/gocryptomator/internal/config"
+	"github.com/fhilgers/gocryptomator/internal/header"
+	"github.com/fhilgers/gocryptomator/internal/masterkey"
+	"github.com/fhilgers/gocryptomator/internal/stream"
+)
+
+// The errors below are matched with errors.Is. Missing and existing files
+// are reported with fs.ErrNotExist and fs.ErrExist, invalid names with
+// fs.ErrInvalid.
+var (
+	// ErrInvalidPassphrase is returned by Open for a wrong passphrase.
+	ErrInvalidPassphrase = masterkey.ErrInvalidPassphrase
+
+	// ErrMasterKeyMalformed is returned by Open if the masterkey file is
+	// corrupt. It is matched by every MasterKeyFieldError.
+	ErrMasterKeyMalformed = masterkey.ErrMalformed
+
+	// ErrConfigTampered is returned by Open if the signature of the vault
+	// config does not match the masterkey.
+	ErrConfigTampered = config.ErrTampered
+
+	// ErrConfigMalformed is returned by Open if the vault config cannot be
+	// parsed.
+	ErrConfigMalformed = config.ErrMalformed
+
+	// ErrUnsupported is returned by Open for vaults with an unsupported
+	// format, shortening threshold or cipher combo.
+	ErrUnsupported = config.ErrUnsupported
+
+	// ErrHeaderAuthentication is returned when opening a file whose header
+	// was modified or belongs to another vault.
+	ErrHeaderAuthentication = header.ErrAuthentication
+
+	// ErrChunkAuthentication is matched by the ChunkAuthError returned when
+	// reading a chunk that was modified, reordered or moved.
+	ErrChunkAuthentication = stream.ErrChunkAuthentication
+
+	// ErrTruncated is returned when reading a file whose ciphertext was cut
+	// off.
+	ErrTruncated = stream.ErrTruncated
+
+	// ErrNotDirectory is returned for paths that traverse a file.
+	ErrNotDirectory = errors.New("not a directory")
+
+	// ErrVaultLocked is returned by every operation on a vault after Lock.
+	ErrVaultLocked = errors.New("vault is locked")
+
+	// ErrVaultInUse is matched by the StorageLockedError returned if
+	// another process holds the StorageLock, and returned by writes after
+	// the lock was lost.
+	ErrVaultInUse = errors.New("vault is in use")
+
+	// ErrNotStorageLocked is returned by operations that move nodes other
+	// clients may use, unless the vault was opened with OpenLocked.
+	ErrNotStorageLocked = errors.New("operation needs the storage lock")
+
+	// ErrConflictNotResolved is the error of the ConflictError reported by
+	// ReadDir for the conflict copies it cannot list, see ResolveConflicts.
+	ErrConflictNotResolved = errors.New("conflict copy not resolved")
+
+	// ErrReadOnly is returned by every modifying operation on a vault
+	// opened with OpenReadOnly. It matches fs.ErrPermission.
+	ErrReadOnly = fmt.Errorf("%w: vault is read-only", fs.ErrPermission)
+
+	// ErrInvalidName is returned for names rejected by the NamePolicy. It
+	// matches fs.ErrInvalid.
+	ErrInvalidName = fmt.Errorf("%w: invalid name", fs.ErrInvalid)
+
+	// ErrNotSupported is returned if an operation needs an Fs extension the
+	// Fs does not implement.
+	ErrNotSupported = errors.New("operation not supported by the underlying fs")
+)
+
+// MasterKeyFieldError names the field of the masterkey file that is missing
+// or invalid.
+type MasterKeyFieldError = masterkey.FieldError
+
+// ChunkAuthError carries the number of the chunk that failed
+// authentication.
+type ChunkAuthError = stream.ChunkAuthError
@@ -0,0 +1,473 @@
+package vault
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	gopath "path"
+	"strings"
+
+	"github.com/fhilgers/gocryptomator/internal/constants"
+	"github.com/fhilgers/gocryptomator/internal/stream"
+	"github.com/google/uuid"
+)
+
+type decryptReadCloser struct {
+	*stream.Reader
+	io.Closer
+}
+
+// OpenFile opens the file name for reading. The returned reader decrypts
+// the contents and closes the underlying file on Close.
+func (v *Vault) OpenFile(name string) (io.ReadCloser, error) {
+	return v.OpenFileContext(context.Background(), name)
+}
+
+// OpenFileContext is like OpenFile. A ContextFs keeps ctx for reading the
+// returned file.
+func (v *Vault) OpenFileContext(ctx context.Context, name string) (io.ReadCloser, error) {
+	filePath, _, err := v.GetFilePathContext(ctx, name)
+	if err != nil {
+		return nil, err
+	}
+
+	r, err := v.fsys(ctx).Open(filePath)
+	if err != nil {
+		return nil, err
+	}
+
+	decReader, err := v.NewDecryptReader(r)
+	if err != nil {
+		r.Close()
+		return nil, err
+	}
+
+	return decryptReadCloser{decReader, r}, nil
+}
+
+type decryptReadSeekCloser struct {
+	*stream.ReadSeeker
+	io.Closer
+}
+
+// OpenSeekableFile opens the file name for random access reads. If the Fs
+// does not return seekable readers from Open, the encrypted file is read into
+// memory first. The reader also has a Nonce method returning the nonce from
+// the file header. A new nonce is generated every time a file is written, so
+// it identifies the version that was opened.
+func (v *Vault) OpenSeekableFile(name string) (io.ReadSeekCloser, error) {
+	return v.OpenSeekableFileContext(context.Background(), name)
+}
+
+func (v *Vault) OpenSeekableFileContext(ctx context.Context, name string) (io.ReadSeekCloser, error) {
+	filePath, _, err := v.GetFilePathContext(ctx, name)
+	if err != nil {
+		return nil, err
+	}
+
+	r, err := v.fsys(ctx).Open(filePath)
+	if err != nil {
+		return nil, err
+	}
+
+	seeker, ok := r.(io.ReadSeeker)
+	if !ok {
+		content, err := io.ReadAll(r)
+		r.Close()
+		if err != nil {
+			return nil, err
+		}
+
+		seeker, r = bytes.NewReader(content), io.NopCloser(nil)
+	}
+
+	decReader, err := v.NewDecryptReadSeeker(seeker)
+	if err != nil {
+		r.Close()
+		return nil, err
+	}
+
+	return decryptReadSeekCloser{decReader, r}, nil
+}
+
+// WriteFile encrypts everything from r into the new file name. It fails if
+// the file already exists.
+func (v *Vault) WriteFile(name string, r io.Reader) error {
+	return v.WriteFileContext(context.Background(), name, r)
+}
+
+// WriteFileContext is like WriteFile. If ctx is done before everything is
+// written, the partial file is removed.
+func (v *Vault) WriteFileContext(ctx context.Context, name string, r io.Reader) error {
+	if err := v.checkWritable(); err != nil {
+		return err
+	}
+
+	name, err := v.cleanName("write", name, true)
+	if err != nil {
+		return err
+	}
+
+	defer v.locks.lock(name)()
+
+	filePath, _, err := v.GetFilePathContext(ctx, name)
+	if err != nil {
+		return err
+	}
+
+	if err = v.writeEncrypted(ctx, filePath, r); err != nil {
+		return err
+	}
+
+	v.cache().RemovePrefix(name)
+
+	return nil
+}
+
+// ReplaceFile encrypts everything from r into the file name, replacing it
+// if it exists. The content is written under a temporary name first, so a
+// failed write leaves the old file in place.
+func (v *Vault) ReplaceFile(name string, r io.Reader) error {
+	return v.ReplaceFileContext(context.Background(), name, r)
+}
+
+// ReplaceFileContext is like ReplaceFile. If ctx is done before everything
+// is written, the old file is kept.
+func (v *Vault) ReplaceFileContext(ctx context.Context, name string, r io.Reader) error {
+	if err := v.checkWritable(); err != nil {
+		return err
+	}
+
+	name, err := v.cleanName("write", name, true)
+	if err != nil {
+		return err
+	}
+
+	defer v.locks.lock(name)()
+
+	filePath, _, err := v.GetFilePathContext(ctx, name)
+	if err != nil {
+		return err
+	}
+
+	// The temporary node is not a .c9r node, so listings skip it
+	tmpPath := gopath.Join(gopath.Dir(filePath), uuid.NewString()+".tmp")
+
+	if err = v.writeEncrypted(ctx, tmpPath, r); err != nil {
+		return err
+	}
+
+	if err = v.replaceFile(ctx, tmpPath, filePath); err != nil {
+		v.fsys(ctx).RemoveFile(tmpPath)
+		return err
+	}
+
+	v.cache().RemovePrefix(name)
+
+	return nil
+}
+
+// Remove removes the file name.
+func (v *Vault) Remove(name string) error {
+	return v.RemoveContext(context.Background(), name)
+}
+
+func (v *Vault) RemoveContext(ctx context.Context, name string) error {
+	if err := v.checkWritable(); err != nil {
+		return err
+	}
+
+	name, err := v.cleanName("remove", name, false)
+	if err != nil {
+		return err
+	}
+
+	defer v.locks.lock(name)()
+
+	filePath, dirID, err := v.GetFilePathContext(ctx, name)
+	if err != nil {
+		return err
+	}
+
+	if err := v.fsys(ctx).RemoveFile(filePath); err != nil {
+		return err
+	}
+
+	v.nameMap.remove(dirID, gopath.Base(name))
+
+	return nil
+}
+
+// RemoveAll removes name and, if it is a directory, everything it
+// contains. It returns nil if name does not exist.
+func (v *Vault) RemoveAll(name string) error {
+	return v.RemoveAllContext(context.Background(), name)
+}
+
+// RemoveAllContext is like RemoveAll, but stops when ctx is done, leaving
+// the parts not yet visited in place.
+func (v *Vault) RemoveAllContext(ctx context.Context, name string) error {
+	if err := v.checkWritable(); err != nil {
+		return err
+	}
+
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	if _, err := v.GetDirIDContext(ctx, name); err != nil {
+		if err = v.RemoveContext(ctx, name); errors.Is(err, fs.ErrNotExist) {
+			return nil
+		}
+		return err
+	}
+
+	entries, err := v.ReadDirContext(ctx, name)
+	if err != nil {
+		return err
+	}
+
+	for _, entry := range entries {
+		if err := v.RemoveAllContext(ctx, gopath.Join(name, entry.Name())); err != nil {
+			return err
+		}
+	}
+
+	return v.RmdirContext(ctx, name)
+}
+
+// Rename moves the file or directory oldName to newName. It fails if newName
+// already exists. Directories are moved by moving their dir.c9r, their
+// contents stay in place.
+func (v *Vault) Rename(oldName, newName string) (err error) {
+	return v.RenameContext(context.Background(), oldName, newName)
+}
+
+func (v *Vault) RenameContext(ctx context.Context, oldName, newName string) (err error) {
+	if err = v.checkWritable(); err != nil {
+		return
+	}
+
+	if oldName, err = v.cleanName("rename", oldName, false); err != nil {
+		return
+	}
+
+	if newName, err = v.cleanName("rename", newName, true); err != nil {
+		return
+	}
+
+	if oldName == "" || newName == "" {
+		return fmt.Errorf("%w: cannot rename the root directory", fs.ErrInvalid)
+	}
+
+	if oldName == newName {
+		return nil
+	}
+
+	if strings.HasPrefix(newName+PathSeparator, oldName+PathSeparator) {
+		return fmt.Errorf("%w: cannot move %s into itself", fs.ErrInvalid, oldName)
+	}
+
+	defer v.locks.lock(oldName, newName)()
+
+	oldPath, oldDirID, err := v.GetFilePathContext(ctx, oldName)
+	if err != nil {
+		return
+	}
+
+	newPath, _, err := v.GetFilePathContext(ctx, newName)
+	if err != nil {
+		return
+	}
+
+	exists, err := v.exists(ctx, newPath)
+	if err != nil {
+		return
+	}
+	if exists {
+		return &fs.PathError{Op: "rename", Path: newName, Err: fs.ErrExist}
+	}
+
+	if dirID, err := v.GetDirIDContext(ctx, oldName); err == nil {
+		if err = v.renameDir(ctx, oldName, newName, oldPath, newPath, dirID); err == nil {
+			v.nameMap.remove(oldDirID, gopath.Base(oldName))
+		}
+		return err
+	}
+
+	if err = v.renameFile(ctx, oldPath, newPath); err != nil {
+		return
+	}
+
+	v.nameMap.remove(oldDirID, gopath.Base(oldName))
+	v.cache().RemovePrefix(newName)
+
+	return
+}
+
+func (v *Vault) renameDir(ctx context.Context, oldName, newName, oldPath, newPath, dirID string) (err error) {
+	fsys := v.fsys(ctx)
+
+	if renamer, ok := fsys.(Renamer); ok {
+		if err = renamer.Rename(oldPath, newPath); err != nil {
+			return
+		}
+
+		v.cache().RemovePrefix(oldName)
+		v.cache().Set(newName, CacheEntry{DirID: dirID})
+
+		return
+	}
+
+	if err = fsys.MkdirAll(newPath); err != nil {
+		return
+	}
+
+	if err = v.writeDirIDToPath(ctx, gopath.Join(newPath, constants.DirFile), dirID); err != nil {
+		return
+	}
+
+	v.cache().RemovePrefix(oldName)
+	v.cache().Set(newName, CacheEntry{DirID: dirID})
+
+	if err = fsys.RemoveFile(gopath.Join(oldPath, constants.DirFile)); err != nil {
+		return
+	}
+
+	return fsys.RemoveDir(oldPath)
+}
+
+func (v *Vault) renameFile(ctx context.Context, oldPath, newPath string) (err error) {
+	fsys := v.fsys(ctx)
+
+	if renamer, ok := fsys.(Renamer); ok {
+		return renamer.Rename(oldPath, newPath)
+	}
+
+	if err = v.copyFile(ctx, oldPath, newPath); err != nil {
+		return
+	}
+
+	return fsys.RemoveFile(oldPath)
+}
+
+// replaceFile moves the file tmpPath over path. A Replacer does it in one
+// step. Otherwise the old file is moved aside and put back if moving tmpPath
+// fails, so its content is never lost.
+func (v *Vault) replaceFile(ctx context.Context, tmpPath, path string) (err error) {
+	fsys := v.fsys(ctx)
+
+	if replacer, ok := fsys.(Replacer); ok {
+		return replacer.Replace(tmpPath, path)
+	}
+
+	asidePath := gopath.Join(gopath.Dir(path), uuid.NewString()+".tmp")
+
+	if err = v.renameFile(ctx, path, asidePath); errors.Is(err, fs.ErrNotExist) {
+		return v.renameFile(ctx, tmpPath, path)
+	} else if err != nil {
+		return
+	}
+
+	if err = v.renameFile(ctx, tmpPath, path); err != nil {
+		v.renameFile(ctx, asidePath, path)
+		return
+	}
+
+	fsys.RemoveFile(asidePath)
+
+	return
+}
+
+// ChangePassphrase rewraps the masterkey with a new passphrase. The old
+// masterkey file is kept as a backup next to it, like the desktop
+// application does.
+func (v *Vault) ChangePassphrase(passphrase string) error {
+	return v.ChangePassphraseContext(context.Background(), passphrase)
+}
+
+// ChangePassphraseContext is like ChangePassphrase. The new masterkey file
+// is written under a temporary name first and moved into place once it is
+// complete.
+func (v *Vault) ChangePassphraseContext(ctx context.Context, passphrase string) (err error) {
+	if err = v.checkWritable(); err != nil {
+		return
+	}
+
+	fsys := v.fsys(ctx)
+
+	r, err := fsys.Open(constants.ConfigMasterkeyFileName)
+	if err != nil {
+		return
+	}
+
+	oldMasterKey, err := io.ReadAll(r)
+	r.Close()
+	if err != nil {
+		return
+	}
+
+	done, err := v.useKeys()
+	if err != nil {
+		return
+	}
+
+	masterKeyWriter := new(bytes.Buffer)
+	err = v.MasterKey.Marshal(masterKeyWriter, passphrase)
+	done()
+	if err != nil {
+		return
+	}
+
+	sum := sha256.Sum256(oldMasterKey)
+	backupName := fmt.Sprintf("%s.%X.bkup", constants.ConfigMasterkeyFileName, sum[:4])
+
+	if err = fsys.WriteString(backupName, string(oldMasterKey)); err != nil && !errors.Is(err, fs.ErrExist) {
+		return
+	}
+
+	// A leftover of an interrupted change is incomplete
+	tmpName := constants.ConfigMasterkeyFileName + ".tmp"
+	if err = fsys.RemoveFile(tmpName); err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return
+	}
+
+	if err = fsys.WriteString(tmpName, masterKeyWriter.String()); err != nil {
+		fsys.RemoveFile(tmpName)
+		return
+	}
+
+	if err = v.replaceFile(ctx, tmpName, constants.ConfigMasterkeyFileName); err != nil {
+		fsys.RemoveFile(tmpName)
+	}
+
+	return
+}
+
+func (v *Vault) exists(ctx context.Context, path string) (bool, error) {
+	fsys := v.fsys(ctx)
+
+	var err error
+	if stater, ok := fsys.(Stater); ok {
+		_, err = stater.Stat(path)
+	} else {
+		var r io.ReadCloser
+		if r, err = fsys.Open(path); err == nil {
+			r.Close()
+		}
+	}
+
+	if err == nil {
+		return true, nil
+	}
+
+	if errors.Is(err, fs.ErrNotExist) {
+		return false, nil
+	}
+
+	return false, err
+}
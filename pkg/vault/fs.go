@@ -0,0 +1,215 @@
+package vault
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"io/fs"
+)
+
+// The interfaces below are optional extensions of Fs. The vault detects them
+// with type assertions and falls back to the plain Fs methods where possible.
+
+// Lister is implemented by an Fs that can list directories. It is required
+// for ReadDir.
+type Lister interface {
+	// List the entries of a dir sorted by name, error if not exists
+	ReadDir(name string) ([]fs.DirEntry, error)
+}
+
+// Stater is implemented by an Fs that can query a single file or dir
+// without opening it.
+type Stater interface {
+	// Stat a file or dir, error if not exists
+	Stat(name string) (fs.FileInfo, error)
+}
+
+// Renamer is implemented by an Fs that can move files and dirs. Without it,
+// files are moved by copying and dirs by recreating them.
+type Renamer interface {
+	// Move a file or dir, error if oldName not exists, error if newName exists
+	Rename(oldName, newName string) error
+}
+
+// Replacer is implemented by an Fs that can move a file over an existing one
+// in one step. Without it, the existing file is moved aside first and only
+// removed once the new one is in place.
+type Replacer interface {
+	// Move a file, error if oldName not exists, replace newName if exists
+	Replace(oldName, newName string) error
+}
+
+// Copier is implemented by an Fs that can copy files without transferring
+// their content, like the copy operations of object stores.
+type Copier interface {
+	// Copy a file, error if src not exists, error if dst exists
+	Copy(src, dst string) error
+}
+
+// Creator is implemented by an Fs that can stream the content of new files.
+// Without it, files are buffered in memory and written with WriteString.
+type Creator interface {
+	// Create a new file for writing, fail if already exists. The content may
+	// only become visible after Close. If a write fails, the caller aborts
+	// the writer if it is an Aborter, or closes it and removes the file.
+	Create(name string) (io.WriteCloser, error)
+}
+
+// Aborter is implemented by writers returned from Creator.Create that can
+// discard their content instead of storing it, like multipart uploads that
+// would otherwise store a truncated file on Close.
+type Aborter interface {
+	// Abort the write, nothing written so far becomes visible, the writer
+	// must not be used afterwards
+	Abort() error
+}
+
+// ReadOnlyFs is all a vault opened with OpenReadOnly needs.
+type ReadOnlyFs interface {
+	Open(name string) (io.ReadCloser, error)
+	Lister
+}
+
+// readOnlyFs turns a ReadOnlyFs into an Fs whose modifying methods fail.
+type readOnlyFs struct {
+	ReadOnlyFs
+}
+
+func (f readOnlyFs) WriteString(name, content string) error {
+	return &fs.PathError{Op: "write", Path: name, Err: ErrReadOnly}
+}
+
+func (f readOnlyFs) RemoveDir(name string) error {
+	return &fs.PathError{Op: "remove", Path: name, Err: ErrReadOnly}
+}
+
+func (f readOnlyFs) RemoveFile(name string) error {
+	return &fs.PathError{Op: "remove", Path: name, Err: ErrReadOnly}
+}
+
+func (f readOnlyFs) MkdirAll(name string) error {
+	return &fs.PathError{Op: "mkdir", Path: name, Err: ErrReadOnly}
+}
+
+// ContextFs is implemented by an Fs whose operations can be cancelled. The
+// methods of the vault taking a context use the view returned by
+// WithContext for all their operations.
+type ContextFs interface {
+	// Return a view of the Fs bound to ctx, with the same extensions
+	WithContext(ctx context.Context) Fs
+}
+
+// fsys returns the Fs bound to ctx if it is a ContextFs.
+func (v *Vault) fsys(ctx context.Context) Fs {
+	if contextFs, ok := v.fs.(ContextFs); ok {
+		return contextFs.WithContext(ctx)
+	}
+
+	return v.fs
+}
+
+// interruptible runs fn in a goroutine and returns early with the error of
+// ctx if it is done first. fn keeps running, so it must not touch anything
+// the caller uses after an early return.
+func interruptible(ctx context.Context, fn func() error) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	done := make(chan error, 1)
+	go func() {
+		done <- fn()
+	}()
+
+	select {
+	case err := <-done:
+		return err
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// copyFile uses Copier if available and falls back to reading and writing
+// the content.
+func (v *Vault) copyFile(ctx context.Context, src, dst string) (err error) {
+	fsys := v.fsys(ctx)
+	if copier, ok := fsys.(Copier); ok {
+		return copier.Copy(src, dst)
+	}
+
+	r, err := fsys.Open(src)
+	if err != nil {
+		return
+	}
+	defer r.Close()
+
+	return v.writeRaw(ctx, dst, func(w io.Writer) error {
+		_, err := io.Copy(w, r)
+		return err
+	})
+}
+
+// writeRaw creates the new file name and writes what fill writes into it,
+// streaming it if the Fs is a Creator. fill only runs once the file is
+// created, so an existing file fails before fill reads anything. Without a
+// Creator, the content is buffered and written with WriteString.
+func (v *Vault) writeRaw(ctx context.Context, name string, fill func(w io.Writer) error) (err error) {
+	fsys := v.fsys(ctx)
+
+	creator, ok := fsys.(Creator)
+	if !ok {
+		content := new(bytes.Buffer)
+		if err = fill(content); err != nil {
+			return
+		}
+
+		return fsys.WriteString(name, content.String())
+	}
+
+	w, err := creator.Create(name)
+	if err != nil {
+		return
+	}
+
+	// Partial files are removed without the context, which may be done
+	if err = fill(w); err != nil {
+		if aborter, ok := w.(Aborter); ok {
+			aborter.Abort()
+			return
+		}
+
+		w.Close()
+		v.fs.RemoveFile(name)
+		return
+	}
+
+	if err = w.Close(); err != nil && !errors.Is(err, fs.ErrExist) {
+		v.fs.RemoveFile(name)
+	}
+
+	return
+}
+
+// writeEncrypted encrypts everything from r into the new file name. r is
+// read in the calling goroutine only, and not at all if name exists.
+func (v *Vault) writeEncrypted(ctx context.Context, name string, r io.Reader) error {
+	return v.writeRaw(ctx, name, func(w io.Writer) error {
+		encWriter, err := v.NewEncryptWriter(nopWriteCloser{w})
+		if err != nil {
+			return err
+		}
+
+		if _, err = io.Copy(encWriter, contextReader{ctx, r}); err != nil {
+			return err
+		}
+
+		return encWriter.Close()
+	})
+}
+
+type nopWriteCloser struct {
+	io.Writer
+}
+
+func (nopWriteCloser) Close() error { return nil }
@@ -0,0 +1,386 @@
+// Package fstest checks implementations of vault.Fs and its optional
+// extensions against their documented contracts. Backends run TestFs and
+// TestVault from their own tests:
+//
+//	func TestConformance(t *testing.T) {
+//		fstest.TestFs(t, func() vault.Fs { return newTestFs(t) })
+//	}
+package fstest
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"strings"
+	"testing"
+
+	"github.com/fhilgers/gocryptomator/pkg/vault"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// TestFs runs the conformance suite against the Fs returned by newFs, which
+// is called once per subtest and must return an empty Fs. Tests of optional
+// extensions the Fs does not implement are skipped.
+func TestFs(t *testing.T, newFs func() vault.Fs) {
+	tests := []struct {
+		name string
+		test func(t *testing.T, fsys vault.Fs)
+	}{
+		{"WriteString", testWriteString},
+		{"Open", testOpen},
+		{"MkdirAll", testMkdirAll},
+		{"RemoveDir", testRemoveDir},
+		{"RemoveFile", testRemoveFile},
+		{"Lister", testLister},
+		{"Stater", testStater},
+		{"Renamer", testRenamer},
+		{"Copier", testCopier},
+		{"Replacer", testReplacer},
+		{"Creator", testCreator},
+		{"ContextFs", testContextFs},
+	}
+
+	for _, test := range tests {
+		test := test
+		t.Run(test.name, func(t *testing.T) {
+			test.test(t, newFs())
+		})
+	}
+}
+
+func readFile(t *testing.T, fsys vault.Fs, name string) string {
+	r, err := fsys.Open(name)
+	require.NoError(t, err)
+	defer r.Close()
+
+	content, err := io.ReadAll(r)
+	require.NoError(t, err)
+
+	return string(content)
+}
+
+func testWriteString(t *testing.T, fsys vault.Fs) {
+	require.NoError(t, fsys.MkdirAll("dir"))
+
+	assert.NoError(t, fsys.WriteString("dir/file", "content"))
+	assert.Equal(t, "content", readFile(t, fsys, "dir/file"))
+
+	assert.ErrorIs(t, fsys.WriteString("dir/file", "other"), fs.ErrExist, "WriteString must fail on existing files")
+	assert.Equal(t, "content", readFile(t, fsys, "dir/file"), "WriteString must not modify existing files")
+
+	assert.NoError(t, fsys.WriteString("dir/empty", ""))
+	assert.Equal(t, "", readFile(t, fsys, "dir/empty"))
+
+	assert.NoError(t, fsys.WriteString("dir/name with spaces+ü", "content"))
+	assert.Equal(t, "content", readFile(t, fsys, "dir/name with spaces+ü"))
+
+	_, err := fsys.Open("dir/missing")
+	assert.ErrorIs(t, err, fs.ErrNotExist)
+
+	_, err = fsys.Open("dir/file/below")
+	assert.ErrorIs(t, err, fs.ErrNotExist, "paths below files must not exist")
+}
+
+func testOpen(t *testing.T, fsys vault.Fs) {
+	content := strings.Repeat("0123456789", 10*1024)
+	require.NoError(t, fsys.WriteString("file", content))
+
+	r, err := fsys.Open("file")
+	require.NoError(t, err)
+	defer r.Close()
+
+	// Readers that implement io.Seeker are used for random access
+	seeker, ok := r.(io.Seeker)
+	if !ok {
+		return
+	}
+
+	for _, offset := range []int64{5000, 10, int64(len(content)) - 10} {
+		pos, err := seeker.Seek(offset, io.SeekStart)
+		require.NoError(t, err)
+		assert.Equal(t, offset, pos)
+
+		part := make([]byte, 10)
+		_, err = io.ReadFull(r, part)
+		assert.NoError(t, err)
+		assert.Equal(t, content[offset:offset+10], string(part))
+	}
+
+	size, err := seeker.Seek(0, io.SeekEnd)
+	assert.NoError(t, err)
+	assert.Equal(t, int64(len(content)), size)
+}
+
+func testMkdirAll(t *testing.T, fsys vault.Fs) {
+	assert.NoError(t, fsys.MkdirAll("a/b/c"))
+	assert.NoError(t, fsys.MkdirAll("a/b/c"), "MkdirAll must not fail on existing dirs")
+	assert.NoError(t, fsys.MkdirAll("a/b"))
+
+	assert.NoError(t, fsys.WriteString("a/b/c/file", "content"))
+	assert.Equal(t, "content", readFile(t, fsys, "a/b/c/file"))
+}
+
+func testRemoveDir(t *testing.T, fsys vault.Fs) {
+	require.NoError(t, fsys.MkdirAll("a/b"))
+	require.NoError(t, fsys.WriteString("a/file", "content"))
+
+	assert.Error(t, fsys.RemoveDir("a"), "RemoveDir must fail on non empty dirs")
+	assert.Error(t, fsys.RemoveDir("a/file"), "RemoveDir must fail on files")
+	assert.ErrorIs(t, fsys.RemoveDir("a/missing"), fs.ErrNotExist)
+
+	assert.NoError(t, fsys.RemoveDir("a/b"))
+	assert.ErrorIs(t, fsys.RemoveDir("a/b"), fs.ErrNotExist)
+	assert.Equal(t, "content", readFile(t, fsys, "a/file"))
+}
+
+func testRemoveFile(t *testing.T, fsys vault.Fs) {
+	require.NoError(t, fsys.MkdirAll("a/b"))
+	require.NoError(t, fsys.WriteString("a/file", "content"))
+
+	assert.Error(t, fsys.RemoveFile("a/b"), "RemoveFile must fail on dirs")
+	assert.ErrorIs(t, fsys.RemoveFile("a/missing"), fs.ErrNotExist)
+
+	assert.NoError(t, fsys.RemoveFile("a/file"))
+	assert.ErrorIs(t, fsys.RemoveFile("a/file"), fs.ErrNotExist)
+
+	_, err := fsys.Open("a/file")
+	assert.ErrorIs(t, err, fs.ErrNotExist)
+	assert.NoError(t, fsys.WriteString("a/file", "recreated"), "removed files must be writable again")
+}
+
+func testLister(t *testing.T, fsys vault.Fs) {
+	lister, ok := fsys.(vault.Lister)
+	if !ok {
+		t.Skip("Fs does not implement Lister")
+	}
+
+	require.NoError(t, fsys.MkdirAll("a/c"))
+	require.NoError(t, fsys.MkdirAll("a/empty"))
+	require.NoError(t, fsys.WriteString("a/b", "content"))
+	require.NoError(t, fsys.WriteString("a/c/nested", "content"))
+
+	entries, err := lister.ReadDir("a")
+	require.NoError(t, err)
+	require.Len(t, entries, 3, "ReadDir must only list direct children")
+
+	assert.Equal(t, "b", entries[0].Name())
+	assert.False(t, entries[0].IsDir())
+	info, err := entries[0].Info()
+	assert.NoError(t, err)
+	assert.Equal(t, int64(len("content")), info.Size())
+
+	assert.Equal(t, "c", entries[1].Name())
+	assert.True(t, entries[1].IsDir())
+	assert.Equal(t, "empty", entries[2].Name())
+	assert.True(t, entries[2].IsDir())
+
+	entries, err = lister.ReadDir("a/empty")
+	assert.NoError(t, err)
+	assert.Empty(t, entries)
+
+	_, err = lister.ReadDir("missing")
+	assert.ErrorIs(t, err, fs.ErrNotExist)
+}
+
+func testStater(t *testing.T, fsys vault.Fs) {
+	stater, ok := fsys.(vault.Stater)
+	if !ok {
+		t.Skip("Fs does not implement Stater")
+	}
+
+	require.NoError(t, fsys.MkdirAll("a/b"))
+	require.NoError(t, fsys.WriteString("a/file", "content"))
+
+	info, err := stater.Stat("a/file")
+	require.NoError(t, err)
+	assert.Equal(t, "file", info.Name())
+	assert.False(t, info.IsDir())
+	assert.Equal(t, int64(len("content")), info.Size())
+
+	info, err = stater.Stat("a/b")
+	require.NoError(t, err)
+	assert.Equal(t, "b", info.Name())
+	assert.True(t, info.IsDir())
+
+	_, err = stater.Stat("a/missing")
+	assert.ErrorIs(t, err, fs.ErrNotExist)
+}
+
+func testRenamer(t *testing.T, fsys vault.Fs) {
+	renamer, ok := fsys.(vault.Renamer)
+	if !ok {
+		t.Skip("Fs does not implement Renamer")
+	}
+
+	require.NoError(t, fsys.MkdirAll("a/b"))
+	require.NoError(t, fsys.WriteString("a/b/file", "content"))
+	require.NoError(t, fsys.WriteString("a/other", "other"))
+
+	assert.NoError(t, renamer.Rename("a/b/file", "a/moved"))
+	assert.Equal(t, "content", readFile(t, fsys, "a/moved"))
+	_, err := fsys.Open("a/b/file")
+	assert.ErrorIs(t, err, fs.ErrNotExist)
+
+	assert.ErrorIs(t, renamer.Rename("a/moved", "a/other"), fs.ErrExist, "Rename must not replace existing files")
+	assert.Equal(t, "other", readFile(t, fsys, "a/other"))
+
+	assert.ErrorIs(t, renamer.Rename("a/missing", "a/new"), fs.ErrNotExist)
+
+	require.NoError(t, fsys.WriteString("a/b/file", "content"))
+	assert.NoError(t, renamer.Rename("a/b", "c"), "Rename must move dirs with their contents")
+	assert.Equal(t, "content", readFile(t, fsys, "c/file"))
+	assert.ErrorIs(t, fsys.RemoveDir("a/b"), fs.ErrNotExist)
+
+	require.NoError(t, fsys.MkdirAll("d"))
+	assert.ErrorIs(t, renamer.Rename("c", "d"), fs.ErrExist, "Rename must not replace existing dirs")
+	assert.Equal(t, "content", readFile(t, fsys, "c/file"))
+
+	// Only one of several concurrent renames to the same name may succeed
+	const n = 8
+	for i := 0; i < n; i++ {
+		require.NoError(t, fsys.WriteString(fmt.Sprintf("d/%d", i), fmt.Sprint(i)))
+	}
+
+	errs := make(chan error, n)
+	for i := 0; i < n; i++ {
+		go func(i int) {
+			errs <- renamer.Rename(fmt.Sprintf("d/%d", i), "d/target")
+		}(i)
+	}
+
+	renamed := 0
+	for i := 0; i < n; i++ {
+		if err := <-errs; err == nil {
+			renamed++
+		} else {
+			assert.ErrorIs(t, err, fs.ErrExist)
+		}
+	}
+	assert.Equal(t, 1, renamed)
+}
+
+func testCopier(t *testing.T, fsys vault.Fs) {
+	copier, ok := fsys.(vault.Copier)
+	if !ok {
+		t.Skip("Fs does not implement Copier")
+	}
+
+	require.NoError(t, fsys.MkdirAll("a/b"))
+	require.NoError(t, fsys.WriteString("a/file", "content"))
+	require.NoError(t, fsys.WriteString("a/other", "other"))
+
+	assert.NoError(t, copier.Copy("a/file", "a/b/copy"))
+	assert.Equal(t, "content", readFile(t, fsys, "a/b/copy"))
+	assert.Equal(t, "content", readFile(t, fsys, "a/file"), "Copy must keep the source")
+
+	assert.ErrorIs(t, copier.Copy("a/file", "a/other"), fs.ErrExist, "Copy must not replace existing files")
+	assert.Equal(t, "other", readFile(t, fsys, "a/other"))
+
+	assert.ErrorIs(t, copier.Copy("a/missing", "a/new"), fs.ErrNotExist)
+}
+
+func testReplacer(t *testing.T, fsys vault.Fs) {
+	replacer, ok := fsys.(vault.Replacer)
+	if !ok {
+		t.Skip("Fs does not implement Replacer")
+	}
+
+	require.NoError(t, fsys.MkdirAll("a/b"))
+	require.NoError(t, fsys.WriteString("a/file", "content"))
+	require.NoError(t, fsys.WriteString("a/new", "new"))
+
+	assert.NoError(t, replacer.Replace("a/new", "a/file"))
+	assert.Equal(t, "new", readFile(t, fsys, "a/file"), "Replace must replace existing files")
+
+	_, err := fsys.Open("a/new")
+	assert.ErrorIs(t, err, fs.ErrNotExist, "Replace must remove the source")
+
+	assert.NoError(t, replacer.Replace("a/file", "a/b/moved"))
+	assert.Equal(t, "new", readFile(t, fsys, "a/b/moved"))
+
+	assert.ErrorIs(t, replacer.Replace("a/missing", "a/b/moved"), fs.ErrNotExist)
+	assert.Equal(t, "new", readFile(t, fsys, "a/b/moved"), "failed replacements must keep the target")
+}
+
+func testCreator(t *testing.T, fsys vault.Fs) {
+	creator, ok := fsys.(vault.Creator)
+	if !ok {
+		t.Skip("Fs does not implement Creator")
+	}
+
+	require.NoError(t, fsys.MkdirAll("a"))
+
+	content := strings.Repeat("0123456789", 100*1024)
+
+	w, err := creator.Create("a/file")
+	require.NoError(t, err)
+	for r := bytes.NewReader([]byte(content)); r.Len() > 0; {
+		_, err = io.CopyN(w, r, 1000)
+		require.True(t, err == nil || err == io.EOF)
+	}
+	require.NoError(t, w.Close())
+	assert.Equal(t, content, readFile(t, fsys, "a/file"))
+
+	_, err = creator.Create("a/file")
+	assert.ErrorIs(t, err, fs.ErrExist, "Create must fail on existing files")
+
+	w, err = creator.Create("a/empty")
+	require.NoError(t, err)
+	require.NoError(t, w.Close())
+	assert.Equal(t, "", readFile(t, fsys, "a/empty"))
+
+	for _, size := range []int{10, len(content)} {
+		w, err = creator.Create("a/aborted")
+		require.NoError(t, err)
+
+		aborter, ok := w.(vault.Aborter)
+		if !ok {
+			w.Close()
+			return
+		}
+
+		_, err = io.WriteString(w, content[:size])
+		require.NoError(t, err)
+		assert.NoError(t, aborter.Abort())
+
+		_, err = fsys.Open("a/aborted")
+		assert.ErrorIs(t, err, fs.ErrNotExist, "Abort must not store anything")
+	}
+}
+
+func testContextFs(t *testing.T, fsys vault.Fs) {
+	contextFs, ok := fsys.(vault.ContextFs)
+	if !ok {
+		t.Skip("Fs does not implement ContextFs")
+	}
+
+	require.NoError(t, fsys.MkdirAll("a"))
+
+	bound := contextFs.WithContext(context.Background())
+	assert.NoError(t, bound.WriteString("a/file", "content"))
+	assert.Equal(t, "content", readFile(t, fsys, "a/file"))
+
+	for _, extension := range []func(vault.Fs) bool{
+		func(fsys vault.Fs) bool { _, ok := fsys.(vault.Lister); return ok },
+		func(fsys vault.Fs) bool { _, ok := fsys.(vault.Stater); return ok },
+		func(fsys vault.Fs) bool { _, ok := fsys.(vault.Renamer); return ok },
+		func(fsys vault.Fs) bool { _, ok := fsys.(vault.Copier); return ok },
+		func(fsys vault.Fs) bool { _, ok := fsys.(vault.Replacer); return ok },
+		func(fsys vault.Fs) bool { _, ok := fsys.(vault.Creator); return ok },
+	} {
+		assert.Equal(t, extension(fsys), extension(bound), "WithContext must keep the extensions")
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	err := contextFs.WithContext(ctx).WriteString("a/other", "content")
+	assert.True(t, errors.Is(err, context.Canceled), "operations must fail with the error of a done context, got %v", err)
+
+	_, err = fsys.Open("a/other")
+	assert.ErrorIs(t, err, fs.ErrNotExist)
+}
@@ -0,0 +1,136 @@
+package fstest
+
+import (
+	"bytes"
+	"crypto/rand"
+	"io"
+	"io/fs"
+	"strings"
+	"testing"
+
+	"github.com/fhilgers/gocryptomator/pkg/vault"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+const passphrase = "fstest passphrase"
+
+// TestVault runs an end-to-end round trip of a vault stored on the Fs
+// returned by newFs. Every step reopens the vault, so nothing is served
+// from the caches of a previous instance.
+func TestVault(t *testing.T, newFs func() vault.Fs) {
+	fsys := newFs()
+
+	v, err := vault.Create(fsys, passphrase)
+	require.NoError(t, err)
+	require.NoError(t, v.MkRootDir())
+
+	_, err = vault.Open(fsys, "wrong passphrase")
+	assert.Error(t, err, "Open must fail with the wrong passphrase")
+
+	reopen := func() *vault.Vault {
+		v, err := vault.Open(fsys, passphrase)
+		require.NoError(t, err)
+		return v
+	}
+
+	large := make([]byte, 100*1024+17)
+	_, err = rand.Read(large)
+	require.NoError(t, err)
+
+	files := map[string][]byte{
+		"empty":               {},
+		"small":               []byte("content"),
+		"dir/large":           large,
+		"dir/sub/with spaces": []byte("spaces"),
+		"dir/sub/ünïcödé":     []byte("unicode"),
+	}
+
+	v = reopen()
+	require.NoError(t, v.Mkdir("dir"))
+	require.NoError(t, v.Mkdir("dir/sub"))
+	for name, content := range files {
+		require.NoError(t, v.WriteFile(name, bytes.NewReader(content)), name)
+	}
+	assert.ErrorIs(t, v.WriteFile("small", strings.NewReader("other")), fs.ErrExist)
+
+	v = reopen()
+	for name, content := range files {
+		assert.Equal(t, content, readVaultFile(t, v, name), name)
+	}
+
+	if _, ok := fsys.(vault.Lister); ok {
+		assert.Equal(t, []string{"dir/", "empty", "small"}, vaultEntries(t, v, ""))
+		assert.Equal(t, []string{"large", "sub/"}, vaultEntries(t, v, "dir"))
+
+		entries, err := v.ReadDir("dir")
+		require.NoError(t, err)
+		info, err := entries[0].Info()
+		require.NoError(t, err)
+		assert.Equal(t, int64(len(large)), info.Size(), "ReadDir must report the plaintext size")
+	}
+
+	r, err := v.OpenSeekableFile("dir/large")
+	require.NoError(t, err)
+	_, err = r.Seek(40*1024, io.SeekStart)
+	require.NoError(t, err)
+	part := make([]byte, 1000)
+	_, err = io.ReadFull(r, part)
+	assert.NoError(t, err)
+	assert.Equal(t, large[40*1024:40*1024+1000], part)
+	assert.NoError(t, r.Close())
+
+	v = reopen()
+	require.NoError(t, v.Rename("small", "dir/sub/moved"))
+	require.NoError(t, v.Rename("dir/sub", "renamed"))
+	assert.ErrorIs(t, v.Rename("empty", "dir/large"), fs.ErrExist)
+
+	v = reopen()
+	assert.Equal(t, []byte("content"), readVaultFile(t, v, "renamed/moved"))
+	assert.Equal(t, []byte("spaces"), readVaultFile(t, v, "renamed/with spaces"))
+	_, err = v.OpenFile("small")
+	assert.ErrorIs(t, err, fs.ErrNotExist)
+	_, err = v.GetDirID("dir/sub")
+	assert.Error(t, err)
+
+	require.NoError(t, v.Remove("empty"))
+	assert.Error(t, v.Rmdir("renamed"), "Rmdir must fail on non empty dirs")
+	require.NoError(t, v.RemoveAll("renamed"))
+	require.NoError(t, v.RemoveAll("dir"))
+
+	v = reopen()
+	_, err = v.OpenFile("empty")
+	assert.ErrorIs(t, err, fs.ErrNotExist)
+	_, err = v.GetDirID("dir")
+	assert.Error(t, err)
+
+	if _, ok := fsys.(vault.Lister); ok {
+		assert.Empty(t, vaultEntries(t, v, ""))
+	}
+}
+
+func readVaultFile(t *testing.T, v *vault.Vault, name string) []byte {
+	r, err := v.OpenFile(name)
+	require.NoError(t, err)
+	defer r.Close()
+
+	content, err := io.ReadAll(r)
+	require.NoError(t, err)
+
+	return content
+}
+
+func vaultEntries(t *testing.T, v *vault.Vault, name string) []string {
+	entries, err := v.ReadDir(name)
+	require.NoError(t, err)
+
+	names := make([]string, len(entries))
+	for i, entry := range entries {
+		names[i] = entry.Name()
+		if entry.IsDir() {
+			names[i] += "/"
+		}
+	}
+
+	return names
+}
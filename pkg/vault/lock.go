@@ -0,0 +1,81 @@
+package vault
+
+import (
+	"fmt"
+	"sync"
+)
+
+// lockState is shared by all copies of a Vault, so that locking one of them
+// locks every copy.
+type lockState struct {
+	mu     sync.RWMutex
+	locked bool
+}
+
+// Lock wipes the masterkey and clears the directory id cache. Every further
+// operation fails with ErrVaultLocked. Lock waits for operations that are
+// currently using the keys. Files opened before Lock keep working until they
+// are closed, as their ciphers are set up when opening them. Locking a
+// locked vault does nothing.
+func (v *Vault) Lock() {
+	v.state.mu.Lock()
+	defer v.state.mu.Unlock()
+
+	if v.state.locked {
+		return
+	}
+
+	v.MasterKey.Wipe()
+	v.FullyInvalidate()
+	v.state.locked = true
+}
+
+// Close locks v and releases its StorageLock, if it was opened with
+// OpenLocked.
+func (v *Vault) Close() error {
+	v.Lock()
+
+	if v.storageLock != nil {
+		return v.storageLock.Release()
+	}
+
+	return nil
+}
+
+// checkWritable fails if v must not be modified.
+func (v *Vault) checkWritable() error {
+	if v.readOnly {
+		return ErrReadOnly
+	}
+
+	if v.storageLock == nil {
+		return nil
+	}
+
+	if err := v.storageLock.Err(); err != nil {
+		return fmt.Errorf("%w: storage lock lost: %v", ErrVaultInUse, err)
+	}
+
+	return nil
+}
+
+// Locked reports whether v was locked.
+func (v *Vault) Locked() bool {
+	v.state.mu.RLock()
+	defer v.state.mu.RUnlock()
+
+	return v.state.locked
+}
+
+// useKeys keeps Lock from wiping the keys until the returned function is
+// called. It fails with ErrVaultLocked if v is already locked.
+func (v *Vault) useKeys() (done func(), err error) {
+	v.state.mu.RLock()
+
+	if v.state.locked {
+		v.state.mu.RUnlock()
+		return nil, ErrVaultLocked
+	}
+
+	return v.state.mu.RUnlock, nil
+}
@@ -0,0 +1,430 @@
+package vault
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/fs"
+	gopath "path"
+	"strings"
+	"sync"
+	"time"
+	"unicode/utf8"
+
+	"github.com/fhilgers/gocryptomator/internal/constants"
+	"golang.org/x/text/unicode/norm"
+)
+
+// DefaultMaxNameLength is the longest name in bytes whose encrypted name
+// stays below the shortening threshold. Longer names would need name
+// shortening, which is not implemented yet.
+const DefaultMaxNameLength = 146
+
+// NamePolicy decides which cleartext names the vault accepts and how they
+// are normalized before they are encrypted. Names of existing files and
+// directories are only normalized and checked for what no vault can store,
+// like empty names or NUL characters, so that files created by other
+// clients stay accessible. New names are checked against the whole policy.
+type NamePolicy struct {
+	// Normalize converts names to the form they are encrypted in, so that
+	// names that look the same map to the same file. Nil keeps names as
+	// they are.
+	Normalize func(name string) string
+
+	// MaxLength is the maximum length of new names in bytes. Zero disables
+	// the check.
+	MaxLength int
+
+	// WindowsCompatible rejects new names that Windows clients cannot
+	// store: names with the characters <>:"|?*\ or control characters,
+	// names ending in a dot or space and reserved names like CON or LPT1.
+	WindowsCompatible bool
+}
+
+// DefaultNamePolicy normalizes names to NFC like the desktop application
+// does and only accepts names that every client can store.
+var DefaultNamePolicy = NamePolicy{
+	Normalize:         norm.NFC.String,
+	MaxLength:         DefaultMaxNameLength,
+	WindowsCompatible: true,
+}
+
+var windowsReservedNames = map[string]bool{
+	"CON": true, "PRN": true, "AUX": true, "NUL": true,
+	"COM1": true, "COM2": true, "COM3": true, "COM4": true, "COM5": true,
+	"COM6": true, "COM7": true, "COM8": true, "COM9": true,
+	"LPT1": true, "LPT2": true, "LPT3": true, "LPT4": true, "LPT5": true,
+	"LPT6": true, "LPT7": true, "LPT8": true, "LPT9": true,
+}
+
+// Check normalizes name and checks it against the whole policy.
+func (p NamePolicy) Check(name string) (string, error) {
+	name, err := p.normalize(name)
+	if err != nil {
+		return "", err
+	}
+
+	if p.MaxLength > 0 && len(name) > p.MaxLength {
+		return "", fmt.Errorf("%w: longer than %d bytes", ErrInvalidName, p.MaxLength)
+	}
+
+	if p.WindowsCompatible {
+		if i := strings.IndexAny(name, `<>:"|?*\`); i >= 0 {
+			return "", fmt.Errorf("%w: contains %q", ErrInvalidName, name[i])
+		}
+
+		for _, r := range name {
+			if r < ' ' {
+				return "", fmt.Errorf("%w: contains control character %U", ErrInvalidName, r)
+			}
+		}
+
+		if strings.HasSuffix(name, ".") || strings.HasSuffix(name, " ") {
+			return "", fmt.Errorf("%w: ends with a dot or space", ErrInvalidName)
+		}
+
+		base := strings.ToUpper(strings.SplitN(name, ".", 2)[0])
+		if windowsReservedNames[strings.TrimRight(base, " ")] {
+			return "", fmt.Errorf("%w: reserved on windows", ErrInvalidName)
+		}
+	}
+
+	return name, nil
+}
+
+// normalize normalizes name and rejects names no vault can store.
+func (p NamePolicy) normalize(name string) (string, error) {
+	switch {
+	case name == "" || name == "." || name == "..":
+		return "", fmt.Errorf("%w: %q", ErrInvalidName, name)
+	case strings.Contains(name, PathSeparator):
+		return "", fmt.Errorf("%w: contains %s", ErrInvalidName, PathSeparator)
+	case strings.ContainsRune(name, 0):
+		return "", fmt.Errorf("%w: contains NUL", ErrInvalidName)
+	case !utf8.ValidString(name):
+		return "", fmt.Errorf("%w: not valid UTF-8", ErrInvalidName)
+	}
+
+	if p.Normalize != nil {
+		name = p.Normalize(name)
+	}
+
+	return name, nil
+}
+
+// SetNamePolicy replaces the NamePolicy of v, which is DefaultNamePolicy
+// by default. It is safe to call while v is in use, the names mapped with
+// the old policy are forgotten.
+func (v *Vault) SetNamePolicy(p NamePolicy) {
+	v.settings.mu.Lock()
+	defer v.settings.mu.Unlock()
+
+	v.settings.names = p
+	v.nameMap.clear()
+}
+
+func (v *Vault) namePolicy() NamePolicy {
+	v.settings.mu.RLock()
+	defer v.settings.mu.RUnlock()
+
+	return v.settings.names
+}
+
+// cleanName cleans the path name and normalizes its segments. If create is
+// set, the last segment is a new name and checked against the whole policy.
+func (v *Vault) cleanName(op, name string, create bool) (string, error) {
+	segments := splitPath(name)
+	policy := v.namePolicy()
+
+	for i, segment := range segments {
+		var err error
+		if create && i == len(segments)-1 {
+			segments[i], err = policy.Check(segment)
+		} else {
+			segments[i], err = policy.normalize(segment)
+		}
+
+		if err != nil {
+			return "", &fs.PathError{Op: op, Path: name, Err: err}
+		}
+	}
+
+	return strings.Join(segments, PathSeparator), nil
+}
+
+// nameMapMaxAge is how long the mapping of a directory is trusted when a
+// name is not found in it. Other clients may add entries in the meantime.
+const nameMapMaxAge = time.Minute
+
+// nameMap maps, per directory id, the normalized names of entries whose
+// cleartext names are not normalized, as written by clients without a
+// NamePolicy, and the names of conflict copies to their encrypted node
+// names. A directory is mapped when it is listed, or when a name is looked
+// up that has no node under its encryption, so that such entries are found
+// by the names they are listed with, while their nodes are left as they
+// are.
+type nameMap struct {
+	mu   sync.Mutex
+	dirs map[string]mappedDir
+}
+
+type mappedDir struct {
+	names  map[string]string
+	mapped time.Time
+}
+
+func newNameMap() *nameMap {
+	return &nameMap{dirs: map[string]mappedDir{}}
+}
+
+// get returns the encrypted node name of name in the directory dirID. It
+// reports whether the directory was mapped within nameMapMaxAge.
+func (m *nameMap) get(dirID, name string) (encName string, fresh bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	dir, ok := m.dirs[dirID]
+
+	return dir.names[name], ok && time.Since(dir.mapped) < nameMapMaxAge
+}
+
+func (m *nameMap) set(dirID string, names map[string]string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.dirs[dirID] = mappedDir{names: names, mapped: time.Now()}
+}
+
+// remove forgets name once its node is gone.
+func (m *nameMap) remove(dirID, name string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	delete(m.dirs[dirID].names, name)
+}
+
+// forget drops the directory dirID, which is mapped again the next time
+// one of its names is missed.
+func (m *nameMap) forget(dirID string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	delete(m.dirs, dirID)
+}
+
+func (m *nameMap) clear() {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.dirs = map[string]mappedDir{}
+}
+
+// mapNames returns the names entries with the cleartext names clearNames
+// and the encrypted node names encNames are listed with, and maps the
+// directory dirID. Entries are listed with their normalized names, unless
+// another entry has that name already. The conflict copies in the directory
+// dirPath are listed with the names from conflictNames.
+func (v *Vault) mapNames(ctx context.Context, dirPath, dirID string, clearNames, encNames []string, copies []conflictCopy) (names, copyNames []string, copyErrs []error) {
+	names = make([]string, len(clearNames))
+	copy(names, clearNames)
+
+	taken := map[string]bool{}
+	for _, name := range clearNames {
+		taken[name] = true
+	}
+
+	mapped := map[string]string{}
+	if policy := v.namePolicy(); policy.Normalize != nil {
+		for i, name := range clearNames {
+			normalized, err := policy.normalize(name)
+			if err != nil || taken[normalized] {
+				continue
+			}
+
+			taken[normalized] = true
+			mapped[normalized] = encNames[i]
+			names[i] = normalized
+		}
+	}
+
+	copyNames, copyErrs = v.conflictNames(ctx, dirPath, dirID, copies, taken)
+	for i, name := range copyNames {
+		if name != "" {
+			mapped[name] = copies[i].encEntry.Name()
+		}
+	}
+
+	v.nameMap.set(dirID, mapped)
+
+	return
+}
+
+// encryptNodeName returns the encrypted node name of the normalized name in
+// the directory dirID. The encryption of name itself is used if a node
+// exists under it. Otherwise the directory is mapped, unless that happened
+// recently, to find an entry whose name is not normalized or a conflict
+// copy.
+func (v *Vault) encryptNodeName(ctx context.Context, name, dirID string) (string, error) {
+	encName, err := v.EncryptFileName(name, dirID)
+	if err != nil {
+		return "", err
+	}
+
+	mappedName, fresh := v.nameMap.get(dirID, name)
+	if fresh && mappedName != "" {
+		return mappedName, nil
+	} else if fresh {
+		return encName, nil
+	}
+
+	dirPath, err := v.PathFromDirID(dirID)
+	if err != nil {
+		return "", err
+	}
+
+	if exists, err := v.exists(ctx, gopath.Join(dirPath, encName)); err != nil || exists {
+		return encName, err
+	}
+
+	if err = v.mapDir(ctx, dirID); err != nil {
+		return "", err
+	}
+
+	if mappedName, _ = v.nameMap.get(dirID, name); mappedName != "" {
+		return mappedName, nil
+	}
+
+	return encName, nil
+}
+
+// mapDir lists the directory dirID to map its names. Directories that do
+// not exist yet, like the root directory of an empty vault, stay unmapped.
+func (v *Vault) mapDir(ctx context.Context, dirID string) error {
+	fsys := v.fsys(ctx)
+
+	lister, ok := fsys.(Lister)
+	if !ok {
+		return nil
+	}
+
+	dirPath, err := v.PathFromDirID(dirID)
+	if err != nil {
+		return err
+	}
+
+	encEntries, err := lister.ReadDir(dirPath)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+
+	var clearNames, encNames []string
+	var copies []conflictCopy
+	for _, encEntry := range encEntries {
+		if name, ok := v.decryptEntryName(fsys, dirPath, dirID, encEntry); ok {
+			clearNames = append(clearNames, name)
+			encNames = append(encNames, encEntry.Name())
+		} else if originalEncName, original, ok := v.conflictOriginal(encEntry.Name(), dirID); ok {
+			copies = append(copies, conflictCopy{encEntry: encEntry, originalEncName: originalEncName, original: original})
+		}
+	}
+
+	v.mapNames(ctx, dirPath, dirID, clearNames, encNames, copies)
+
+	return nil
+}
+
+// NormalizeNames moves the nodes in the directory name whose names are not
+// normalized, as written by clients without a NamePolicy, to the encryption
+// of their normalized names. Other clients see the normalized names
+// afterwards. Nodes whose normalized name is taken or would need name
+// shortening are left in place. It returns the cleartext paths of the
+// nodes that were moved. As this moves nodes other clients may use, v must
+// be opened with OpenLocked.
+func (v *Vault) NormalizeNames(name string) ([]string, error) {
+	return v.NormalizeNamesContext(context.Background(), name)
+}
+
+// NormalizeNamesContext is like NormalizeNames, but stops when ctx is done.
+func (v *Vault) NormalizeNamesContext(ctx context.Context, name string) (normalized []string, err error) {
+	if err = v.checkWritable(); err != nil {
+		return
+	}
+
+	if v.storageLock == nil {
+		return nil, ErrNotStorageLocked
+	}
+
+	fsys := v.fsys(ctx)
+
+	lister, ok := fsys.(Lister)
+	if !ok {
+		return nil, ErrNotSupported
+	}
+
+	policy := v.namePolicy()
+	if policy.Normalize == nil {
+		return
+	}
+
+	if name, err = v.cleanName("normalize", name, false); err != nil {
+		return
+	}
+
+	// Nobody must create the normalized names in the meantime
+	defer v.locks.lock(name)()
+
+	dirPath, dirID, err := v.GetDirPathContext(ctx, name)
+	if err != nil {
+		return
+	}
+
+	encEntries, err := lister.ReadDir(dirPath)
+	if err != nil {
+		return
+	}
+
+	for _, encEntry := range encEntries {
+		if err = ctx.Err(); err != nil {
+			return
+		}
+
+		clearName, ok := v.decryptEntryName(fsys, dirPath, dirID, encEntry)
+		if !ok {
+			continue
+		}
+
+		newName, err := policy.normalize(clearName)
+		if err != nil || newName == clearName {
+			continue
+		}
+
+		encName, err := v.EncryptFileName(newName, dirID)
+		if err != nil {
+			return normalized, err
+		}
+		if len(encName) > constants.ConfigShorteningThreshold {
+			continue
+		}
+
+		newPath := gopath.Join(dirPath, encName)
+
+		if exists, err := v.exists(ctx, newPath); err != nil {
+			return normalized, err
+		} else if exists {
+			continue
+		}
+
+		if err := v.renameNode(ctx, lister, gopath.Join(dirPath, encEntry.Name()), newPath, encEntry.IsDir()); err != nil {
+			return normalized, err
+		}
+
+		v.nameMap.remove(dirID, newName)
+		v.cache().RemovePrefix(gopath.Join(name, newName))
+
+		normalized = append(normalized, gopath.Join(name, newName))
+	}
+
+	return
+}
@@ -0,0 +1,104 @@
+package vault
+
+import (
+	"sort"
+	"strings"
+	"sync"
+)
+
+// pathLocks hands out read/write locks for cleaned vault paths. A lock is
+// dropped as soon as nobody holds or waits for it.
+type pathLocks struct {
+	mu    sync.Mutex
+	locks map[string]*pathLock
+}
+
+type pathLock struct {
+	sync.RWMutex
+	refs int
+}
+
+func newPathLocks() *pathLocks {
+	return &pathLocks{locks: map[string]*pathLock{}}
+}
+
+// lock locks every name for writing and all of their parents for reading,
+// so that no parent can be removed or renamed in the meantime. Locks are
+// taken in lexical order, which puts parents before their children and
+// prevents deadlocks between callers. The returned function unlocks
+// everything again.
+func (l *pathLocks) lock(names ...string) (unlock func()) {
+	write := map[string]bool{}
+	for _, name := range names {
+		name = cleanPath(name)
+		write[name] = true
+
+		for parent := name; parent != ""; {
+			parent = parentPath(parent)
+			if _, ok := write[parent]; !ok {
+				write[parent] = false
+			}
+		}
+	}
+
+	paths := make([]string, 0, len(write))
+	for path := range write {
+		paths = append(paths, path)
+	}
+	sort.Strings(paths)
+
+	for _, path := range paths {
+		lock := l.acquire(path)
+		if write[path] {
+			lock.Lock()
+		} else {
+			lock.RLock()
+		}
+	}
+
+	return func() {
+		for i := len(paths) - 1; i >= 0; i-- {
+			l.release(paths[i], write[paths[i]])
+		}
+	}
+}
+
+func (l *pathLocks) acquire(path string) *pathLock {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	lock, ok := l.locks[path]
+	if !ok {
+		lock = &pathLock{}
+		l.locks[path] = lock
+	}
+	lock.refs++
+
+	return lock
+}
+
+func (l *pathLocks) release(path string, write bool) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	lock := l.locks[path]
+	if write {
+		lock.Unlock()
+	} else {
+		lock.RUnlock()
+	}
+
+	if lock.refs--; lock.refs == 0 {
+		delete(l.locks, path)
+	}
+}
+
+// parentPath returns the parent of the cleaned path name, "" for top level
+// entries.
+func parentPath(name string) string {
+	if i := strings.LastIndex(name, PathSeparator); i >= 0 {
+		return name[:i]
+	}
+
+	return ""
+}
@@ -0,0 +1,276 @@
+package vault
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// UnlockFunc unlocks the vault at path, usually by asking for the passphrase
+// and calling Open. It is called by Sessions when a locked vault is
+// accessed.
+type UnlockFunc func(ctx context.Context, path string) (*Vault, error)
+
+type SessionOptions struct {
+	// IdleTimeout locks a vault that was not acquired for this long. Zero
+	// disables it.
+	IdleTimeout time.Duration
+
+	// MaxLifetime locks a vault this long after it was unlocked, no matter
+	// how often it is used. Zero disables it.
+	MaxLifetime time.Duration
+
+	// Unlock is called by Acquire for vaults that are locked or were never
+	// added. Without it, Acquire fails with ErrVaultLocked.
+	Unlock UnlockFunc
+}
+
+// Sessions holds unlocked vaults keyed by their path and locks them after
+// the idle timeout or lifetime of the options. Callers Acquire a vault for
+// every operation, including the whole time a file is open, and release it
+// afterwards. A vault that expires while acquired is handed out no more and
+// locked as soon as the last caller releases it.
+type Sessions struct {
+	opts SessionOptions
+
+	mu       sync.Mutex
+	sessions map[string]*session
+}
+
+type session struct {
+	// unlockMu serializes calls to the unlock callback.
+	unlockMu sync.Mutex
+
+	// current is nil while the vault is locked.
+	current *lease
+}
+
+// lease is one unlocked instance of a vault. After it expires, it stays
+// alive until refs drops to zero and is locked then.
+type lease struct {
+	vault *Vault
+
+	unlocked time.Time
+	lastUse  time.Time
+	refs     int
+	expired  bool
+
+	timer  *time.Timer
+	locked chan struct{}
+}
+
+func NewSessions(opts SessionOptions) *Sessions {
+	return &Sessions{
+		opts:     opts,
+		sessions: map[string]*session{},
+	}
+}
+
+// Add registers the unlocked vault v under path. A vault that was
+// registered before is locked once it is released.
+func (s *Sessions) Add(path string, v *Vault) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	sess, ok := s.sessions[path]
+	if !ok {
+		sess = &session{}
+		s.sessions[path] = sess
+	}
+
+	s.start(sess, v)
+}
+
+// Acquire returns the vault at path, unlocking it with the unlock callback
+// if needed. The vault is not locked by Sessions until release is called,
+// except by Lock and Close when their context is done.
+func (s *Sessions) Acquire(ctx context.Context, path string) (v *Vault, release func(), err error) {
+	s.mu.Lock()
+	sess, ok := s.sessions[path]
+	if !ok {
+		sess = &session{}
+		s.sessions[path] = sess
+	}
+	s.mu.Unlock()
+
+	sess.unlockMu.Lock()
+	defer sess.unlockMu.Unlock()
+
+	s.mu.Lock()
+	if sess.current == nil {
+		s.mu.Unlock()
+
+		if s.opts.Unlock == nil {
+			return nil, nil, ErrVaultLocked
+		}
+
+		if v, err = s.opts.Unlock(ctx, path); err != nil {
+			return nil, nil, err
+		}
+
+		s.mu.Lock()
+		s.start(sess, v)
+	}
+
+	l := sess.current
+	l.refs++
+	l.lastUse = time.Now()
+	s.mu.Unlock()
+
+	var once sync.Once
+	release = func() {
+		once.Do(func() {
+			s.mu.Lock()
+			defer s.mu.Unlock()
+
+			l.refs--
+			l.lastUse = time.Now()
+
+			if l.expired && l.refs == 0 {
+				s.lock(l)
+			}
+		})
+	}
+
+	return l.vault, release, nil
+}
+
+// Lock locks the vault at path. It waits for callers that acquired the
+// vault to release it. When ctx is done before, the vault is locked anyway,
+// so that their operations fail with ErrVaultLocked, and the error of ctx is
+// returned.
+func (s *Sessions) Lock(ctx context.Context, path string) error {
+	s.mu.Lock()
+	var l *lease
+	if sess, ok := s.sessions[path]; ok && sess.current != nil {
+		l = sess.current
+		s.expire(sess)
+	}
+	s.mu.Unlock()
+
+	if l == nil {
+		return nil
+	}
+
+	select {
+	case <-l.locked:
+		return nil
+	case <-ctx.Done():
+		s.mu.Lock()
+		s.lock(l)
+		s.mu.Unlock()
+
+		return ctx.Err()
+	}
+}
+
+// Close locks all vaults like Lock and forgets them.
+func (s *Sessions) Close(ctx context.Context) (err error) {
+	s.mu.Lock()
+	paths := make([]string, 0, len(s.sessions))
+	for path := range s.sessions {
+		paths = append(paths, path)
+	}
+	s.mu.Unlock()
+
+	for _, path := range paths {
+		if lockErr := s.Lock(ctx, path); err == nil {
+			err = lockErr
+		}
+	}
+
+	s.mu.Lock()
+	s.sessions = map[string]*session{}
+	s.mu.Unlock()
+
+	return
+}
+
+// start makes v the current lease of sess. s.mu must be held.
+func (s *Sessions) start(sess *session, v *Vault) {
+	if sess.current != nil {
+		s.expire(sess)
+	}
+
+	now := time.Now()
+	l := &lease{
+		vault:    v,
+		unlocked: now,
+		lastUse:  now,
+		locked:   make(chan struct{}),
+	}
+	sess.current = l
+
+	if deadline, ok := s.deadline(l); ok {
+		l.timer = time.AfterFunc(deadline.Sub(now), func() {
+			s.check(sess, l)
+		})
+	}
+}
+
+// check expires l once its deadline passed and reschedules itself
+// otherwise.
+func (s *Sessions) check(sess *session, l *lease) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if sess.current != l {
+		return
+	}
+
+	deadline, _ := s.deadline(l)
+	if wait := time.Until(deadline); wait > 0 {
+		l.timer.Reset(wait)
+		return
+	}
+
+	s.expire(sess)
+}
+
+// deadline returns when l expires if nobody uses it anymore. Acquired
+// leases never idle out.
+func (s *Sessions) deadline(l *lease) (deadline time.Time, ok bool) {
+	if s.opts.IdleTimeout > 0 {
+		deadline, ok = l.lastUse.Add(s.opts.IdleTimeout), true
+		if l.refs > 0 {
+			deadline = time.Now().Add(s.opts.IdleTimeout)
+		}
+	}
+
+	if s.opts.MaxLifetime > 0 {
+		if lifetime := l.unlocked.Add(s.opts.MaxLifetime); !ok || lifetime.Before(deadline) {
+			deadline, ok = lifetime, true
+		}
+	}
+
+	return
+}
+
+// expire detaches the current lease from sess and locks it unless it is
+// still acquired. s.mu must be held.
+func (s *Sessions) expire(sess *session) {
+	l := sess.current
+	sess.current = nil
+
+	l.expired = true
+	if l.timer != nil {
+		l.timer.Stop()
+	}
+
+	if l.refs == 0 {
+		s.lock(l)
+	}
+}
+
+// lock closes the vault of l once, which also releases its StorageLock.
+// s.mu must be held.
+func (s *Sessions) lock(l *lease) {
+	select {
+	case <-l.locked:
+		return
+	default:
+	}
+
+	l.vault.Close()
+	close(l.locked)
+}
@@ -0,0 +1,88 @@
+package vault_test
+
+import (
+	"context"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/fhilgers/gocryptomator/pkg/vault"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSessionsIdle(t *testing.T) {
+	v, fsys := newTestVault(t)
+
+	var unlocks int32
+	sessions := vault.NewSessions(vault.SessionOptions{
+		IdleTimeout: 50 * time.Millisecond,
+		Unlock: func(ctx context.Context, path string) (*vault.Vault, error) {
+			atomic.AddInt32(&unlocks, 1)
+			return vault.OpenContext(ctx, fsys, passphrase)
+		},
+	})
+	sessions.Add("vault", v)
+
+	acquired, release, err := sessions.Acquire(context.Background(), "vault")
+	require.NoError(t, err)
+	assert.Same(t, v, acquired)
+
+	time.Sleep(100 * time.Millisecond)
+	assert.False(t, v.Locked(), "acquired vaults must not idle out")
+
+	release()
+	assert.Eventually(t, v.Locked, time.Second, 10*time.Millisecond)
+
+	acquired, release, err = sessions.Acquire(context.Background(), "vault")
+	require.NoError(t, err)
+	defer release()
+
+	assert.NotSame(t, v, acquired)
+	assert.False(t, acquired.Locked())
+	assert.Equal(t, int32(1), atomic.LoadInt32(&unlocks))
+
+	_, err = acquired.ReadDir("")
+	assert.NoError(t, err)
+}
+
+func TestSessionsLifetime(t *testing.T) {
+	v, _ := newTestVault(t)
+
+	sessions := vault.NewSessions(vault.SessionOptions{MaxLifetime: 50 * time.Millisecond})
+	sessions.Add("vault", v)
+
+	_, release, err := sessions.Acquire(context.Background(), "vault")
+	require.NoError(t, err)
+
+	time.Sleep(100 * time.Millisecond)
+	assert.False(t, v.Locked(), "locking must wait for acquired vaults")
+
+	_, _, err = sessions.Acquire(context.Background(), "vault")
+	assert.ErrorIs(t, err, vault.ErrVaultLocked, "expired vaults must not be handed out")
+
+	release()
+	assert.True(t, v.Locked())
+}
+
+func TestSessionsLock(t *testing.T) {
+	v, _ := newTestVault(t)
+
+	sessions := vault.NewSessions(vault.SessionOptions{})
+	sessions.Add("vault", v)
+
+	acquired, release, err := sessions.Acquire(context.Background(), "vault")
+	require.NoError(t, err)
+	defer release()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+
+	assert.ErrorIs(t, sessions.Lock(ctx, "vault"), context.DeadlineExceeded)
+	assert.True(t, v.Locked())
+
+	_, err = acquired.ReadDir("")
+	assert.ErrorIs(t, err, vault.ErrVaultLocked)
+
+	assert.NoError(t, sessions.Close(context.Background()))
+}
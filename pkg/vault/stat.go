@@ -0,0 +1,173 @@
+package vault
+
+import (
+	"context"
+	"errors"
+	"io/fs"
+	gopath "path"
+
+	"github.com/fhilgers/gocryptomator/internal/constants"
+)
+
+// Stat returns the cleartext info of the file, directory or symlink name.
+// Files report their cleartext size and all nodes the modification time of
+// their encrypted node. Symlinks are not followed, like with os.Lstat. Files
+// whose encrypted size no valid file can have are reported with size zero,
+// like ReadDir does, see IsTruncated.
+func (v *Vault) Stat(name string) (fs.FileInfo, error) {
+	return v.StatContext(context.Background(), name)
+}
+
+// StatContext is like Stat. If the Fs is not a Stater, or the encrypted name
+// is shortened, the parent directory is listed instead, which needs a
+// Lister.
+func (v *Vault) StatContext(ctx context.Context, name string) (fs.FileInfo, error) {
+	fsys := v.fsys(ctx)
+
+	cleanName, err := v.cleanName("stat", name, false)
+	if err != nil {
+		return nil, err
+	}
+
+	parent, base := gopath.Split(cleanName)
+
+	dirPath, dirID, err := v.GetDirPathContext(ctx, parent)
+	if err != nil {
+		return nil, err
+	}
+
+	stater, ok := fsys.(Stater)
+
+	if base == "" {
+		info := &fileInfo{name: ".", mode: fs.ModeDir | 0o755}
+
+		if ok {
+			encInfo, err := stater.Stat(dirPath)
+			if err != nil {
+				return nil, err
+			}
+			info.modTime, info.sys = encInfo.ModTime(), encInfo
+		}
+
+		return info, nil
+	}
+
+	encName, err := v.encryptNodeName(ctx, base, dirID)
+	if err != nil {
+		return nil, err
+	}
+
+	var info *fileInfo
+	if ok && len(encName) <= constants.ConfigShorteningThreshold {
+		info, err = v.statNode(stater, gopath.Join(dirPath, encName), base)
+	} else {
+		info, err = v.statListed(fsys, dirPath, dirID, base, encName)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if info == nil {
+		return nil, &fs.PathError{Op: "stat", Path: name, Err: fs.ErrNotExist}
+	}
+
+	return info, nil
+}
+
+// statNode returns the info of the encrypted node nodePath, or nil if it
+// does not exist. Directory nodes are told apart by the files in them, like
+// ReadDir does.
+func (v *Vault) statNode(stater Stater, nodePath, name string) (*fileInfo, error) {
+	encInfo, err := stater.Stat(nodePath)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	if !encInfo.IsDir() {
+		return newFileInfo(name, 0, fs.FileInfoToDirEntry(encInfo))
+	}
+
+	for _, node := range []struct {
+		name string
+		mode fs.FileMode
+	}{
+		{constants.DirFile, fs.ModeDir | 0o755},
+		{constants.SymlinkFile, fs.ModeSymlink | 0o777},
+		{constants.ContentsFile, 0},
+	} {
+		fileInfo, err := stater.Stat(gopath.Join(nodePath, node.name))
+		if errors.Is(err, fs.ErrNotExist) {
+			continue
+		} else if err != nil {
+			return nil, err
+		}
+
+		// Directories report the node itself, like ReadDir
+		if node.mode.IsDir() {
+			fileInfo = encInfo
+		}
+
+		return newFileInfo(name, node.mode, fs.FileInfoToDirEntry(fileInfo))
+	}
+
+	return nil, nil
+}
+
+// statListed finds name, whose encrypted node name is encName, by listing
+// the directory dirPath. Names that are not normalized match their
+// normalized form, unless another entry has that name.
+func (v *Vault) statListed(fsys Fs, dirPath, dirID, name, encName string) (*fileInfo, error) {
+	lister, ok := fsys.(Lister)
+	if !ok {
+		return nil, ErrNotSupported
+	}
+
+	encEntries, err := lister.ReadDir(dirPath)
+	if err != nil {
+		return nil, err
+	}
+
+	policy := v.namePolicy()
+
+	var normalized *fileInfo
+	for _, encEntry := range encEntries {
+		// Conflict copies are mapped to the names they are listed with
+		if encEntry.Name() == encName {
+			return v.nodeInfo(lister, dirPath, name, encEntry)
+		}
+
+		clearName, ok := v.decryptEntryName(fsys, dirPath, dirID, encEntry)
+		if !ok {
+			continue
+		}
+
+		exact := clearName == name
+		if !exact {
+			if normalized != nil || policy.Normalize == nil {
+				continue
+			}
+			if n, err := policy.normalize(clearName); err != nil || n != name {
+				continue
+			}
+		}
+
+		info, err := v.decryptEntry(fsys, lister, dirPath, dirID, encEntry)
+		if err != nil {
+			return nil, err
+		}
+		if info == nil {
+			continue
+		}
+
+		if exact {
+			return info, nil
+		}
+
+		info.name = name
+		normalized = info
+	}
+
+	return normalized, nil
+}
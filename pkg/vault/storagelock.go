@@ -0,0 +1,353 @@
+package vault
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// LockFileName is the file at the root of the vault storage that holds the
+// StorageLock.
+const LockFileName = "gocryptomator.lock"
+
+// heartbeatFiles are written in turns by the heartbeat of a StorageLock, so
+// that one of them is complete while the other is rewritten.
+var heartbeatFiles = [2]string{LockFileName + ".heartbeat0", LockFileName + ".heartbeat1"}
+
+const (
+	DefaultHeartbeat  = 30 * time.Second
+	DefaultStaleAfter = 3 * DefaultHeartbeat
+)
+
+type StorageLockOptions struct {
+	// Owner identifies the holder in errors of other processes. It defaults
+	// to hostname:pid.
+	Owner string
+
+	// Heartbeat is the interval in which the lock file is refreshed. It
+	// defaults to DefaultHeartbeat.
+	Heartbeat time.Duration
+
+	// StaleAfter is the age of the last heartbeat after which a lock is
+	// considered abandoned and taken over. It defaults to DefaultStaleAfter
+	// and should leave room for clock skew between machines.
+	StaleAfter time.Duration
+
+	// Clock provides the time and the heartbeat ticks. It defaults to the
+	// system clock and is replaced in tests.
+	Clock Clock
+}
+
+// Clock is the source of time of a StorageLock.
+type Clock interface {
+	Now() time.Time
+
+	// Tick returns a channel that receives every d until stop is called
+	Tick(d time.Duration) (c <-chan time.Time, stop func())
+}
+
+type systemClock struct{}
+
+func (systemClock) Now() time.Time {
+	return time.Now()
+}
+
+func (systemClock) Tick(d time.Duration) (<-chan time.Time, func()) {
+	ticker := time.NewTicker(d)
+
+	return ticker.C, ticker.Stop
+}
+
+// StorageLockedError is returned when the storage is locked by someone
+// else. It matches ErrVaultInUse.
+type StorageLockedError struct {
+	Owner     string
+	Heartbeat time.Time
+}
+
+func (e *StorageLockedError) Error() string {
+	return fmt.Sprintf("vault is in use by %s, last seen %s", e.Owner, e.Heartbeat.Format(time.RFC3339))
+}
+
+func (e *StorageLockedError) Is(target error) bool {
+	return target == ErrVaultInUse
+}
+
+// StorageLock is an advisory lock that keeps processes and machines
+// sharing the storage of a vault from writing to it at the same time. It
+// is a file created exclusively through the Fs, which is left untouched
+// while it is held. The heartbeat goes to two separate files in turns, so
+// that there is always a complete one. As the Fs cannot replace files
+// atomically, two processes taking over the same stale lock at once may
+// both succeed, so StaleAfter should be generous.
+type StorageLock struct {
+	fs    Fs
+	opts  StorageLockOptions
+	token string
+
+	// beats counts the heartbeats written, the next one goes to
+	// heartbeatFiles[beats%2].
+	beats int
+
+	mu   sync.Mutex
+	err  error
+	lost chan struct{}
+	stop chan struct{}
+	done chan struct{}
+}
+
+type lockFile struct {
+	Owner     string    `json:"owner"`
+	Token     string    `json:"token"`
+	Heartbeat time.Time `json:"heartbeat"`
+}
+
+// AcquireStorageLock creates the lock file in fsys. It fails with a
+// StorageLockedError if somebody else holds a lock that is not stale.
+func AcquireStorageLock(ctx context.Context, fsys Fs, opts StorageLockOptions) (l *StorageLock, err error) {
+	if opts.Owner == "" {
+		hostname, _ := os.Hostname()
+		opts.Owner = fmt.Sprintf("%s:%d", hostname, os.Getpid())
+	}
+	if opts.Heartbeat <= 0 {
+		opts.Heartbeat = DefaultHeartbeat
+	}
+	if opts.StaleAfter <= 0 {
+		opts.StaleAfter = DefaultStaleAfter
+	}
+	if opts.Clock == nil {
+		opts.Clock = systemClock{}
+	}
+
+	l = &StorageLock{
+		fs:    fsys,
+		opts:  opts,
+		token: uuid.NewString(),
+		lost:  make(chan struct{}),
+		stop:  make(chan struct{}),
+		done:  make(chan struct{}),
+	}
+
+	// One attempt to create the file and one after taking over a stale lock
+	for attempt := 0; ; attempt++ {
+		if err = ctx.Err(); err != nil {
+			return nil, err
+		}
+
+		if err = l.write(LockFileName); !errors.Is(err, fs.ErrExist) || attempt == 1 {
+			break
+		}
+
+		var current lockFile
+		if current, err = l.read(); errors.Is(err, fs.ErrNotExist) {
+			continue
+		} else if err != nil {
+			return nil, err
+		}
+
+		if opts.Clock.Now().Sub(current.Heartbeat) < opts.StaleAfter {
+			return nil, &StorageLockedError{Owner: current.Owner, Heartbeat: current.Heartbeat}
+		}
+
+		// Narrow the window in which somebody else takes over first
+		if again, err := l.read(); err == nil && again.Token != current.Token {
+			continue
+		}
+
+		if err = fsys.RemoveFile(LockFileName); err != nil && !errors.Is(err, fs.ErrNotExist) {
+			return nil, err
+		}
+	}
+
+	if errors.Is(err, fs.ErrExist) {
+		current, _ := l.read()
+		return nil, &StorageLockedError{Owner: current.Owner, Heartbeat: current.Heartbeat}
+	} else if err != nil {
+		return nil, err
+	}
+
+	go l.heartbeat()
+
+	return l, nil
+}
+
+// Lost is closed when the lock was taken over by someone else or could not
+// be refreshed. Err reports why.
+func (l *StorageLock) Lost() <-chan struct{} {
+	return l.lost
+}
+
+func (l *StorageLock) Err() error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	return l.err
+}
+
+// Release stops the heartbeat and removes the lock file, unless the lock
+// was lost. Releasing a released lock does nothing.
+func (l *StorageLock) Release() error {
+	l.mu.Lock()
+	select {
+	case <-l.stop:
+		l.mu.Unlock()
+		return nil
+	default:
+		close(l.stop)
+	}
+	l.mu.Unlock()
+
+	<-l.done
+
+	if err := l.Err(); err != nil {
+		return err
+	}
+
+	if _, err := l.owned(); err != nil {
+		return err
+	}
+
+	if err := l.fs.RemoveFile(LockFileName); err != nil {
+		return err
+	}
+
+	// The heartbeats may belong to whoever took the lock in the meantime
+	for _, name := range heartbeatFiles {
+		if beat, err := l.readFile(name); err == nil && beat.Token == l.token {
+			l.fs.RemoveFile(name)
+		}
+	}
+
+	return nil
+}
+
+func (l *StorageLock) heartbeat() {
+	defer close(l.done)
+
+	tick, stop := l.opts.Clock.Tick(l.opts.Heartbeat)
+	defer stop()
+
+	for {
+		select {
+		case <-l.stop:
+			return
+		case <-tick:
+		}
+
+		if err := l.refresh(); err != nil {
+			l.mu.Lock()
+			l.err = err
+			l.mu.Unlock()
+
+			close(l.lost)
+			return
+		}
+	}
+}
+
+// refresh writes the current time to the next heartbeat file. The other
+// one keeps the previous heartbeat while it is written.
+func (l *StorageLock) refresh() error {
+	if _, err := l.owned(); err != nil {
+		return err
+	}
+
+	name := heartbeatFiles[l.beats%2]
+	l.beats++
+
+	if err := l.fs.RemoveFile(name); err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return err
+	}
+
+	if err := l.write(name); errors.Is(err, fs.ErrExist) {
+		return fmt.Errorf("%w: lock was taken over", ErrVaultInUse)
+	} else if err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// owned fails if the lock file does not belong to l anymore.
+func (l *StorageLock) owned() (current lockFile, err error) {
+	if current, err = l.read(); err != nil {
+		return
+	}
+
+	if current.Token != l.token {
+		err = &StorageLockedError{Owner: current.Owner, Heartbeat: current.Heartbeat}
+	}
+
+	return
+}
+
+func (l *StorageLock) write(name string) error {
+	content, err := json.Marshal(lockFile{
+		Owner:     l.opts.Owner,
+		Token:     l.token,
+		Heartbeat: l.opts.Clock.Now().UTC(),
+	})
+	if err != nil {
+		return err
+	}
+
+	return l.fs.WriteString(name, string(content))
+}
+
+// read returns the lock file with the latest heartbeat of its holder. A
+// lock file that cannot be parsed is probably still being written and
+// counts as fresh, unless the Fs is a Stater and reports it as old.
+func (l *StorageLock) read() (current lockFile, err error) {
+	current, err = l.readFile(LockFileName)
+	if errors.Is(err, errMalformedLock) {
+		current = lockFile{Owner: "unknown", Heartbeat: l.opts.Clock.Now()}
+
+		if stater, ok := l.fs.(Stater); ok {
+			if info, err := stater.Stat(LockFileName); err == nil {
+				current.Heartbeat = info.ModTime()
+			}
+		}
+
+		return current, nil
+	} else if err != nil {
+		return
+	}
+
+	for _, name := range heartbeatFiles {
+		beat, err := l.readFile(name)
+		if err == nil && beat.Token == current.Token && beat.Heartbeat.After(current.Heartbeat) {
+			current.Heartbeat = beat.Heartbeat
+		}
+	}
+
+	return
+}
+
+var errMalformedLock = errors.New("malformed lock file")
+
+func (l *StorageLock) readFile(name string) (current lockFile, err error) {
+	r, err := l.fs.Open(name)
+	if err != nil {
+		return
+	}
+	defer r.Close()
+
+	content, err := io.ReadAll(r)
+	if err != nil {
+		return
+	}
+
+	if json.Unmarshal(content, &current) != nil || current.Token == "" {
+		err = errMalformedLock
+	}
+
+	return
+}
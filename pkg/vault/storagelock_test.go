@@ -0,0 +1,168 @@
+package vault_test
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/fhilgers/gocryptomator/pkg/vault"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// fakeClock is a vault.Clock driven by the test. Its ticks are unbuffered,
+// so a tick is only delivered once the heartbeat of the previous one is
+// written.
+type fakeClock struct {
+	mu   sync.Mutex
+	now  time.Time
+	tick chan time.Time
+}
+
+func newFakeClock(now time.Time) *fakeClock {
+	return &fakeClock{now: now, tick: make(chan time.Time)}
+}
+
+func (c *fakeClock) Now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return c.now
+}
+
+func (c *fakeClock) Tick(d time.Duration) (<-chan time.Time, func()) {
+	return c.tick, func() {}
+}
+
+func (c *fakeClock) advance(d time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.now = c.now.Add(d)
+}
+
+// beat advances the time by d and delivers a heartbeat tick.
+func (c *fakeClock) beat(d time.Duration) {
+	c.advance(d)
+	c.tick <- c.Now()
+}
+
+func TestStorageLock(t *testing.T) {
+	_, fsys := newTestVault(t)
+	ctx := context.Background()
+	clock := newFakeClock(time.Now())
+	opts := vault.StorageLockOptions{Owner: "first", Heartbeat: time.Minute, StaleAfter: 3 * time.Minute, Clock: clock}
+
+	v1, err := vault.OpenLocked(ctx, fsys, passphrase, opts)
+	require.NoError(t, err)
+
+	// Twice as long as StaleAfter, the previous heartbeat is at most a
+	// minute old
+	for i := 0; i < 6; i++ {
+		clock.beat(time.Minute)
+	}
+
+	opts.Owner = "second"
+	_, err = vault.OpenLocked(ctx, fsys, passphrase, opts)
+	assert.ErrorIs(t, err, vault.ErrVaultInUse, "the heartbeat must keep the lock fresh")
+
+	var lockedErr *vault.StorageLockedError
+	if assert.ErrorAs(t, err, &lockedErr) {
+		assert.Equal(t, "first", lockedErr.Owner)
+	}
+
+	v2, err := vault.OpenReadOnly(fsys, passphrase)
+	require.NoError(t, err, "readers ignore the lock")
+	_, err = v2.ReadDir("")
+	assert.NoError(t, err)
+	assert.ErrorIs(t, v2.Mkdir("dir"), vault.ErrReadOnly, "readers must not write")
+
+	assert.NoError(t, v1.Close())
+
+	v3, err := vault.OpenLocked(ctx, fsys, passphrase, opts)
+	require.NoError(t, err)
+	assert.NoError(t, v3.Close())
+}
+
+func TestStorageLockTakeover(t *testing.T) {
+	_, fsys := newTestVault(t)
+	ctx := context.Background()
+
+	clock := newFakeClock(time.Now())
+
+	stale := fmt.Sprintf(`{"owner":"crashed","token":"t","heartbeat":%q}`, clock.Now().Add(-time.Hour).Format(time.RFC3339Nano))
+	require.NoError(t, fsys.WriteString(vault.LockFileName, stale))
+
+	opts := vault.StorageLockOptions{Heartbeat: time.Minute, StaleAfter: time.Hour, Clock: clock}
+
+	v, err := vault.OpenLocked(ctx, fsys, passphrase, opts)
+	require.NoError(t, err, "stale locks must be taken over")
+	assert.NoError(t, v.Mkdir("dir"))
+
+	// Somebody else takes over once this process missed its heartbeats,
+	// e.g. while it was suspended
+	clock.advance(2 * time.Hour)
+	otherClock := newFakeClock(clock.Now())
+	other, err := vault.AcquireStorageLock(ctx, fsys, vault.StorageLockOptions{Owner: "other", StaleAfter: time.Hour, Clock: otherClock})
+	require.NoError(t, err)
+	defer other.Release()
+
+	clock.beat(time.Minute)
+
+	assert.Eventually(t, func() bool {
+		return v.Mkdir("other") != nil
+	}, time.Second, 10*time.Millisecond)
+	assert.ErrorIs(t, v.Mkdir("other"), vault.ErrVaultInUse)
+	assert.ErrorIs(t, v.Close(), vault.ErrVaultInUse)
+}
+
+func TestStorageLockHeartbeat(t *testing.T) {
+	_, fsys := newTestVault(t)
+	ctx := context.Background()
+	clock := newFakeClock(time.Now())
+	opts := vault.StorageLockOptions{Owner: "first", Heartbeat: time.Minute, StaleAfter: 3 * time.Minute, Clock: clock}
+
+	l, err := vault.AcquireStorageLock(ctx, fsys, opts)
+	require.NoError(t, err)
+
+	// The lock file itself is never rewritten and one heartbeat is always
+	// complete, so others find a fresh lock while the heartbeat runs
+	opts.Owner = "second"
+	for i := 0; i < 200; i++ {
+		clock.beat(time.Minute)
+
+		_, err := vault.AcquireStorageLock(ctx, fsys, opts)
+		require.ErrorIs(t, err, vault.ErrVaultInUse)
+	}
+
+	select {
+	case <-l.Lost():
+		t.Fatalf("lock lost: %v", l.Err())
+	default:
+	}
+
+	require.NoError(t, l.Release())
+
+	// A lock file that is still being written is not stale
+	require.NoError(t, fsys.WriteString(vault.LockFileName, `{"owner":"third","tok`))
+	_, err = vault.AcquireStorageLock(ctx, fsys, vault.StorageLockOptions{StaleAfter: time.Minute})
+	assert.ErrorIs(t, err, vault.ErrVaultInUse)
+}
+
+func TestStorageLockSessions(t *testing.T) {
+	_, fsys := newTestVault(t)
+	ctx := context.Background()
+
+	v, err := vault.OpenLocked(ctx, fsys, passphrase, vault.StorageLockOptions{})
+	require.NoError(t, err)
+
+	sessions := vault.NewSessions(vault.SessionOptions{})
+	sessions.Add("vault", v)
+	require.NoError(t, sessions.Lock(ctx, "vault"))
+
+	l, err := vault.AcquireStorageLock(ctx, fsys, vault.StorageLockOptions{})
+	require.NoError(t, err, "locked sessions must release the storage lock")
+	assert.NoError(t, l.Release())
+}
@@ -2,8 +2,11 @@ package vault
 
 import (
 	"bytes"
+	"context"
+	"errors"
 	"fmt"
 	"io"
+	"io/fs"
 	gopath "path"
 	"strings"
 	"sync"
@@ -15,9 +18,8 @@ import (
 	"github.com/fhilgers/gocryptomator/internal/masterkey"
 	"github.com/fhilgers/gocryptomator/internal/path"
 	"github.com/fhilgers/gocryptomator/internal/stream"
+	"github.com/fhilgers/gocryptomator/internal/wipe"
 	"github.com/google/uuid"
-
-	"github.com/orcaman/concurrent-map/v2"
 )
 
 const (
@@ -43,28 +45,46 @@ type Fs interface {
 	MkdirAll(name string) error
 }
 
-type cacheEntry struct {
-	DirID string
-}
+type (
+	SalvageMode = stream.SalvageMode
+	Damage      = stream.Damage
+)
+
+const (
+	SalvageZero = stream.SalvageZero
+	SalvageOmit = stream.SalvageOmit
+)
 
 type Vault struct {
 	config.Config
 	masterkey.MasterKey
 
-	fs Fs
+	fs    Fs
+	state *lockState
 
-	mkDirLock cmap.ConcurrentMap[string, *sync.Mutex]
-	cache     cmap.ConcurrentMap[string, cacheEntry]
+	locks       *pathLocks
+	settings    *settings
+	storageLock *StorageLock
+	readOnly    bool
+	nameMap     *nameMap
 }
 
 func Open(fs Fs, passphrase string) (vault *Vault, err error) {
+	return OpenContext(context.Background(), fs, passphrase)
+}
+
+// OpenContext is like Open. The key derivation is abandoned when ctx is
+// done, but keeps running in the background until it finishes.
+func OpenContext(ctx context.Context, fs Fs, passphrase string) (vault *Vault, err error) {
 	vault = &Vault{
-		fs:        fs,
-		cache:     cmap.New[cacheEntry](),
-		mkDirLock: cmap.New[*sync.Mutex](),
+		fs:       fs,
+		state:    new(lockState),
+		locks:    newPathLocks(),
+		settings: &settings{cache: NewLRUCache(DefaultCacheSize, DefaultCacheTTL), names: DefaultNamePolicy},
+		nameMap:  newNameMap(),
 	}
 
-	configReader, err := fs.Open(constants.ConfigFileName)
+	configReader, err := vault.fsys(ctx).Open(constants.ConfigFileName)
 	if err != nil {
 		return
 	}
@@ -74,16 +94,26 @@ func Open(fs Fs, passphrase string) (vault *Vault, err error) {
 		return
 	}
 
-	masterKeyReader, err := fs.Open(constants.ConfigMasterkeyFileName)
+	masterKeyReader, err := vault.fsys(ctx).Open(constants.ConfigMasterkeyFileName)
 	if err != nil {
 		return
 	}
 	defer masterKeyReader.Close()
 
-	if vault.MasterKey, err = masterkey.Unmarshal(masterKeyReader, passphrase); err != nil {
+	masterKeyBytes, err := io.ReadAll(masterKeyReader)
+	if err != nil {
 		return
 	}
 
+	var masterKey masterkey.MasterKey
+	if err = interruptible(ctx, func() (err error) {
+		masterKey, err = masterkey.Unmarshal(bytes.NewReader(masterKeyBytes), passphrase)
+		return
+	}); err != nil {
+		return
+	}
+	vault.MasterKey = masterKey
+
 	if err = vault.Config.Verify(vault.EncryptKey, vault.MacKey); err != nil {
 		return
 	}
@@ -91,23 +121,81 @@ func Open(fs Fs, passphrase string) (vault *Vault, err error) {
 	return
 }
 
+// OpenLocked is like OpenContext, but acquires the StorageLock of fs first.
+// It is released by Close. Writes fail with ErrVaultInUse once the lock is
+// lost. Processes that only read should use OpenReadOnly, which ignores the
+// lock.
+func OpenLocked(ctx context.Context, fs Fs, passphrase string, opts StorageLockOptions) (vault *Vault, err error) {
+	storageLock, err := AcquireStorageLock(ctx, fs, opts)
+	if err != nil {
+		return
+	}
+
+	if vault, err = OpenContext(ctx, fs, passphrase); err != nil {
+		storageLock.Release()
+		return nil, err
+	}
+
+	vault.storageLock = storageLock
+
+	return
+}
+
+// OpenReadOnly opens a vault that refuses every modifying operation with
+// ErrReadOnly. It only needs to open and list files in fs and does not take
+// the StorageLock.
+func OpenReadOnly(fs ReadOnlyFs, passphrase string) (vault *Vault, err error) {
+	return OpenReadOnlyContext(context.Background(), fs, passphrase)
+}
+
+func OpenReadOnlyContext(ctx context.Context, fs ReadOnlyFs, passphrase string) (vault *Vault, err error) {
+	fsys, ok := fs.(Fs)
+	if !ok {
+		fsys = readOnlyFs{fs}
+	}
+
+	if vault, err = OpenContext(ctx, fsys, passphrase); err != nil {
+		return
+	}
+
+	vault.readOnly = true
+
+	return
+}
+
+// ReadOnly reports whether v was opened with OpenReadOnly.
+func (v *Vault) ReadOnly() bool {
+	return v.readOnly
+}
+
 func Create(fs Fs, passphrase string) (vault *Vault, err error) {
+	return CreateContext(context.Background(), fs, passphrase)
+}
+
+// CreateContext is like Create. The key derivation is abandoned when ctx is
+// done, but keeps running in the background until it finishes.
+func CreateContext(ctx context.Context, fs Fs, passphrase string) (vault *Vault, err error) {
 	vault = &Vault{
-		fs:        fs,
-		cache:     cmap.New[cacheEntry](),
-		mkDirLock: cmap.New[*sync.Mutex](),
+		fs:       fs,
+		state:    new(lockState),
+		locks:    newPathLocks(),
+		settings: &settings{cache: NewLRUCache(DefaultCacheSize, DefaultCacheTTL), names: DefaultNamePolicy},
+		nameMap:  newNameMap(),
 	}
 
 	if vault.MasterKey, err = masterkey.New(); err != nil {
 		return
 	}
 
+	masterKey := vault.MasterKey
 	masterKeyWriter := new(bytes.Buffer)
-	if err = vault.MasterKey.Marshal(masterKeyWriter, passphrase); err != nil {
+	if err = interruptible(ctx, func() error {
+		return masterKey.Marshal(masterKeyWriter, passphrase)
+	}); err != nil {
 		return
 	}
 
-	if err = vault.fs.WriteString(constants.ConfigMasterkeyFileName, masterKeyWriter.String()); err != nil {
+	if err = vault.fsys(ctx).WriteString(constants.ConfigMasterkeyFileName, masterKeyWriter.String()); err != nil {
 		return
 	}
 
@@ -120,7 +208,7 @@ func Create(fs Fs, passphrase string) (vault *Vault, err error) {
 		return
 	}
 
-	if err = vault.fs.WriteString(constants.ConfigFileName, configWriter.String()); err != nil {
+	if err = vault.fsys(ctx).WriteString(constants.ConfigFileName, configWriter.String()); err != nil {
 		return
 	}
 
@@ -132,27 +220,49 @@ func Create(fs Fs, passphrase string) (vault *Vault, err error) {
 }
 
 func (v *Vault) MkRootDir() (err error) {
-	dirPath, err := path.FromDirID(RootDirID, v.EncryptKey, v.MacKey)
+	if err = v.checkWritable(); err != nil {
+		return
+	}
+
+	return v.mkRootDir(context.Background())
+}
+
+func (v *Vault) mkRootDir(ctx context.Context) (err error) {
+	dirPath, err := v.fromDirID(RootDirID)
 	if err != nil {
 		return
 	}
 
-	return v.fs.MkdirAll(gopath.Join(DataDir, dirPath))
+	return v.fsys(ctx).MkdirAll(gopath.Join(DataDir, dirPath))
 }
 
 func (v *Vault) Mkdir(name string) (err error) {
-	cleanName := cleanPath(name)
+	return v.MkdirContext(context.Background(), name)
+}
 
-	mu, ok := v.mkDirLock.Get(cleanName)
-	if !ok {
-		mu = new(sync.Mutex)
-		v.mkDirLock.Set(cleanName, mu)
+func (v *Vault) MkdirContext(ctx context.Context, name string) (err error) {
+	if err = v.checkWritable(); err != nil {
+		return
+	}
+
+	cleanName, err := v.cleanName("mkdir", name, true)
+	if err != nil {
+		return
 	}
-	mu.Lock()
-	defer mu.Unlock()
 
-	if _, err = v.GetDirID(cleanName); err == nil {
+	defer v.locks.lock(cleanName)()
+
+	if _, err = v.GetDirIDContext(ctx, cleanName); err == nil {
 		return nil
+	} else if errors.Is(err, ErrNotDirectory) {
+		// Either name or one of its parents is a file
+		if _, err = v.GetDirIDContext(ctx, gopath.Dir(cleanName)); err == nil {
+			err = &fs.PathError{Op: "mkdir", Path: name, Err: fs.ErrExist}
+		}
+		return
+	}
+	if !errors.Is(err, fs.ErrNotExist) {
+		return
 	}
 
 	parent, dir := gopath.Split(cleanName)
@@ -161,16 +271,16 @@ func (v *Vault) Mkdir(name string) (err error) {
 		return nil
 	}
 
-	if err = v.MkRootDir(); err != nil {
+	if err = v.mkRootDir(ctx); err != nil {
 		return
 	}
 
-	parentID, err := v.GetDirID(parent)
+	parentID, err := v.GetDirIDContext(ctx, parent)
 	if err != nil {
 		return
 	}
 
-	parentPath, err := path.FromDirID(parentID, v.EncryptKey, v.MacKey)
+	parentPath, err := v.fromDirID(parentID)
 	if err != nil {
 		return
 	}
@@ -180,30 +290,28 @@ func (v *Vault) Mkdir(name string) (err error) {
 		return
 	}
 
-	if err = v.fs.MkdirAll(gopath.Join(DataDir, parentPath, encDirName)); err != nil {
+	if err = v.fsys(ctx).MkdirAll(gopath.Join(DataDir, parentPath, encDirName)); err != nil {
 		return
 	}
 
 	dirID := uuid.NewString()
-	err = v.writeDirIDToPath(gopath.Join(DataDir, parentPath, encDirName, constants.DirFile), dirID)
+	err = v.writeDirIDToPath(ctx, gopath.Join(DataDir, parentPath, encDirName, constants.DirFile), dirID)
 	if err != nil {
 		return
 	}
 
-	v.cache.Set(cleanName, cacheEntry{
-		DirID: dirID,
-	})
+	v.cache().Set(cleanName, CacheEntry{DirID: dirID})
 
-	dirPath, err := path.FromDirID(dirID, v.EncryptKey, v.MacKey)
+	dirPath, err := v.fromDirID(dirID)
 	if err != nil {
 		return
 	}
 
-	if err = v.fs.MkdirAll(gopath.Join(DataDir, dirPath)); err != nil {
+	if err = v.fsys(ctx).MkdirAll(gopath.Join(DataDir, dirPath)); err != nil {
 		return
 	}
 
-	if err = v.writeDirIDToPathEncrypted(gopath.Join(DataDir, dirPath, "dirid.c9r"), dirID); err != nil {
+	if err = v.writeDirIDToPathEncrypted(ctx, gopath.Join(DataDir, dirPath, constants.DirIDBackupFile), dirID); err != nil {
 		return err
 	}
 
@@ -211,7 +319,20 @@ func (v *Vault) Mkdir(name string) (err error) {
 }
 
 func (v *Vault) Rmdir(name string) (err error) {
-	cleanName := cleanPath(name)
+	return v.RmdirContext(context.Background(), name)
+}
+
+func (v *Vault) RmdirContext(ctx context.Context, name string) (err error) {
+	if err = v.checkWritable(); err != nil {
+		return
+	}
+
+	cleanName, err := v.cleanName("rmdir", name, false)
+	if err != nil {
+		return
+	}
+
+	defer v.locks.lock(cleanName)()
 
 	parent, dir := gopath.Split(cleanName)
 
@@ -219,63 +340,69 @@ func (v *Vault) Rmdir(name string) (err error) {
 		return nil
 	}
 
-	parentID, err := v.GetDirID(parent)
+	parentID, err := v.GetDirIDContext(ctx, parent)
 	if err != nil {
 		return
 	}
 
-	dirID, _, err := v.getDirSegmentID(dir, parentID)
+	dirID, _, err := v.getDirSegmentID(ctx, dir, parentID)
 	if err != nil {
 		return
 	}
 
-	v.cache.Remove(cleanName)
+	v.cache().RemovePrefix(cleanName)
 
-	parentPath, err := path.FromDirID(parentID, v.EncryptKey, v.MacKey)
+	parentPath, err := v.fromDirID(parentID)
 	if err != nil {
 		return
 	}
 
-	dirPath, err := path.FromDirID(dirID, v.EncryptKey, v.MacKey)
+	dirPath, err := v.fromDirID(dirID)
 	if err != nil {
 		return
 	}
 
-	encDirName, err := v.EncryptFileName(dir, parentID)
+	encDirName, err := v.encryptNodeName(ctx, dir, parentID)
 	if err != nil {
 		return
 	}
 
-	if err = v.fs.RemoveFile(gopath.Join(DataDir, dirPath, "dirid.c9r")); err != nil {
+	if err = v.fsys(ctx).RemoveFile(gopath.Join(DataDir, dirPath, constants.DirIDBackupFile)); err != nil {
 		// TODO handle dirid.c9r correctly
 	}
 
-	if err = v.fs.RemoveDir(gopath.Join(DataDir, dirPath)); err != nil {
+	if err = v.fsys(ctx).RemoveDir(gopath.Join(DataDir, dirPath)); err != nil {
 		return
 	}
 
-	if err = v.fs.RemoveDir(gopath.Join(DataDir, gopath.Dir(dirPath))); err != nil {
+	if err = v.fsys(ctx).RemoveDir(gopath.Join(DataDir, gopath.Dir(dirPath))); err != nil {
 		// TODO
 	}
 
-	if err = v.fs.RemoveFile(gopath.Join(DataDir, parentPath, encDirName, constants.DirFile)); err != nil {
+	if err = v.fsys(ctx).RemoveFile(gopath.Join(DataDir, parentPath, encDirName, constants.DirFile)); err != nil {
 		// TODO handle dir.c9r correctly
 	}
 
-	if err = v.fs.RemoveDir(gopath.Join(DataDir, parentPath, encDirName)); err != nil {
+	if err = v.fsys(ctx).RemoveDir(gopath.Join(DataDir, parentPath, encDirName)); err != nil {
 		return
 	}
 
+	v.nameMap.remove(parentID, dir)
+
 	return
 }
 
 func (v *Vault) GetDirPath(name string) (dirPath, dirID string, err error) {
-	dirID, err = v.GetDirID(name)
+	return v.GetDirPathContext(context.Background(), name)
+}
+
+func (v *Vault) GetDirPathContext(ctx context.Context, name string) (dirPath, dirID string, err error) {
+	dirID, err = v.GetDirIDContext(ctx, name)
 	if err != nil {
 		return
 	}
 
-	dir, err := path.FromDirID(dirID, v.EncryptKey, v.MacKey)
+	dir, err := v.fromDirID(dirID)
 	if err != nil {
 		return
 	}
@@ -283,64 +410,141 @@ func (v *Vault) GetDirPath(name string) (dirPath, dirID string, err error) {
 	return gopath.Join(DataDir, dir), dirID, nil
 }
 
+// settings holds what can be changed while the vault is in use. Some
+// methods copy the Vault, so it is shared through a pointer.
+type settings struct {
+	mu         sync.RWMutex
+	cache      Cache
+	names      NamePolicy
+	onConflict func(err *ConflictError)
+}
+
+// SetCache replaces the directory id cache of v, which is an LRUCache of
+// DefaultCacheSize entries expiring after DefaultCacheTTL by default. It is
+// safe to call while v is in use, lookups already running finish with the
+// old cache.
+func (v *Vault) SetCache(c Cache) {
+	v.settings.mu.Lock()
+	defer v.settings.mu.Unlock()
+
+	v.settings.cache = c
+}
+
+func (v *Vault) cache() Cache {
+	v.settings.mu.RLock()
+	defer v.settings.mu.RUnlock()
+
+	return v.settings.cache
+}
+
+func (v *Vault) CacheStats() CacheStats {
+	return v.cache().Stats()
+}
+
+// InvalidateCache evicts name and everything below it from the directory id
+// cache.
 func (v *Vault) InvalidateCache(name string) {
-	v.cache.Remove(cleanPath(name))
+	cleanName, err := v.cleanName("invalidate", name, false)
+	if err != nil {
+		cleanName = cleanPath(name)
+	}
+
+	v.cache().RemovePrefix(cleanName)
 }
 
 func (v *Vault) FullyInvalidate() {
-	v.cache.Clear()
+	v.cache().Clear()
+	v.nameMap.clear()
 }
 
 func (v *Vault) GetDirID(name string) (dirID string, err error) {
+	return v.GetDirIDContext(context.Background(), name)
+}
+
+// GetDirIDContext is like GetDirID, but stops resolving the path segments
+// when ctx is done.
+func (v *Vault) GetDirIDContext(ctx context.Context, name string) (dirID string, err error) {
+	if v.Locked() {
+		return "", ErrVaultLocked
+	}
+
+	name, err = v.cleanName("open", name, false)
+	if err != nil {
+		return
+	}
+
 	segments := splitPath(name)
 
 	dirID = RootDirID
 
-	if entry, ok := v.cache.Get(cleanPath(name)); ok {
+	if len(segments) == 0 {
+		return
+	}
+
+	// The parents are only looked up if name itself is not cached
+	if entry, ok := v.cache().Get(name); ok && entry.Missing {
+		return "", &fs.PathError{Op: "open", Path: segments[len(segments)-1], Err: fs.ErrNotExist}
+	} else if ok {
 		return entry.DirID, nil
 	}
 
-	// var dirIDFile string
 	for i, segment := range segments {
+		segmentPath := strings.Join(segments[:i+1], PathSeparator)
+
+		if i < len(segments)-1 {
+			entry, ok := v.cache().Get(segmentPath)
+			if ok && entry.Missing {
+				return "", &fs.PathError{Op: "open", Path: segment, Err: fs.ErrNotExist}
+			} else if ok {
+				dirID = entry.DirID
+				continue
+			}
+		}
 
-		entry, ok := v.cache.Get(strings.Join(segments[:i+1], PathSeparator))
-		if ok {
-			dirID = entry.DirID
-			continue
+		if err = ctx.Err(); err != nil {
+			return
 		}
 
-		if dirID, _, err = v.getDirSegmentID(segment, dirID); err != nil {
+		if dirID, _, err = v.getDirSegmentID(ctx, segment, dirID); errors.Is(err, fs.ErrNotExist) {
+			v.cache().Set(segmentPath, CacheEntry{Missing: true})
+			return
+		} else if err != nil {
 			return
 		}
 
-		v.cache.Set(strings.Join(segments[:i+1], PathSeparator), cacheEntry{
-			DirID: dirID,
-		})
+		v.cache().Set(segmentPath, CacheEntry{DirID: dirID})
 	}
 
 	return
 }
 
 func (v *Vault) GetFilePath(name string) (filePath, dirID string, err error) {
-	cleanName := cleanPath(name)
+	return v.GetFilePathContext(context.Background(), name)
+}
+
+func (v *Vault) GetFilePathContext(ctx context.Context, name string) (filePath, dirID string, err error) {
+	cleanName, err := v.cleanName("open", name, false)
+	if err != nil {
+		return
+	}
 
 	dir, file := gopath.Split(cleanName)
 
 	if file == "" {
-		return "", "", fmt.Errorf("not a valid filepath: %s", name)
+		return "", "", fmt.Errorf("%w: not a valid filepath: %s", fs.ErrInvalid, name)
 	}
 
-	dirID, err = v.GetDirID(dir)
+	dirID, err = v.GetDirIDContext(ctx, dir)
 	if err != nil {
 		return
 	}
 
-	parentPath, err := path.FromDirID(dirID, v.EncryptKey, v.MacKey)
+	parentPath, err := v.fromDirID(dirID)
 	if err != nil {
 		return
 	}
 
-	encName, err := v.EncryptFileName(file, dirID)
+	encName, err := v.encryptNodeName(ctx, file, dirID)
 	if err != nil {
 		return
 	}
@@ -351,7 +555,7 @@ func (v *Vault) GetFilePath(name string) (filePath, dirID string, err error) {
 // TODO change API
 
 func (v *Vault) PathFromDirID(dirId string) (string, error) {
-	path, err := path.FromDirID(dirId, v.EncryptKey, v.MacKey)
+	path, err := v.fromDirID(dirId)
 	if err != nil {
 		return "", err
 	}
@@ -359,11 +563,33 @@ func (v *Vault) PathFromDirID(dirId string) (string, error) {
 	return gopath.Join(DataDir, path), nil
 }
 
+func (v *Vault) fromDirID(dirID string) (string, error) {
+	done, err := v.useKeys()
+	if err != nil {
+		return "", err
+	}
+	defer done()
+
+	return path.FromDirID(dirID, v.EncryptKey, v.MacKey)
+}
+
 func (v *Vault) DecryptFileName(name, dirID string) (string, error) {
+	done, err := v.useKeys()
+	if err != nil {
+		return "", err
+	}
+	defer done()
+
 	return filename.Decrypt(name, dirID, v.EncryptKey, v.MacKey)
 }
 
 func (v *Vault) EncryptFileName(name, dirID string) (string, error) {
+	done, err := v.useKeys()
+	if err != nil {
+		return "", err
+	}
+	defer done()
+
 	return filename.Encrypt(name, dirID, v.EncryptKey, v.MacKey)
 }
 
@@ -381,33 +607,40 @@ func CalculateEncryptedFileSize(size int64) int64 {
 	return fullChunksSize + restSize + constants.HeaderEncryptedSize
 }
 
-func CalculateRawFileSize(size int64) int64 {
-	size = size - constants.HeaderEncryptedSize
-
-	nFullChunks := (size / constants.ChunkEncryptedSize)
-	fullChunksSize := nFullChunks * constants.ChunkPayloadSize
-
-	rest := size - (nFullChunks * constants.ChunkEncryptedSize)
-
-	var restSize int64 = 0
-	if rest > 0 {
-		restSize = rest - constants.ChunkMacSize - constants.ChunkNonceSize
+// CalculateRawFileSize returns the cleartext size of an encrypted file with
+// the given size. Sizes that no encrypted file can have, like sizes smaller
+// than the header or with a last chunk too short for its nonce and mac, fail
+// with ErrTruncated.
+func CalculateRawFileSize(size int64) (int64, error) {
+	if size < constants.HeaderEncryptedSize {
+		return 0, fmt.Errorf("%w: incomplete header", ErrTruncated)
 	}
 
-	return fullChunksSize + restSize
+	return stream.PlaintextSize(size - constants.HeaderEncryptedSize)
 }
 
 func (v *Vault) NewEncryptReader(r io.Reader) (io.ReadCloser, error) {
+	return v.NewEncryptReaderContext(context.Background(), r)
+}
+
+// NewEncryptReaderContext is like NewEncryptReader. When ctx is done, reads
+// fail with the error of ctx and the encryption goroutine stops after its
+// current read from r. Close waits for the goroutine, after that r is no
+// longer read.
+func (v *Vault) NewEncryptReaderContext(ctx context.Context, r io.Reader) (io.ReadCloser, error) {
 	pipeReader, pipeWriter := io.Pipe()
+	done := make(chan struct{})
 
 	go func() {
+		defer close(done)
+
 		encWriter, err := v.NewEncryptWriter(pipeWriter)
 		if err != nil {
 			pipeWriter.CloseWithError(err)
 			return
 		}
 
-		if _, err = io.Copy(encWriter, r); err != nil {
+		if _, err = io.Copy(encWriter, contextReader{ctx, r}); err != nil {
 			pipeWriter.CloseWithError(err)
 			return
 		}
@@ -415,23 +648,118 @@ func (v *Vault) NewEncryptReader(r io.Reader) (io.ReadCloser, error) {
 		pipeWriter.CloseWithError(encWriter.Close())
 	}()
 
-	return pipeReader, nil
+	go func() {
+		select {
+		case <-ctx.Done():
+			pipeWriter.CloseWithError(ctx.Err())
+		case <-done:
+		}
+	}()
+
+	return &encryptReader{pipeReader, done}, nil
+}
+
+// encryptReader is the reading end of the pipe of NewEncryptReaderContext.
+type encryptReader struct {
+	*io.PipeReader
+	done chan struct{}
+}
+
+func (r *encryptReader) Close() error {
+	err := r.PipeReader.Close()
+	<-r.done
+
+	return err
+}
+
+type contextReader struct {
+	ctx context.Context
+	r   io.Reader
+}
+
+func (r contextReader) Read(p []byte) (int, error) {
+	if err := r.ctx.Err(); err != nil {
+		return 0, err
+	}
+
+	return r.r.Read(p)
 }
 
 func (v Vault) NewDecryptReader(r io.ReadCloser) (*stream.Reader, error) {
-	h, err := header.Unmarshal(r, v.EncryptKey, v.MacKey)
+	done, err := v.useKeys()
+	if err != nil {
+		return nil, err
+	}
+	defer done()
+
+	h, err := v.unmarshalHeader(r)
 	if err != nil {
 		return nil, err
 	}
+	defer wipe.Bytes(h.ContentKey)
 
 	return stream.NewReader(r, h.ContentKey, h.Nonce, v.MacKey)
 }
 
+// NewDecryptReadSeeker is like NewDecryptReader, but allows random access
+// into the plaintext.
+func (v Vault) NewDecryptReadSeeker(r io.ReadSeeker) (*stream.ReadSeeker, error) {
+	done, err := v.useKeys()
+	if err != nil {
+		return nil, err
+	}
+	defer done()
+
+	h, err := v.unmarshalHeader(r)
+	if err != nil {
+		return nil, err
+	}
+	defer wipe.Bytes(h.ContentKey)
+
+	return stream.NewReadSeeker(r, h.ContentKey, h.Nonce, v.MacKey)
+}
+
+// NewSalvageDecryptReader is like NewDecryptReader, but keeps decrypting
+// past chunks that fail authentication. The header must still be intact, as
+// it carries the content key. After reading to EOF, Damaged reports the
+// unrecoverable byte ranges.
+func (v Vault) NewSalvageDecryptReader(r io.ReadCloser, mode SalvageMode) (*stream.SalvageReader, error) {
+	done, err := v.useKeys()
+	if err != nil {
+		return nil, err
+	}
+	defer done()
+
+	h, err := v.unmarshalHeader(r)
+	if err != nil {
+		return nil, err
+	}
+	defer wipe.Bytes(h.ContentKey)
+
+	return stream.NewSalvageReader(r, h.ContentKey, h.Nonce, v.MacKey, mode)
+}
+
+func (v Vault) unmarshalHeader(r io.Reader) (header.FileHeader, error) {
+	h, err := header.Unmarshal(r, v.EncryptKey, v.MacKey)
+	if err == io.EOF || err == io.ErrUnexpectedEOF {
+		err = fmt.Errorf("%w: incomplete header", ErrTruncated)
+	}
+
+	return h, err
+}
+
 func (v Vault) NewEncryptWriter(w io.WriteCloser) (*stream.Writer, error) {
+	done, err := v.useKeys()
+	if err != nil {
+		return nil, err
+	}
+	defer done()
+
 	h, err := header.New()
 	if err != nil {
 		return nil, err
 	}
+	defer wipe.Bytes(h.ContentKey)
 
 	if err := h.Marshal(w, v.EncryptKey, v.MacKey); err != nil {
 		return nil, err
@@ -442,31 +770,42 @@ func (v Vault) NewEncryptWriter(w io.WriteCloser) (*stream.Writer, error) {
 
 // ENDTODO
 
-func (v *Vault) getDirSegmentID(segment, parentID string) (dirID, dirIDFile string, err error) {
+func (v *Vault) getDirSegmentID(ctx context.Context, segment, parentID string) (dirID, dirIDFile string, err error) {
 	if strings.Contains(segment, PathSeparator) {
-		return "", "", fmt.Errorf("segment must not have any slashes: %s", segment)
+		return "", "", fmt.Errorf("%w: segment must not have any slashes: %s", fs.ErrInvalid, segment)
 	}
 
-	parentPath, err := path.FromDirID(parentID, v.EncryptKey, v.MacKey)
+	parentPath, err := v.fromDirID(parentID)
 	if err != nil {
 		return
 	}
 
-	encSegment, err := v.EncryptFileName(segment, parentID)
+	encSegment, err := v.encryptNodeName(ctx, segment, parentID)
 	if err != nil {
 		return
 	}
 
-	dirID, err = v.getDirIDFromPath(gopath.Join(DataDir, parentPath, encSegment, constants.DirFile))
+	nodePath := gopath.Join(DataDir, parentPath, encSegment)
+
+	dirID, err = v.getDirIDFromPath(ctx, gopath.Join(nodePath, constants.DirFile))
 	if err != nil {
+		// Distinguish files from missing nodes, backends report opening
+		// below a file differently
+		if exists, existsErr := v.exists(ctx, nodePath); existsErr == nil {
+			if exists {
+				err = &fs.PathError{Op: "open", Path: segment, Err: ErrNotDirectory}
+			} else {
+				err = &fs.PathError{Op: "open", Path: segment, Err: fs.ErrNotExist}
+			}
+		}
 		return
 	}
 
-	return dirID, gopath.Join(DataDir, parentPath, encSegment, constants.DirFile), nil
+	return dirID, gopath.Join(nodePath, constants.DirFile), nil
 }
 
-func (v *Vault) getDirIDFromPath(path string) (dirID string, err error) {
-	dirIDReader, err := v.fs.Open(path)
+func (v *Vault) getDirIDFromPath(ctx context.Context, path string) (dirID string, err error) {
+	dirIDReader, err := v.fsys(ctx).Open(path)
 	if err != nil {
 		return
 	}
@@ -480,23 +819,27 @@ func (v *Vault) getDirIDFromPath(path string) (dirID string, err error) {
 	return string(dirIDBytes), nil
 }
 
-func (v *Vault) writeDirIDToPath(path, dirID string) (err error) {
-	return v.fs.WriteString(path, dirID)
+func (v *Vault) writeDirIDToPath(ctx context.Context, path, dirID string) (err error) {
+	return v.fsys(ctx).WriteString(path, dirID)
 }
 
-func (v *Vault) writeDirIDToPathEncrypted(path, dirID string) (err error) {
-	encReader, err := v.NewEncryptReader(strings.NewReader(dirID))
+func (v *Vault) writeDirIDToPathEncrypted(ctx context.Context, path, dirID string) (err error) {
+	encryptedDirID := new(bytes.Buffer)
+
+	encWriter, err := v.NewEncryptWriter(nopWriteCloser{encryptedDirID})
 	if err != nil {
 		return err
 	}
-	defer encReader.Close()
 
-	encryptedDirID, err := io.ReadAll(encReader)
-	if err != nil {
+	if _, err = io.WriteString(encWriter, dirID); err != nil {
+		return err
+	}
+
+	if err = encWriter.Close(); err != nil {
 		return err
 	}
 
-	return v.fs.WriteString(path, string(encryptedDirID))
+	return v.fsys(ctx).WriteString(path, encryptedDirID.String())
 }
 
 func cleanPath(name string) string {
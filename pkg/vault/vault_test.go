@@ -0,0 +1,1057 @@
+package vault_test
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	gopath "path"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/fhilgers/gocryptomator/pkg/osfs"
+	"github.com/fhilgers/gocryptomator/pkg/vault"
+	"github.com/fhilgers/gocryptomator/pkg/vault/fstest"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+const passphrase = "passphrase"
+
+func newTestVault(t *testing.T) (*vault.Vault, *osfs.Fs) {
+	fsys := osfs.New(t.TempDir())
+
+	v, err := vault.Create(fsys, passphrase)
+	require.NoError(t, err)
+	require.NoError(t, v.MkRootDir())
+
+	return v, fsys
+}
+
+func readFile(t *testing.T, v *vault.Vault, name string) string {
+	r, err := v.OpenFile(name)
+	require.NoError(t, err)
+	defer r.Close()
+
+	content, err := io.ReadAll(r)
+	require.NoError(t, err)
+
+	return string(content)
+}
+
+func entryNames(t *testing.T, v *vault.Vault, name string) []string {
+	entries, err := v.ReadDir(name)
+	require.NoError(t, err)
+
+	names := make([]string, len(entries))
+	for i, entry := range entries {
+		names[i] = entry.Name()
+		if entry.IsDir() {
+			names[i] += "/"
+		}
+	}
+
+	return names
+}
+
+func TestCreateOpen(t *testing.T) {
+	v1, fsys := newTestVault(t)
+
+	v2, err := vault.Open(fsys, passphrase)
+	assert.NoError(t, err)
+	assert.Equal(t, v1.MasterKey, v2.MasterKey)
+
+	_, err = vault.Open(fsys, "wrong")
+	assert.Error(t, err)
+}
+
+func TestFiles(t *testing.T) {
+	v, _ := newTestVault(t)
+
+	assert.NoError(t, v.Mkdir("dir"))
+	assert.NoError(t, v.Mkdir("dir/sub"))
+	assert.NoError(t, v.WriteFile("dir/file.txt", strings.NewReader("hello")))
+	assert.ErrorIs(t, v.WriteFile("dir/file.txt", strings.NewReader("again")), fs.ErrExist)
+
+	assert.Equal(t, "hello", readFile(t, v, "dir/file.txt"))
+	assert.Equal(t, []string{"file.txt", "sub/"}, entryNames(t, v, "dir"))
+
+	entries, err := v.ReadDir("dir")
+	assert.NoError(t, err)
+	info, err := entries[0].Info()
+	assert.NoError(t, err)
+	assert.Equal(t, int64(len("hello")), info.Size())
+
+	assert.NoError(t, v.Remove("dir/file.txt"))
+	assert.NoError(t, v.Rmdir("dir/sub"))
+	assert.Empty(t, entryNames(t, v, "dir"))
+}
+
+func TestRename(t *testing.T) {
+	v, _ := newTestVault(t)
+
+	assert.NoError(t, v.Mkdir("a"))
+	assert.NoError(t, v.Mkdir("a/b"))
+	assert.NoError(t, v.WriteFile("a/b/file", strings.NewReader("content")))
+	assert.NoError(t, v.WriteFile("other", strings.NewReader("other")))
+
+	assert.NoError(t, v.Rename("a/b/file", "moved"))
+	assert.Equal(t, "content", readFile(t, v, "moved"))
+
+	assert.NoError(t, v.WriteFile("a/b/file", strings.NewReader("content")))
+	assert.NoError(t, v.Rename("a", "c"))
+	assert.Equal(t, []string{"c/", "moved", "other"}, entryNames(t, v, ""))
+	assert.Equal(t, "content", readFile(t, v, "c/b/file"))
+
+	_, err := v.GetDirID("a/b")
+	assert.Error(t, err, "cache must not serve the old subtree")
+
+	assert.ErrorIs(t, v.Rename("moved", "other"), fs.ErrExist)
+	assert.Error(t, v.Rename("c", "c/b/d"))
+}
+
+// minimalFs hides all optional extensions except Lister.
+type minimalFs struct {
+	vault.Fs
+	vault.Lister
+}
+
+// staterFs hides all optional extensions except Stater.
+type staterFs struct {
+	vault.Fs
+	vault.Stater
+}
+
+func TestFallbacks(t *testing.T) {
+	fsys := osfs.New(t.TempDir())
+
+	v, err := vault.Create(minimalFs{fsys, fsys}, passphrase)
+	require.NoError(t, err)
+	require.NoError(t, v.MkRootDir())
+
+	assert.NoError(t, v.Mkdir("a"))
+	assert.NoError(t, v.WriteFile("a/file", strings.NewReader("content")))
+	assert.ErrorIs(t, v.WriteFile("a/file", strings.NewReader("other")), fs.ErrExist)
+	assert.Equal(t, "content", readFile(t, v, "a/file"))
+
+	assert.NoError(t, v.Rename("a/file", "moved"))
+	assert.Equal(t, "content", readFile(t, v, "moved"))
+
+	assert.NoError(t, v.WriteFile("a/file", strings.NewReader("content")))
+	assert.NoError(t, v.Rename("a", "b"))
+	assert.Equal(t, []string{"b/", "moved"}, entryNames(t, v, ""))
+	assert.Equal(t, "content", readFile(t, v, "b/file"))
+	assert.ErrorIs(t, v.Rename("moved", "b"), fs.ErrExist)
+
+	assert.NoError(t, v.ReplaceFile("moved", strings.NewReader("replaced")))
+	assert.Equal(t, "replaced", readFile(t, v, "moved"))
+	assert.Equal(t, []string{"b/", "moved"}, entryNames(t, v, ""))
+
+	dirPath, _, err := v.GetDirPath("")
+	require.NoError(t, err)
+	encEntries, err := fsys.ReadDir(dirPath)
+	require.NoError(t, err)
+	assert.Len(t, encEntries, 2, "the old file must be removed once replaced")
+
+	assert.NoError(t, v.ChangePassphrase("new"))
+	_, err = vault.Open(fsys, "new")
+	assert.NoError(t, err)
+}
+
+func TestFallbacksRoundTrip(t *testing.T) {
+	fstest.TestVault(t, func() vault.Fs {
+		fsys := osfs.New(t.TempDir())
+		return minimalFs{fsys, fsys}
+	})
+}
+
+func TestChangePassphrase(t *testing.T) {
+	v, fsys := newTestVault(t)
+
+	assert.NoError(t, v.ChangePassphrase("new"))
+
+	_, err := vault.Open(fsys, passphrase)
+	assert.Error(t, err)
+
+	v2, err := vault.Open(fsys, "new")
+	assert.NoError(t, err)
+	assert.Equal(t, v.MasterKey, v2.MasterKey)
+
+	_, err = os.Stat(filepath.Join(fsys.Root(), "masterkey.cryptomator.tmp"))
+	assert.ErrorIs(t, err, fs.ErrNotExist)
+}
+
+type failingReader struct{}
+
+func (failingReader) Read(p []byte) (int, error) {
+	return 0, fmt.Errorf("read failed")
+}
+
+func TestReplaceFile(t *testing.T) {
+	v, fsys := newTestVault(t)
+
+	dirPath, _, err := v.GetDirPath("")
+	require.NoError(t, err)
+
+	assert.NoError(t, v.ReplaceFile("file", strings.NewReader("hello")))
+	assert.Equal(t, "hello", readFile(t, v, "file"))
+
+	assert.NoError(t, v.ReplaceFile("file", strings.NewReader("again")))
+	assert.Equal(t, "again", readFile(t, v, "file"))
+
+	assert.Error(t, v.ReplaceFile("file", io.MultiReader(strings.NewReader("partial"), failingReader{})))
+	assert.Equal(t, "again", readFile(t, v, "file"))
+
+	assert.NoError(t, v.Mkdir("dir"))
+	assert.Error(t, v.ReplaceFile("dir", strings.NewReader("hello")))
+	assert.Equal(t, []string{"dir/", "file"}, entryNames(t, v, ""))
+
+	// No temporary nodes are left behind
+	encEntries, err := fsys.ReadDir(dirPath)
+	require.NoError(t, err)
+	assert.Len(t, encEntries, 2)
+}
+
+func TestContext(t *testing.T) {
+	v, fsys := newTestVault(t)
+
+	canceled, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	_, err := vault.OpenContext(canceled, fsys, passphrase)
+	assert.ErrorIs(t, err, context.Canceled)
+
+	deadline, cancel := context.WithTimeout(context.Background(), time.Millisecond)
+	defer cancel()
+
+	start := time.Now()
+	_, err = vault.OpenContext(deadline, fsys, passphrase)
+	assert.ErrorIs(t, err, context.DeadlineExceeded)
+	assert.Less(t, time.Since(start), 100*time.Millisecond, "OpenContext must not wait for the key derivation")
+
+	assert.NoError(t, v.Mkdir("a"))
+	v.FullyInvalidate()
+
+	_, err = v.GetDirIDContext(canceled, "a")
+	assert.ErrorIs(t, err, context.Canceled)
+	assert.ErrorIs(t, v.MkdirContext(canceled, "b"), context.Canceled)
+
+	_, err = v.ReadDirContext(canceled, "")
+	assert.ErrorIs(t, err, context.Canceled)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	encReader, err := v.NewEncryptReaderContext(ctx, endlessReader{})
+	require.NoError(t, err)
+
+	_, err = io.ReadFull(encReader, make([]byte, 1024))
+	assert.NoError(t, err)
+	cancel()
+	_, err = io.Copy(io.Discard, encReader)
+	assert.ErrorIs(t, err, context.Canceled)
+
+	ctx, cancel = context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	assert.ErrorIs(t, v.WriteFileContext(ctx, "a/file", endlessReader{}), context.DeadlineExceeded)
+	assert.Empty(t, entryNames(t, v, "a"), "partial files must be removed")
+}
+
+// unreadReader fails the test when it is read.
+type unreadReader struct {
+	t *testing.T
+}
+
+func (r unreadReader) Read(p []byte) (int, error) {
+	r.t.Error("reader of an existing file must not be read")
+	return 0, io.EOF
+}
+
+type endlessReader struct{}
+
+func (endlessReader) Read(p []byte) (int, error) {
+	return len(p), nil
+}
+
+func TestErrors(t *testing.T) {
+	v, fsys := newTestVault(t)
+
+	_, err := vault.Open(fsys, "wrong")
+	assert.ErrorIs(t, err, vault.ErrInvalidPassphrase)
+
+	assert.NoError(t, v.WriteFile("file", strings.NewReader("content")))
+	assert.ErrorIs(t, v.WriteFile("file", unreadReader{t}), fs.ErrExist)
+
+	_, err = v.OpenFile("file/below")
+	assert.ErrorIs(t, err, vault.ErrNotDirectory)
+	assert.ErrorIs(t, v.Mkdir("file"), fs.ErrExist)
+	assert.ErrorIs(t, v.Rename("file", "file/below"), fs.ErrInvalid)
+
+	_, err = v.OpenFile("missing/file")
+	assert.ErrorIs(t, err, fs.ErrNotExist)
+
+	require.NoError(t, fsys.RemoveFile("masterkey.cryptomator"))
+	require.NoError(t, fsys.WriteString("masterkey.cryptomator", `{"version": 999}`))
+
+	_, err = vault.Open(fsys, passphrase)
+	assert.ErrorIs(t, err, vault.ErrMasterKeyMalformed)
+	assert.NotErrorIs(t, err, vault.ErrInvalidPassphrase)
+
+	var fieldErr *vault.MasterKeyFieldError
+	if assert.ErrorAs(t, err, &fieldErr) {
+		assert.Equal(t, "scryptSalt", fieldErr.Field)
+	}
+}
+
+func TestLock(t *testing.T) {
+	v, _ := newTestVault(t)
+
+	assert.NoError(t, v.Mkdir("dir"))
+	assert.NoError(t, v.WriteFile("dir/file", strings.NewReader("content")))
+
+	r, err := v.OpenFile("dir/file")
+	require.NoError(t, err)
+	defer r.Close()
+
+	encKey, macKey := v.EncryptKey, v.MacKey
+
+	assert.False(t, v.Locked())
+	assert.NoError(t, v.Close())
+	assert.True(t, v.Locked())
+	v.Lock()
+
+	assert.Equal(t, make([]byte, len(encKey)), encKey)
+	assert.Equal(t, make([]byte, len(macKey)), macKey)
+
+	content, err := io.ReadAll(r)
+	assert.NoError(t, err)
+	assert.Equal(t, "content", string(content), "open files keep working")
+
+	_, err = v.GetDirID("dir")
+	assert.ErrorIs(t, err, vault.ErrVaultLocked)
+	_, err = v.OpenFile("dir/file")
+	assert.ErrorIs(t, err, vault.ErrVaultLocked)
+	_, err = v.ReadDir("")
+	assert.ErrorIs(t, err, vault.ErrVaultLocked)
+	assert.ErrorIs(t, v.WriteFile("other", strings.NewReader("content")), vault.ErrVaultLocked)
+	assert.ErrorIs(t, v.Mkdir("other"), vault.ErrVaultLocked)
+	assert.ErrorIs(t, v.ChangePassphrase("new"), vault.ErrVaultLocked)
+}
+
+// slowFs widens race windows by delaying every Open after it happened.
+type slowFs struct {
+	*osfs.Fs
+}
+
+func (f slowFs) Open(name string) (io.ReadCloser, error) {
+	defer time.Sleep(time.Millisecond)
+
+	return f.Fs.Open(name)
+}
+
+func TestConcurrentMkdir(t *testing.T) {
+	fsys := osfs.New(t.TempDir())
+
+	v, err := vault.Create(slowFs{fsys}, passphrase)
+	require.NoError(t, err)
+	require.NoError(t, v.MkRootDir())
+
+	const workers = 32
+
+	for round := 0; round < 10; round++ {
+		name := fmt.Sprintf("dir%d/sub", round)
+
+		var wg sync.WaitGroup
+		errs := make([]error, workers)
+		for i := 0; i < workers; i++ {
+			wg.Add(1)
+			go func(i int) {
+				defer wg.Done()
+
+				if errs[i] = v.Mkdir(gopath.Dir(name)); errs[i] == nil {
+					errs[i] = v.Mkdir(name)
+				}
+			}(i)
+		}
+		wg.Wait()
+
+		for _, err := range errs {
+			assert.NoError(t, err)
+		}
+	}
+
+	dirIDFiles, err := filepath.Glob(filepath.Join(fsys.Root(), "d", "*", "*", "dirid.c9r"))
+	require.NoError(t, err)
+	assert.Len(t, dirIDFiles, 20, "every directory must get exactly one dir id")
+
+	v.FullyInvalidate()
+	assert.Len(t, entryNames(t, v, ""), 10)
+	for round := 0; round < 10; round++ {
+		assert.Equal(t, []string{"sub/"}, entryNames(t, v, fmt.Sprintf("dir%d", round)))
+	}
+}
+
+func TestConcurrentRenameWrite(t *testing.T) {
+	v, _ := newTestVault(t)
+
+	require.NoError(t, v.Mkdir("a"))
+
+	var wg sync.WaitGroup
+	for i := 0; i < 16; i++ {
+		wg.Add(2)
+		go func(i int) {
+			defer wg.Done()
+			v.WriteFile(fmt.Sprintf("a/file%d", i), strings.NewReader("content"))
+		}(i)
+		go func(i int) {
+			defer wg.Done()
+			if i%2 == 0 {
+				v.Rename("a", "b")
+			} else {
+				v.Rename("b", "a")
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	v.FullyInvalidate()
+
+	var total int
+	for _, dir := range []string{"a", "b"} {
+		if entries, err := v.ReadDir(dir); err == nil {
+			total += len(entries)
+		}
+	}
+	assert.LessOrEqual(t, total, 16)
+	assert.Len(t, entryNames(t, v, ""), 1, "renames must not duplicate or lose the directory")
+}
+
+// openListFs implements nothing but vault.ReadOnlyFs.
+type openListFs struct {
+	fsys *osfs.Fs
+}
+
+func (f openListFs) Open(name string) (io.ReadCloser, error) {
+	return f.fsys.Open(name)
+}
+
+func (f openListFs) ReadDir(name string) ([]fs.DirEntry, error) {
+	return f.fsys.ReadDir(name)
+}
+
+func TestReadOnly(t *testing.T) {
+	v, fsys := newTestVault(t)
+
+	require.NoError(t, v.Mkdir("dir"))
+	require.NoError(t, v.WriteFile("dir/file", strings.NewReader("content")))
+
+	for _, readOnlyFs := range []vault.ReadOnlyFs{fsys, openListFs{fsys}} {
+		ro, err := vault.OpenReadOnly(readOnlyFs, passphrase)
+		require.NoError(t, err)
+		assert.True(t, ro.ReadOnly())
+
+		assert.Equal(t, "content", readFile(t, ro, "dir/file"))
+		assert.Equal(t, []string{"file"}, entryNames(t, ro, "dir"))
+
+		for _, err := range []error{
+			ro.MkRootDir(),
+			ro.Mkdir("other"),
+			ro.Rmdir("dir"),
+			ro.WriteFile("dir/other", strings.NewReader("content")),
+			ro.Remove("dir/file"),
+			ro.RemoveAll("dir"),
+			ro.Rename("dir/file", "moved"),
+			ro.ChangePassphrase("new"),
+		} {
+			assert.ErrorIs(t, err, vault.ErrReadOnly)
+			assert.ErrorIs(t, err, fs.ErrPermission)
+		}
+	}
+
+	assert.Equal(t, "content", readFile(t, v, "dir/file"))
+}
+
+// waitForChange waits until events reports a change of name.
+func waitForChange(t *testing.T, events <-chan vault.ChangeEvent, name string) {
+	timeout := time.After(5 * time.Second)
+
+	for {
+		select {
+		case event, ok := <-events:
+			require.True(t, ok, "events closed before %s changed", name)
+			if event.Path == name {
+				return
+			}
+		case <-timeout:
+			t.Fatalf("no change of %s reported", name)
+		}
+	}
+}
+
+func TestWatch(t *testing.T) {
+	for name, newFs := range map[string]func(fsys *osfs.Fs) vault.Fs{
+		"watcher": func(fsys *osfs.Fs) vault.Fs { return fsys },
+		"poll":    func(fsys *osfs.Fs) vault.Fs { return minimalFs{fsys, fsys} },
+	} {
+		t.Run(name, func(t *testing.T) {
+			fsys := newFs(osfs.New(t.TempDir()))
+
+			writer, err := vault.Create(fsys, passphrase)
+			require.NoError(t, err)
+			require.NoError(t, writer.MkRootDir())
+
+			observer, err := vault.Open(fsys, passphrase)
+			require.NoError(t, err)
+
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+
+			events, err := observer.Watch(ctx, vault.WatchOptions{PollInterval: 10 * time.Millisecond})
+			require.NoError(t, err)
+
+			require.NoError(t, writer.Mkdir("dir"))
+			waitForChange(t, events, "dir")
+
+			require.NoError(t, writer.WriteFile("dir/file", strings.NewReader("content")))
+			waitForChange(t, events, "dir/file")
+			assert.Equal(t, []string{"file"}, entryNames(t, observer, "dir"))
+
+			// Replace the directory the observer has cached by another one
+			require.NoError(t, writer.RemoveAll("dir"))
+			require.NoError(t, writer.Mkdir("dir"))
+			require.NoError(t, writer.WriteFile("dir/new", strings.NewReader("content")))
+			waitForChange(t, events, "dir/new")
+			assert.Equal(t, []string{"new"}, entryNames(t, observer, "dir"))
+
+			// Trees created at once are indexed from their top directory
+			require.NoError(t, writer.Mkdir("a"))
+			require.NoError(t, writer.Mkdir("a/b"))
+			require.NoError(t, writer.Mkdir("a/b/c"))
+			require.NoError(t, writer.WriteFile("a/b/c/file", strings.NewReader("content")))
+			waitForChange(t, events, "a/b/c/file")
+
+			cancel()
+			for range events {
+			}
+		})
+	}
+}
+
+func TestWatchSlowReceiver(t *testing.T) {
+	fsys := osfs.New(t.TempDir())
+
+	writer, err := vault.Create(fsys, passphrase)
+	require.NoError(t, err)
+	require.NoError(t, writer.MkRootDir())
+	require.NoError(t, writer.Mkdir("dir"))
+	require.NoError(t, writer.WriteFile("dir/old", strings.NewReader("content")))
+
+	observer, err := vault.Open(fsys, passphrase)
+	require.NoError(t, err)
+	assert.Equal(t, []string{"old"}, entryNames(t, observer, "dir"))
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	events, err := observer.Watch(ctx, vault.WatchOptions{Debounce: time.Millisecond})
+	require.NoError(t, err)
+
+	// Nobody receives the events, which must neither hold up invalidation
+	// nor pile up
+	for i := 0; i < 1100; i++ {
+		require.NoError(t, writer.WriteFile(fmt.Sprintf("file%d", i), strings.NewReader("")))
+	}
+
+	require.NoError(t, writer.RemoveAll("dir"))
+	require.NoError(t, writer.Mkdir("dir"))
+	require.NoError(t, writer.WriteFile("dir/new", strings.NewReader("content")))
+
+	assert.Eventually(t, func() bool {
+		entries, err := observer.ReadDir("dir")
+		return err == nil && len(entries) == 1 && entries[0].Name() == "new"
+	}, 5*time.Second, 10*time.Millisecond)
+
+	waitForChange(t, events, "")
+
+	cancel()
+	for range events {
+	}
+}
+
+func TestDecryptPath(t *testing.T) {
+	v, fsys := newTestVault(t)
+
+	require.NoError(t, v.Mkdir("a"))
+	require.NoError(t, v.Mkdir("a/b"))
+	require.NoError(t, v.WriteFile("a/b/file", strings.NewReader("content")))
+
+	rootPath, _, err := v.GetDirPath("")
+	require.NoError(t, err)
+	dirPath, _, err := v.GetDirPath("a/b")
+	require.NoError(t, err)
+	filePath, _, err := v.GetFilePath("a/b/file")
+	require.NoError(t, err)
+	nodePath, _, err := v.GetFilePath("a/b")
+	require.NoError(t, err)
+
+	for encryptedPath, expected := range map[string]string{
+		rootPath:                              "",
+		dirPath:                               "a/b",
+		gopath.Join(dirPath, "dirid.c9r"):     "a/b",
+		filePath:                              "a/b/file",
+		"/" + filePath:                        "a/b/file",
+		gopath.Join(nodePath, "dir.c9r"):      "a/b",
+		gopath.Join(filePath, "contents.c9r"): "a/b/file",
+	} {
+		path, err := v.DecryptPath(encryptedPath)
+		assert.NoError(t, err, encryptedPath)
+		assert.Equal(t, expected, path, encryptedPath)
+	}
+
+	paths, err := v.DecryptPaths([]string{filePath, rootPath, dirPath})
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"a/b/file", "", "a/b"}, paths)
+
+	_, err = v.DecryptPaths([]string{filePath, "vault.cryptomator"})
+	assert.ErrorIs(t, err, fs.ErrInvalid)
+
+	_, err = v.DecryptPath(gopath.Join(dirPath, "unknown.c9r"))
+	assert.Error(t, err)
+
+	_, err = v.DecryptPath("vault.cryptomator")
+	assert.ErrorIs(t, err, fs.ErrInvalid)
+
+	// Without backups, the directory ids are found in the dir.c9r files
+	require.NoError(t, fsys.RemoveFile(gopath.Join(dirPath, "dirid.c9r")))
+	path, err := v.DecryptPath(filePath)
+	assert.NoError(t, err)
+	assert.Equal(t, "a/b/file", path)
+
+	// Shortened names are read from name.c9s
+	shortPath := gopath.Join(gopath.Dir(nodePath), "short.c9s")
+	require.NoError(t, os.Rename(fsys.Root()+"/"+nodePath, fsys.Root()+"/"+shortPath))
+	require.NoError(t, fsys.WriteString(gopath.Join(shortPath, "name.c9s"), gopath.Base(nodePath)))
+	v.FullyInvalidate()
+
+	path, err = v.DecryptPath(gopath.Join(shortPath, "name.c9s"))
+	assert.NoError(t, err)
+	assert.Equal(t, "a/b", path)
+
+	path, err = v.DecryptPath(filePath)
+	assert.NoError(t, err)
+	assert.Equal(t, "a/b/file", path)
+}
+
+func TestConflicts(t *testing.T) {
+	v, fsys := newTestVault(t)
+
+	for name, content := range map[string]string{"report.txt": "original", "copy": "conflict", "moved": "moved"} {
+		require.NoError(t, v.WriteFile(name, strings.NewReader(content)))
+	}
+	require.NoError(t, v.Mkdir("dir"))
+
+	// A copy of a file with another content, a copy of a directory and a
+	// copy whose original is gone
+	reportPath, _, err := v.GetFilePath("report.txt")
+	require.NoError(t, err)
+	copyPath, _, err := v.GetFilePath("copy")
+	require.NoError(t, err)
+	require.NoError(t, fsys.Rename(copyPath, strings.TrimSuffix(reportPath, ".c9r")+" (1).c9r"))
+
+	dirPath, _, err := v.GetFilePath("dir")
+	require.NoError(t, err)
+	dirFile, err := fsys.Open(gopath.Join(dirPath, "dir.c9r"))
+	require.NoError(t, err)
+	dirID, err := io.ReadAll(dirFile)
+	require.NoError(t, err)
+	dirFile.Close()
+	conflictDirPath := strings.TrimSuffix(dirPath, ".c9r") + " (conflicted copy).c9r"
+	require.NoError(t, fsys.MkdirAll(conflictDirPath))
+	require.NoError(t, fsys.WriteString(gopath.Join(conflictDirPath, "dir.c9r"), string(dirID)))
+
+	movedPath, _, err := v.GetFilePath("moved")
+	require.NoError(t, err)
+	require.NoError(t, fsys.Rename(movedPath, strings.TrimSuffix(movedPath, ".c9r")+" (2).c9r"))
+
+	// Listing shows the copies under the names they are resolved to, without
+	// moving them
+	var conflicts []*vault.ConflictError
+	v.OnConflict(func(err *vault.ConflictError) {
+		conflicts = append(conflicts, err)
+	})
+
+	assert.Equal(t, []string{"dir/", "moved", "report (Conflict 1).txt", "report.txt"}, entryNames(t, v, ""))
+	assert.Empty(t, conflicts)
+	assert.Equal(t, "conflict", readFile(t, v, "report (Conflict 1).txt"))
+	assert.Equal(t, "moved", readFile(t, v, "moved"))
+	_, err = fsys.Stat(conflictDirPath)
+	assert.NoError(t, err)
+
+	other, err := vault.Open(fsys, passphrase)
+	require.NoError(t, err)
+	info, err := other.Stat("report (Conflict 1).txt")
+	require.NoError(t, err)
+	assert.Equal(t, int64(len("conflict")), info.Size())
+
+	// Copies without a conflict free name are reported instead
+	other.SetNamePolicy(vault.NamePolicy{MaxLength: 12})
+	other.OnConflict(func(err *vault.ConflictError) {
+		conflicts = append(conflicts, err)
+	})
+	assert.Equal(t, []string{"dir/", "moved", "report.txt"}, entryNames(t, other, ""))
+	require.Len(t, conflicts, 1)
+	assert.ErrorIs(t, conflicts[0], vault.ErrConflictNotResolved)
+	assert.Equal(t, "report.txt", conflicts[0].Name)
+
+	_, err = v.ResolveConflicts("")
+	assert.ErrorIs(t, err, vault.ErrNotStorageLocked)
+
+	locked, err := vault.OpenLocked(context.Background(), fsys, passphrase, vault.StorageLockOptions{})
+	require.NoError(t, err)
+	defer locked.Close()
+
+	resolved, err := locked.ResolveConflicts("")
+	require.NoError(t, err)
+	assert.ElementsMatch(t, []string{"moved", "report (Conflict 1).txt"}, resolved)
+
+	assert.Equal(t, []string{"dir/", "moved", "report (Conflict 1).txt", "report.txt"}, entryNames(t, locked, ""))
+	assert.Equal(t, "original", readFile(t, locked, "report.txt"))
+	assert.Equal(t, "conflict", readFile(t, locked, "report (Conflict 1).txt"))
+	assert.Equal(t, "moved", readFile(t, locked, "moved"))
+
+	_, err = fsys.Stat(conflictDirPath)
+	assert.ErrorIs(t, err, fs.ErrNotExist, "identical directory copies are removed")
+
+	// Names already taken by earlier conflicts are skipped
+	require.NoError(t, locked.WriteFile("second", strings.NewReader("second")))
+	secondPath, _, err := locked.GetFilePath("second")
+	require.NoError(t, err)
+	require.NoError(t, fsys.Rename(secondPath, strings.TrimSuffix(reportPath, ".c9r")+" (2).c9r"))
+
+	resolved, err = locked.ResolveConflicts("")
+	require.NoError(t, err)
+	assert.Equal(t, []string{"report (Conflict 2).txt"}, resolved)
+	assert.Equal(t, "second", readFile(t, locked, "report (Conflict 2).txt"))
+
+	// Suffixes starting with base64 characters, on a name without padding
+	name := "x"
+	namePath, _, err := locked.GetFilePath(name)
+	require.NoError(t, err)
+	for strings.HasSuffix(namePath, "=.c9r") {
+		name += "x"
+		namePath, _, err = locked.GetFilePath(name)
+		require.NoError(t, err)
+	}
+	require.NoError(t, locked.WriteFile(name, strings.NewReader("original")))
+	require.NoError(t, fsys.WriteString(strings.TrimSuffix(namePath, ".c9r")+"_copy1.c9r", "copy"))
+
+	resolved, err = locked.ResolveConflicts("")
+	require.NoError(t, err)
+	assert.Equal(t, []string{name + " (Conflict 1)"}, resolved)
+
+	// Long names are cut short to stay below the shortening threshold
+	long := strings.Repeat("l", vault.DefaultMaxNameLength-4) + ".txt"
+	require.NoError(t, locked.WriteFile(long, strings.NewReader("original")))
+	require.NoError(t, locked.WriteFile("long copy", strings.NewReader("copy")))
+	longPath, _, err := locked.GetFilePath(long)
+	require.NoError(t, err)
+	longCopyPath, _, err := locked.GetFilePath("long copy")
+	require.NoError(t, err)
+	require.NoError(t, fsys.Rename(longCopyPath, strings.TrimSuffix(longPath, ".c9r")+" (1).c9r"))
+
+	resolved, err = locked.ResolveConflicts("")
+	require.NoError(t, err)
+	require.Len(t, resolved, 1)
+	assert.True(t, strings.HasSuffix(resolved[0], " (Conflict 1).txt"))
+	assert.LessOrEqual(t, len(resolved[0]), vault.DefaultMaxNameLength)
+	assert.Equal(t, "copy", readFile(t, locked, resolved[0]))
+}
+
+func TestNamePolicy(t *testing.T) {
+	v, fsys := newTestVault(t)
+
+	const nfc, nfd = "\u00e9.txt", "e\u0301.txt"
+
+	require.NoError(t, v.WriteFile(nfd, strings.NewReader("content")))
+	assert.Equal(t, "content", readFile(t, v, nfc))
+	assert.Equal(t, []string{nfc}, entryNames(t, v, ""))
+	assert.ErrorIs(t, v.WriteFile(nfc, strings.NewReader("content")), fs.ErrExist)
+
+	longest := strings.Repeat("a", vault.DefaultMaxNameLength)
+	require.NoError(t, v.WriteFile(longest, strings.NewReader("content")))
+	encPath, _, err := v.GetFilePath(longest)
+	require.NoError(t, err)
+	assert.LessOrEqual(t, len(gopath.Base(encPath)), v.ShorteningThreshold)
+
+	for _, name := range []string{"a\x00b", "..", longest + "a", "a:b", "dir/con.txt", "trailing.", "trailing ", "tab\t"} {
+		err := v.WriteFile(name, strings.NewReader("content"))
+		assert.ErrorIs(t, err, vault.ErrInvalidName, "%q", name)
+		assert.ErrorIs(t, err, fs.ErrInvalid, "%q", name)
+	}
+	assert.ErrorIs(t, v.Mkdir("LPT1"), vault.ErrInvalidName)
+	assert.ErrorIs(t, v.Rename(nfc, "a?"), vault.ErrInvalidName)
+
+	// Names of other clients stay accessible, and names that are not
+	// normalized are looked up and listed normalized without moving them
+	v.SetNamePolicy(vault.NamePolicy{})
+	require.NoError(t, v.WriteFile("a:b", strings.NewReader("content")))
+	require.NoError(t, v.WriteFile("o\u0308", strings.NewReader("content")))
+	require.NoError(t, v.Mkdir("a\u0308"))
+	require.NoError(t, v.WriteFile("a\u0308/file", strings.NewReader("content")))
+	nfdPath, _, err := v.GetFilePath("o\u0308")
+	require.NoError(t, err)
+
+	other, err := vault.Open(fsys, passphrase)
+	require.NoError(t, err)
+	assert.Equal(t, "content", readFile(t, other, "a:b"))
+	assert.Equal(t, "content", readFile(t, other, "\u00f6"))
+	assert.Equal(t, "content", readFile(t, other, "\u00e4/file"))
+	assert.Equal(t, []string{"a:b", longest, "\u00e4/", nfc, "\u00f6"}, entryNames(t, other, ""))
+	assert.FileExists(t, filepath.Join(fsys.Root(), nfdPath), "listing must not move nodes")
+	assert.NoError(t, other.Remove("a:b"))
+
+	_, err = other.NormalizeNames("")
+	assert.ErrorIs(t, err, vault.ErrNotStorageLocked)
+
+	locked, err := vault.OpenLocked(context.Background(), fsys, passphrase, vault.StorageLockOptions{})
+	require.NoError(t, err)
+	defer locked.Close()
+
+	normalized, err := locked.NormalizeNames("")
+	require.NoError(t, err)
+	assert.ElementsMatch(t, []string{"\u00e4", "\u00f6"}, normalized)
+	assert.NoFileExists(t, filepath.Join(fsys.Root(), nfdPath))
+
+	// Clients without a NamePolicy find the normalized names now
+	assert.Equal(t, "content", readFile(t, v, "\u00f6"))
+	assert.Equal(t, "content", readFile(t, v, "\u00e4/file"))
+
+	// The policy can be replaced while the vault is in use
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for i := 0; i < 10; i++ {
+			v.SetNamePolicy(vault.DefaultNamePolicy)
+			v.OnConflict(func(*vault.ConflictError) {})
+			v.SetNamePolicy(vault.NamePolicy{})
+		}
+	}()
+	for i := 0; i < 10; i++ {
+		assert.Equal(t, "content", readFile(t, v, "\u00f6"))
+		assert.Contains(t, entryNames(t, v, ""), "\u00f6")
+	}
+	wg.Wait()
+}
+
+// listCountingFs counts the directories listed.
+type listCountingFs struct {
+	*osfs.Fs
+	lists int32
+}
+
+func (f *listCountingFs) ReadDir(name string) ([]fs.DirEntry, error) {
+	atomic.AddInt32(&f.lists, 1)
+	return f.Fs.ReadDir(name)
+}
+
+func TestNameLookup(t *testing.T) {
+	v, fsys := newTestVault(t)
+
+	v.SetNamePolicy(vault.NamePolicy{})
+	require.NoError(t, v.WriteFile("file", strings.NewReader("content")))
+	require.NoError(t, v.WriteFile("o\u0308", strings.NewReader("content")))
+
+	counting := &listCountingFs{Fs: fsys}
+	other, err := vault.Open(counting, passphrase)
+	require.NoError(t, err)
+
+	assert.Equal(t, "content", readFile(t, other, "file"))
+	assert.Zero(t, atomic.LoadInt32(&counting.lists), "names that exist must be found without listing")
+
+	assert.Equal(t, "content", readFile(t, other, "\u00f6"))
+	assert.Equal(t, int32(1), atomic.LoadInt32(&counting.lists), "missed names must be mapped")
+
+	assert.Equal(t, "content", readFile(t, other, "\u00f6"))
+	_, err = other.Stat("missing")
+	assert.ErrorIs(t, err, fs.ErrNotExist)
+	assert.Equal(t, int32(1), atomic.LoadInt32(&counting.lists), "fresh mappings must be reused")
+}
+
+func TestWalkDir(t *testing.T) {
+	v, _ := newTestVault(t)
+
+	for _, dir := range []string{"a", "a/b", "a/b/c", "d"} {
+		require.NoError(t, v.Mkdir(dir))
+	}
+	for _, file := range []string{"a/b/c/file", "a/file", "d/file", "file"} {
+		require.NoError(t, v.WriteFile(file, strings.NewReader("content")))
+	}
+
+	expected := []string{"", "a", "a/b", "a/b/c", "a/b/c/file", "a/file", "d", "d/file", "file"}
+	dirs := map[string]bool{"": true, "a": true, "a/b": true, "a/b/c": true, "d": true}
+
+	walks := map[string]func(root string, fn fs.WalkDirFunc) error{
+		"serial": v.WalkDir,
+		"lexical": func(root string, fn fs.WalkDirFunc) error {
+			return v.WalkDirParallel(context.Background(), root, vault.WalkOptions{Workers: 3}, fn)
+		},
+		"unordered": func(root string, fn fs.WalkDirFunc) error {
+			return v.WalkDirParallel(context.Background(), root, vault.WalkOptions{Order: vault.WalkUnordered}, fn)
+		},
+	}
+
+	for name, walk := range walks {
+		t.Run(name, func(t *testing.T) {
+			var visited []string
+			require.NoError(t, walk("", func(path string, d fs.DirEntry, err error) error {
+				require.NoError(t, err)
+				assert.Equal(t, dirs[path], d.IsDir(), path)
+				visited = append(visited, path)
+				return nil
+			}))
+
+			if name == "unordered" {
+				assert.ElementsMatch(t, expected, visited)
+				for i, path := range visited {
+					assert.NotContains(t, visited[i+1:], gopath.Dir(path), "parents come first")
+				}
+			} else {
+				assert.Equal(t, expected, visited)
+			}
+
+			visited = nil
+			require.NoError(t, walk("a", func(path string, d fs.DirEntry, err error) error {
+				visited = append(visited, path)
+				if path == "a/b" {
+					return fs.SkipDir
+				}
+				return nil
+			}))
+			assert.ElementsMatch(t, []string{"a", "a/b", "a/file"}, visited)
+
+			visited = nil
+			require.NoError(t, walk("file", func(path string, d fs.DirEntry, err error) error {
+				visited = append(visited, path)
+				return err
+			}))
+			assert.Equal(t, []string{"file"}, visited)
+
+			stop := fmt.Errorf("stop")
+			assert.Equal(t, stop, walk("", func(path string, d fs.DirEntry, err error) error {
+				if path == "a/b/c" {
+					return stop
+				}
+				return nil
+			}))
+
+			assert.ErrorIs(t, walk("missing", func(path string, d fs.DirEntry, err error) error {
+				assert.Nil(t, d)
+				return err
+			}), fs.ErrNotExist)
+		})
+	}
+}
+
+func TestStat(t *testing.T) {
+	for _, size := range []int64{0, 1, 32*1024 - 1, 32 * 1024, 32*1024 + 1, 100000} {
+		rawSize, err := vault.CalculateRawFileSize(vault.CalculateEncryptedFileSize(size))
+		assert.NoError(t, err)
+		assert.Equal(t, size, rawSize)
+	}
+
+	for _, size := range []int64{-1, 0, 67, 69, 68 + 48, 68 + 32*1024 + 48 + 48} {
+		_, err := vault.CalculateRawFileSize(size)
+		assert.ErrorIs(t, err, vault.ErrTruncated, size)
+	}
+
+	for name, wrap := range map[string]func(fsys *osfs.Fs) vault.Fs{
+		"stater":      func(fsys *osfs.Fs) vault.Fs { return fsys },
+		"lister":      func(fsys *osfs.Fs) vault.Fs { return minimalFs{fsys, fsys} },
+		"only stater": func(fsys *osfs.Fs) vault.Fs { return staterFs{fsys, fsys} },
+	} {
+		t.Run(name, func(t *testing.T) {
+			storage := osfs.New(t.TempDir())
+			fsys := wrap(storage)
+
+			v, err := vault.Create(fsys, passphrase)
+			require.NoError(t, err)
+			require.NoError(t, v.MkRootDir())
+
+			content := strings.Repeat("x", 40000)
+			require.NoError(t, v.Mkdir("dir"))
+			require.NoError(t, v.WriteFile("dir/file", strings.NewReader(content)))
+			require.NoError(t, v.Mkdir("dir/sub"))
+
+			// Stat only reads, it neither reports nor touches conflict copies
+			filePath, _, err := v.GetFilePath("dir/file")
+			require.NoError(t, err)
+			conflictPath := strings.TrimSuffix(filePath, ".c9r") + " (1).c9r"
+			require.NoError(t, storage.WriteString(conflictPath, "conflict"))
+			v.OnConflict(func(err *vault.ConflictError) {
+				t.Errorf("conflict reported by stat: %v", err)
+			})
+
+			info, err := v.Stat("dir/file")
+			require.NoError(t, err)
+			assert.Equal(t, "file", info.Name())
+			assert.Equal(t, int64(len(content)), info.Size())
+			assert.True(t, info.Mode().IsRegular())
+			assert.False(t, vault.IsTruncated(info))
+
+			encInfo, err := os.Stat(filepath.Join(storage.Root(), filePath))
+			require.NoError(t, err)
+			assert.Equal(t, encInfo.ModTime(), info.ModTime())
+
+			info, err = v.Stat("/dir/")
+			require.NoError(t, err)
+			assert.Equal(t, "dir", info.Name())
+			assert.True(t, info.IsDir())
+
+			info, err = v.Stat("dir/sub")
+			require.NoError(t, err)
+			assert.True(t, info.IsDir())
+
+			info, err = v.Stat("")
+			require.NoError(t, err)
+			assert.True(t, info.IsDir())
+
+			_, err = v.Stat("dir/missing")
+			assert.ErrorIs(t, err, fs.ErrNotExist)
+			_, err = v.Stat("missing/file")
+			assert.ErrorIs(t, err, fs.ErrNotExist)
+
+			// Truncated files have size zero, only reading them fails
+			require.NoError(t, os.Truncate(filepath.Join(storage.Root(), filePath), 68+10))
+			info, err = v.Stat("dir/file")
+			require.NoError(t, err)
+			assert.Equal(t, int64(0), info.Size())
+			assert.True(t, vault.IsTruncated(info))
+			assert.FileExists(t, filepath.Join(storage.Root(), conflictPath))
+
+			r, err := v.OpenFile("dir/file")
+			if err == nil {
+				_, err = io.ReadAll(r)
+				r.Close()
+			}
+			assert.ErrorIs(t, err, vault.ErrTruncated)
+
+			if _, ok := fsys.(vault.Lister); !ok {
+				return
+			}
+
+			v.OnConflict(nil)
+			entries, err := v.ReadDir("dir")
+			require.NoError(t, err)
+			require.Len(t, entries, 3)
+			assert.Equal(t, "file (Conflict 1)", entries[1].Name())
+			info, err = entries[0].Info()
+			require.NoError(t, err)
+			assert.Equal(t, int64(0), info.Size())
+			assert.True(t, vault.IsTruncated(info))
+		})
+	}
+}
@@ -0,0 +1,357 @@
+package vault
+
+import (
+	"context"
+	"io/fs"
+	gopath "path"
+	"sync"
+)
+
+// DefaultWalkWorkers is the number of directories WalkDirParallel lists at
+// once by default.
+const DefaultWalkWorkers = 8
+
+type WalkOrder int
+
+const (
+	// WalkLexical visits the entries in the same order as WalkDir, while
+	// the directories ahead are already listed in the background.
+	WalkLexical WalkOrder = iota
+
+	// WalkUnordered visits the entries of a directory as soon as it is
+	// listed. Directories are still visited before their contents.
+	WalkUnordered
+)
+
+type WalkOptions struct {
+	// Workers is the number of directories listed at once. It defaults to
+	// DefaultWalkWorkers.
+	Workers int
+
+	Order WalkOrder
+}
+
+// WalkDir walks the file tree rooted at root like fs.WalkDir, calling fn
+// for every file and directory in lexical order.
+func (v *Vault) WalkDir(root string, fn fs.WalkDirFunc) error {
+	return v.WalkDirContext(context.Background(), root, fn)
+}
+
+// WalkDirContext is like WalkDir, but stops with the error of ctx when it
+// is done.
+func (v *Vault) WalkDirContext(ctx context.Context, root string, fn fs.WalkDirFunc) error {
+	return v.walkDir(ctx, root, fn, 0, WalkLexical)
+}
+
+// WalkDirParallel is like WalkDirContext, but lists directories with a pool
+// of workers, which resolve the directory ids and decrypt the names of
+// several directories at once. This hides the latency of remote backends.
+// fn is never called concurrently.
+func (v *Vault) WalkDirParallel(ctx context.Context, root string, opts WalkOptions, fn fs.WalkDirFunc) error {
+	if opts.Workers <= 0 {
+		opts.Workers = DefaultWalkWorkers
+	}
+
+	return v.walkDir(ctx, root, fn, opts.Workers, opts.Order)
+}
+
+func (v *Vault) walkDir(ctx context.Context, root string, fn fs.WalkDirFunc, workers int, order WalkOrder) error {
+	ctx, cancel := context.WithCancel(ctx)
+
+	w := &walker{
+		v:        v,
+		ctx:      ctx,
+		cancel:   cancel,
+		fn:       fn,
+		workers:  workers,
+		maxAhead: 4 * workers,
+	}
+	w.cond = sync.NewCond(&w.mu)
+
+	if order == WalkUnordered {
+		w.results = make(chan *listing)
+	}
+
+	for i := 0; i < workers; i++ {
+		w.wg.Add(1)
+		go w.work()
+	}
+	defer w.close()
+
+	d, err := v.rootEntry(ctx, root)
+	if err != nil {
+		if err = fn(root, nil, err); err == fs.SkipDir {
+			err = nil
+		}
+		return err
+	}
+
+	if order == WalkUnordered {
+		return w.walkUnordered(root, d)
+	}
+
+	var l *listing
+	if d.IsDir() {
+		l = w.prefetch(root, d)
+	}
+
+	if err = w.walk(root, d, l); err == fs.SkipDir {
+		err = nil
+	}
+
+	return err
+}
+
+// rootEntry returns the entry of root, which is named "." for the root
+// directory.
+func (v *Vault) rootEntry(ctx context.Context, root string) (fs.DirEntry, error) {
+	info, err := v.StatContext(ctx, root)
+	if err != nil {
+		return nil, err
+	}
+
+	return fs.FileInfoToDirEntry(info), nil
+}
+
+// walker lists directories for a walk, either when they are needed or
+// ahead of time by its workers.
+type walker struct {
+	v      *Vault
+	ctx    context.Context
+	cancel context.CancelFunc
+	fn     fs.WalkDirFunc
+
+	workers int
+
+	// results receives the listings finished by workers for WalkUnordered.
+	results chan *listing
+
+	mu     sync.Mutex
+	cond   *sync.Cond
+	stack  []*listing
+	closed bool
+
+	// ahead counts the listings workers finished that were not consumed
+	// yet. Workers wait while it exceeds maxAhead.
+	ahead    int
+	maxAhead int
+
+	wg sync.WaitGroup
+}
+
+// listing is the listing of one directory. It is done by whoever needs it
+// first, a worker or the walk itself.
+type listing struct {
+	once sync.Once
+	name string
+	d    fs.DirEntry
+
+	entries []fs.DirEntry
+	err     error
+
+	// ahead is set if a worker finished it before the walk needed it.
+	ahead bool
+}
+
+// prefetch returns the listing of the directory name and queues it for the
+// workers. Listings queued last are taken first, which matches the depth
+// first order of the walk.
+func (w *walker) prefetch(name string, d fs.DirEntry) *listing {
+	l := &listing{name: name, d: d}
+
+	if w.workers == 0 {
+		return l
+	}
+
+	w.mu.Lock()
+	w.stack = append(w.stack, l)
+	w.mu.Unlock()
+	w.cond.Signal()
+
+	return l
+}
+
+func (w *walker) work() {
+	defer w.wg.Done()
+
+	for {
+		w.mu.Lock()
+		for !w.closed && (len(w.stack) == 0 || (w.results == nil && w.ahead >= w.maxAhead)) {
+			w.cond.Wait()
+		}
+		if w.closed {
+			w.mu.Unlock()
+			return
+		}
+
+		l := w.stack[len(w.stack)-1]
+		w.stack = w.stack[:len(w.stack)-1]
+		w.mu.Unlock()
+
+		w.run(l, true)
+
+		if w.results != nil {
+			select {
+			case w.results <- l:
+			case <-w.ctx.Done():
+				return
+			}
+		}
+	}
+}
+
+// run lists the directory of l unless it was listed or dropped before.
+func (w *walker) run(l *listing, worker bool) {
+	l.once.Do(func() {
+		l.entries, l.err = w.v.ReadDirContext(w.ctx, l.name)
+
+		if worker && w.results == nil {
+			w.mu.Lock()
+			w.ahead++
+			l.ahead = true
+			w.mu.Unlock()
+		}
+	})
+}
+
+// take returns the entries of l, listing them now if no worker did yet.
+func (w *walker) take(l *listing) ([]fs.DirEntry, error) {
+	w.run(l, false)
+	w.release(l)
+
+	return l.entries, l.err
+}
+
+// drop gives up the listings that are not needed anymore.
+func (w *walker) drop(listings ...*listing) {
+	for _, l := range listings {
+		if l != nil {
+			l.once.Do(func() {})
+			w.release(l)
+		}
+	}
+}
+
+func (w *walker) release(l *listing) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	if l.ahead {
+		l.ahead = false
+		w.ahead--
+		w.cond.Signal()
+	}
+}
+
+// close stops the workers and waits for them.
+func (w *walker) close() {
+	w.cancel()
+
+	w.mu.Lock()
+	w.closed = true
+	w.mu.Unlock()
+	w.cond.Broadcast()
+
+	w.wg.Wait()
+}
+
+// walk visits name and everything below it in lexical order, like the walk
+// of fs.WalkDir. l is the listing of name if it is a directory.
+func (w *walker) walk(name string, d fs.DirEntry, l *listing) error {
+	if err := w.ctx.Err(); err != nil {
+		w.drop(l)
+		return err
+	}
+
+	if err := w.fn(name, d, nil); err != nil || !d.IsDir() {
+		w.drop(l)
+		if err == fs.SkipDir && d.IsDir() {
+			err = nil
+		}
+		return err
+	}
+
+	entries, err := w.take(l)
+	if err != nil {
+		if err = w.fn(name, d, err); err != nil {
+			if err == fs.SkipDir {
+				err = nil
+			}
+			return err
+		}
+	}
+
+	// Queue the last directory first, so that the first is taken first
+	listings := make([]*listing, len(entries))
+	for i := len(entries) - 1; i >= 0; i-- {
+		if entries[i].IsDir() {
+			listings[i] = w.prefetch(gopath.Join(name, entries[i].Name()), entries[i])
+		}
+	}
+
+	for i, entry := range entries {
+		if err := w.walk(gopath.Join(name, entry.Name()), entry, listings[i]); err != nil {
+			w.drop(listings[i+1:]...)
+			if err == fs.SkipDir {
+				break
+			}
+			return err
+		}
+	}
+
+	return nil
+}
+
+// walkUnordered visits the entries of the directories in the order the
+// workers list them.
+func (w *walker) walkUnordered(root string, d fs.DirEntry) error {
+	if err := w.fn(root, d, nil); err != nil || !d.IsDir() {
+		if err == fs.SkipDir {
+			err = nil
+		}
+		return err
+	}
+
+	w.prefetch(root, d)
+
+	for pending := 1; pending > 0; pending-- {
+		var l *listing
+		select {
+		case l = <-w.results:
+		case <-w.ctx.Done():
+			return w.ctx.Err()
+		}
+
+		if l.err != nil {
+			if err := w.fn(l.name, l.d, l.err); err != nil && err != fs.SkipDir {
+				return err
+			}
+			continue
+		}
+
+		for _, entry := range l.entries {
+			if err := w.ctx.Err(); err != nil {
+				return err
+			}
+
+			name := gopath.Join(l.name, entry.Name())
+
+			err := w.fn(name, entry, nil)
+			if err == fs.SkipDir {
+				if entry.IsDir() {
+					continue
+				}
+				break
+			} else if err != nil {
+				return err
+			}
+
+			if entry.IsDir() {
+				w.prefetch(name, entry)
+				pending++
+			}
+		}
+	}
+
+	return nil
+}
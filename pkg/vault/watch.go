@@ -0,0 +1,526 @@
+package vault
+
+import (
+	"context"
+	"io/fs"
+	gopath "path"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/fhilgers/gocryptomator/internal/constants"
+)
+
+// Watcher is implemented by an Fs that reports changes made to it by any
+// client.
+type Watcher interface {
+	// Watch sends the names of changed files and directories until ctx is
+	// done and closes the channel then.
+	Watch(ctx context.Context) (<-chan string, error)
+}
+
+// DefaultPollInterval is used by Watch for an Fs that is not a Watcher.
+const DefaultPollInterval = 30 * time.Second
+
+// DefaultDebounce is used by Watch if WatchOptions.Debounce is not set.
+const DefaultDebounce = 100 * time.Millisecond
+
+type WatchOptions struct {
+	// PollInterval is the interval in which an Fs that is not a Watcher is
+	// listed to find changes. It defaults to DefaultPollInterval.
+	PollInterval time.Duration
+
+	// Debounce is how long changes are collected after the first one
+	// before they are translated and reported together, so that a burst of
+	// changes, like a directory being copied, is handled at once. It
+	// defaults to DefaultDebounce.
+	Debounce time.Duration
+}
+
+// maxQueuedEvents bounds the events Watch holds for a slow receiver.
+const maxQueuedEvents = 1024
+
+// ChangeEvent reports a change to the vault.
+type ChangeEvent struct {
+	// Path is the cleartext path of the file or directory that changed. If
+	// its name cannot be decrypted, for example because it is already gone,
+	// it is the directory containing it. If the receiver falls behind by
+	// too many events, they are replaced by one for the root directory "".
+	Path string
+}
+
+// Watch invalidates the directory id cache whenever the storage of v
+// changes, no matter who changed it, and reports the cleartext paths of the
+// changes, each once per batch of changes. Without a Watcher, the Fs is
+// listed every PollInterval, which needs a Lister. The directories of the
+// vault are indexed in the background, changes are translated once that is
+// done. The cache is invalidated independently of the receiver, which may
+// fall behind. The channel is closed once ctx is done.
+func (v *Vault) Watch(ctx context.Context, opts WatchOptions) (<-chan ChangeEvent, error) {
+	if opts.PollInterval <= 0 {
+		opts.PollInterval = DefaultPollInterval
+	}
+
+	if opts.Debounce <= 0 {
+		opts.Debounce = DefaultDebounce
+	}
+
+	fsys := v.fsys(ctx)
+
+	watcher, ok := fsys.(Watcher)
+	if !ok {
+		lister, ok := fsys.(Lister)
+		if !ok {
+			return nil, ErrNotSupported
+		}
+
+		watcher = &pollWatcher{lister: lister, interval: opts.PollInterval}
+	}
+
+	names, err := watcher.Watch(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	t := &translator{v: v, fs: fsys, dirs: map[string]translatedDir{}}
+	q := newEventQueue()
+
+	go func() {
+		defer q.close()
+
+		t.index(ctx, "")
+
+		for {
+			batch, open := debounce(names, opts.Debounce)
+
+			q.push(t.translateAll(ctx, batch))
+
+			if !open {
+				return
+			}
+		}
+	}()
+
+	events := make(chan ChangeEvent)
+
+	go func() {
+		defer close(events)
+
+		for {
+			paths, closed := q.pop()
+
+			for _, path := range paths {
+				select {
+				case events <- ChangeEvent{Path: path}:
+				case <-ctx.Done():
+					return
+				}
+			}
+
+			if len(paths) > 0 {
+				continue
+			}
+
+			if closed {
+				return
+			}
+
+			select {
+			case <-q.ready:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+
+	return events, nil
+}
+
+// eventQueue holds the translated paths until the receiver of Watch takes
+// them. If it falls behind by more than maxQueuedEvents, the queue is
+// collapsed to the root directory, which covers every change.
+type eventQueue struct {
+	mu        sync.Mutex
+	paths     []string
+	collapsed bool
+	closed    bool
+
+	// ready is signalled when paths were pushed or the queue was closed.
+	ready chan struct{}
+}
+
+func newEventQueue() *eventQueue {
+	return &eventQueue{ready: make(chan struct{}, 1)}
+}
+
+func (q *eventQueue) push(paths []string) {
+	if len(paths) == 0 {
+		return
+	}
+
+	q.mu.Lock()
+	switch {
+	case q.collapsed:
+	case len(q.paths)+len(paths) > maxQueuedEvents:
+		q.paths, q.collapsed = []string{""}, true
+	default:
+		q.paths = append(q.paths, paths...)
+	}
+	q.mu.Unlock()
+
+	q.signal()
+}
+
+// pop takes all queued paths and reports whether the queue is closed.
+func (q *eventQueue) pop() (paths []string, closed bool) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	paths, q.paths, q.collapsed = q.paths, nil, false
+
+	return paths, q.closed
+}
+
+func (q *eventQueue) close() {
+	q.mu.Lock()
+	q.closed = true
+	q.mu.Unlock()
+
+	q.signal()
+}
+
+func (q *eventQueue) signal() {
+	select {
+	case q.ready <- struct{}{}:
+	default:
+	}
+}
+
+// debounce waits for a name and collects the names that follow within d.
+// It reports false once names is closed.
+func debounce(names <-chan string, d time.Duration) (batch []string, open bool) {
+	name, open := <-names
+	if !open {
+		return nil, false
+	}
+	batch = append(batch, name)
+
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+
+	for {
+		select {
+		case name, open := <-names:
+			if !open {
+				return batch, false
+			}
+			batch = append(batch, name)
+		case <-timer.C:
+			return batch, true
+		}
+	}
+}
+
+// translator maps encrypted paths back to cleartext paths.
+type translator struct {
+	v  *Vault
+	fs Fs
+
+	mu   sync.Mutex
+	dirs map[string]translatedDir
+}
+
+type translatedDir struct {
+	path  string
+	dirID string
+}
+
+// change is a name reported by a Watcher, translated.
+type change struct {
+	// path is the cleartext path of the change.
+	path string
+
+	// dirID is the id of the directory the change happened in.
+	dirID string
+
+	// node is set if the change is an encrypted node or its dir.c9r, which
+	// may make a directory appear.
+	node bool
+}
+
+// index records the encrypted path of every directory in the subtree
+// root. What was recorded for the subtree before is dropped, so directories
+// that are gone are forgotten.
+func (t *translator) index(ctx context.Context, root string) {
+	dirs := map[string]translatedDir{}
+
+	var walk func(name string)
+	walk = func(name string) {
+		dirPath, dirID, err := t.v.GetDirPathContext(ctx, name)
+		if err != nil {
+			return
+		}
+		dirs[dirPath] = translatedDir{path: name, dirID: dirID}
+
+		entries, err := t.v.ReadDirContext(ctx, name)
+		if err != nil {
+			return
+		}
+
+		for _, entry := range entries {
+			if entry.IsDir() {
+				walk(gopath.Join(name, entry.Name()))
+			}
+		}
+	}
+	walk(root)
+
+	t.mu.Lock()
+	for dirPath, dir := range t.dirs {
+		if below(dir.path, []string{root}) {
+			delete(t.dirs, dirPath)
+		}
+	}
+	for dirPath, dir := range dirs {
+		t.dirs[dirPath] = dir
+	}
+	t.mu.Unlock()
+}
+
+func (t *translator) lookup(dirPath string) (dir translatedDir, ok bool) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	dir, ok = t.dirs[dirPath]
+
+	return
+}
+
+// translateAll returns the cleartext paths of a batch of names, each once,
+// and invalidates the cache for them. Nodes that changed are indexed, as
+// another client may have created or replaced a directory there. A new
+// directory may be reported before its node, so names in directories that
+// are not known yet are translated again as long as that indexes new
+// directories. The others are gone or unreachable and dropped.
+func (t *translator) translateAll(ctx context.Context, names []string) (paths []string) {
+	seen := map[string]bool{}
+	var indexed []string
+
+	for len(names) > 0 {
+		var unknown []string
+
+		for _, name := range names {
+			c, known, ok := t.translate(name)
+			if !known {
+				unknown = append(unknown, name)
+			}
+			if !ok {
+				continue
+			}
+
+			t.v.nameMap.forget(c.dirID)
+
+			if !seen[c.path] {
+				seen[c.path] = true
+				paths = append(paths, c.path)
+
+				t.v.InvalidateCache(c.path)
+			}
+
+			if c.node && !below(c.path, indexed) {
+				t.index(ctx, c.path)
+				indexed = append(indexed, c.path)
+			}
+		}
+
+		if len(unknown) == len(names) {
+			break
+		}
+		names = unknown
+	}
+
+	return
+}
+
+// below reports whether path is one of roots or below one of them.
+func below(path string, roots []string) bool {
+	for _, root := range roots {
+		if root == "" || path == root || strings.HasPrefix(path, root+PathSeparator) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// translate translates a name reported by a Watcher. Names outside of the
+// data directory are ignored. It reports whether the directory of name is
+// known.
+func (t *translator) translate(name string) (c change, known, ok bool) {
+	segments := strings.Split(strings.Trim(name, PathSeparator), PathSeparator)
+	if len(segments) < 3 || segments[0] != DataDir {
+		return change{}, true, false
+	}
+
+	dirPath := gopath.Join(segments[:3]...)
+
+	dir, known := t.lookup(dirPath)
+	if !known {
+		return change{}, false, false
+	}
+
+	c = change{path: dir.path, dirID: dir.dirID}
+
+	if len(segments) == 3 {
+		return c, true, true
+	}
+
+	encName := segments[3]
+	if strings.HasSuffix(encName, constants.ShortenedSuffix) {
+		longName, err := readShortenedName(t.fs, gopath.Join(dirPath, encName))
+		if err != nil {
+			return c, true, true
+		}
+		encName = longName
+	}
+
+	clearName, err := t.v.DecryptFileName(encName, dir.dirID)
+	if err != nil {
+		return c, true, true
+	}
+
+	c.path = gopath.Join(dir.path, clearName)
+	c.node = len(segments) == 4 || segments[4] == constants.DirFile
+
+	return c, true, true
+}
+
+// pollWatcher lists the data directory of an Fs periodically and reports
+// the entries that appeared, disappeared or changed size or modification
+// time.
+type pollWatcher struct {
+	lister   Lister
+	interval time.Duration
+}
+
+type polledEntry struct {
+	size    int64
+	modTime time.Time
+}
+
+func (w *pollWatcher) Watch(ctx context.Context) (<-chan string, error) {
+	last, err := w.list()
+	if err != nil {
+		return nil, err
+	}
+
+	names := make(chan string)
+
+	go func() {
+		defer close(names)
+
+		ticker := time.NewTicker(w.interval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+			}
+
+			current, err := w.list()
+			if err != nil {
+				continue
+			}
+
+			var changed []string
+			for name, entry := range current {
+				if old, ok := last[name]; !ok || old != entry {
+					changed = append(changed, name)
+				}
+			}
+			for name := range last {
+				if _, ok := current[name]; !ok {
+					changed = append(changed, name)
+				}
+			}
+			last = current
+
+			for _, name := range changed {
+				select {
+				case names <- name:
+				case <-ctx.Done():
+					return
+				}
+			}
+		}
+	}()
+
+	return names, nil
+}
+
+// list returns the directories of the data directory and the entries in
+// them, whose names are what the vault needs to translate a change.
+func (w *pollWatcher) list() (map[string]polledEntry, error) {
+	entries := map[string]polledEntry{}
+
+	prefixes, err := w.lister.ReadDir(DataDir)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, prefix := range prefixes {
+		prefixPath := gopath.Join(DataDir, prefix.Name())
+
+		dirs, err := w.lister.ReadDir(prefixPath)
+		if err != nil {
+			continue
+		}
+
+		for _, dir := range dirs {
+			dirPath := gopath.Join(prefixPath, dir.Name())
+			entries[dirPath] = polledEntry{}
+
+			nodes, err := w.lister.ReadDir(dirPath)
+			if err != nil {
+				continue
+			}
+
+			for _, node := range nodes {
+				nodePath := gopath.Join(dirPath, node.Name())
+				entries[nodePath] = newPolledEntry(node)
+
+				if node.IsDir() {
+					w.listNode(entries, nodePath)
+				}
+			}
+		}
+	}
+
+	return entries, nil
+}
+
+// listNode adds the contents of a directory node, so that a dir.c9r
+// appearing after its directory is noticed.
+func (w *pollWatcher) listNode(entries map[string]polledEntry, nodePath string) {
+	files, err := w.lister.ReadDir(nodePath)
+	if err != nil {
+		return
+	}
+
+	for _, file := range files {
+		entries[gopath.Join(nodePath, file.Name())] = newPolledEntry(file)
+	}
+}
+
+// newPolledEntry records the size and modification time of files. Only
+// the existence of directories matters.
+func newPolledEntry(entry fs.DirEntry) polledEntry {
+	info, err := entry.Info()
+	if err != nil || info.IsDir() {
+		return polledEntry{}
+	}
+
+	return polledEntry{size: info.Size(), modTime: info.ModTime()}
+}
@@ -0,0 +1,589 @@
+// Package webdavfs implements the vault Fs interface on top of a WebDAV
+// server like Nextcloud or ownCloud.
+package webdavfs
+
+import (
+	"bytes"
+	"context"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"net/http"
+	"net/url"
+	gopath "path"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/fhilgers/gocryptomator/pkg/vault"
+)
+
+type Config struct {
+	// URL of the collection the vault is stored in.
+	URL string
+
+	Username string
+	Password string
+
+	// Client is used for all requests. Defaults to http.DefaultClient.
+	Client *http.Client
+}
+
+type Fs struct {
+	base   *url.URL
+	cfg    Config
+	client *http.Client
+	ctx    context.Context
+}
+
+// Error is an unexpected status returned by the server.
+type Error struct {
+	Method     string
+	StatusCode int
+}
+
+func (e *Error) Error() string {
+	return fmt.Sprintf("webdav: %s: %d %s", e.Method, e.StatusCode, http.StatusText(e.StatusCode))
+}
+
+// Is maps the status codes onto the errors of io/fs. Failed preconditions
+// only happen on exclusive creates, so they are reported as fs.ErrExist.
+func (e *Error) Is(target error) bool {
+	switch target {
+	case fs.ErrNotExist:
+		return e.StatusCode == http.StatusNotFound || e.StatusCode == http.StatusConflict
+	case fs.ErrExist:
+		return e.StatusCode == http.StatusPreconditionFailed
+	case fs.ErrPermission:
+		return e.StatusCode == http.StatusUnauthorized || e.StatusCode == http.StatusForbidden
+	}
+
+	return false
+}
+
+func New(cfg Config) (*Fs, error) {
+	base, err := url.Parse(cfg.URL)
+	if err != nil {
+		return nil, err
+	}
+	base.Path = strings.TrimSuffix(base.Path, "/")
+	base.RawPath = ""
+
+	client := cfg.Client
+	if client == nil {
+		client = http.DefaultClient
+	}
+
+	return &Fs{base: base, cfg: cfg, client: client}, nil
+}
+
+// WithContext returns a copy of the Fs that makes all requests with ctx.
+func (f *Fs) WithContext(ctx context.Context) vault.Fs {
+	c := *f
+	c.ctx = ctx
+
+	return &c
+}
+
+func (f *Fs) context() context.Context {
+	if f.ctx == nil {
+		return context.Background()
+	}
+
+	return f.ctx
+}
+
+func (f *Fs) Open(name string) (io.ReadCloser, error) {
+	r := &reader{f: f, name: name}
+
+	if err := r.get(); err != nil {
+		return nil, &fs.PathError{Op: "open", Path: name, Err: err}
+	}
+
+	return r, nil
+}
+
+// WriteString creates the file with If-None-Match: *. As not every server
+// honors the header, the existence is checked beforehand as well.
+func (f *Fs) WriteString(name, content string) error {
+	if _, err := f.Stat(name); err == nil {
+		return &fs.PathError{Op: "write", Path: name, Err: fs.ErrExist}
+	} else if !errors.Is(err, fs.ErrNotExist) {
+		return err
+	}
+
+	header := http.Header{"If-None-Match": {"*"}}
+	if _, err := f.do(http.MethodPut, name, header, strings.NewReader(content), http.StatusCreated, http.StatusNoContent, http.StatusOK); err != nil {
+		return &fs.PathError{Op: "write", Path: name, Err: err}
+	}
+
+	return nil
+}
+
+func (f *Fs) RemoveDir(name string) error {
+	infos, err := f.propfind(name, "1")
+	if err != nil {
+		return &fs.PathError{Op: "removedir", Path: name, Err: err}
+	}
+
+	if !infos[0].IsDir() {
+		return &fs.PathError{Op: "removedir", Path: name, Err: errors.New("not a directory")}
+	}
+
+	if len(infos) > 1 {
+		return &fs.PathError{Op: "removedir", Path: name, Err: errors.New("directory not empty")}
+	}
+
+	if _, err := f.do(http.MethodDelete, name+"/", nil, nil, http.StatusNoContent, http.StatusOK); err != nil {
+		return &fs.PathError{Op: "removedir", Path: name, Err: err}
+	}
+
+	return nil
+}
+
+func (f *Fs) RemoveFile(name string) error {
+	info, err := f.Stat(name)
+	if err != nil {
+		return err
+	}
+
+	if info.IsDir() {
+		return &fs.PathError{Op: "removefile", Path: name, Err: errors.New("is a directory")}
+	}
+
+	if _, err := f.do(http.MethodDelete, name, nil, nil, http.StatusNoContent, http.StatusOK); err != nil {
+		return &fs.PathError{Op: "removefile", Path: name, Err: err}
+	}
+
+	return nil
+}
+
+// MkdirAll creates the collection, creating missing parents only if the
+// server reports them missing.
+func (f *Fs) MkdirAll(name string) error {
+	name = strings.Trim(gopath.Clean("/"+name), "/")
+	if name == "" {
+		return nil
+	}
+
+	_, err := f.do("MKCOL", name+"/", nil, nil, http.StatusCreated)
+
+	var statusErr *Error
+	switch {
+	case err == nil:
+		return nil
+	case errors.As(err, &statusErr) && statusErr.StatusCode == http.StatusMethodNotAllowed:
+		if info, err := f.Stat(name); err != nil || !info.IsDir() {
+			return &fs.PathError{Op: "mkdir", Path: name, Err: errors.New("not a directory")}
+		}
+		return nil
+	case errors.As(err, &statusErr) && statusErr.StatusCode == http.StatusConflict:
+		if err := f.MkdirAll(gopath.Dir(name)); err != nil {
+			return err
+		}
+		return f.MkdirAll(name)
+	default:
+		return &fs.PathError{Op: "mkdir", Path: name, Err: err}
+	}
+}
+
+func (f *Fs) ReadDir(name string) ([]fs.DirEntry, error) {
+	infos, err := f.propfind(name, "1")
+	if err != nil {
+		return nil, &fs.PathError{Op: "readdir", Path: name, Err: err}
+	}
+
+	if !infos[0].IsDir() {
+		return nil, &fs.PathError{Op: "readdir", Path: name, Err: errors.New("not a directory")}
+	}
+
+	entries := make([]fs.DirEntry, 0, len(infos)-1)
+	for _, info := range infos[1:] {
+		entries = append(entries, fs.FileInfoToDirEntry(info))
+	}
+
+	sort.Slice(entries, func(i, j int) bool {
+		return entries[i].Name() < entries[j].Name()
+	})
+
+	return entries, nil
+}
+
+// Stat returns the info of a single file or directory.
+func (f *Fs) Stat(name string) (fs.FileInfo, error) {
+	infos, err := f.propfind(name, "0")
+	if err != nil {
+		return nil, &fs.PathError{Op: "stat", Path: name, Err: err}
+	}
+
+	return infos[0], nil
+}
+
+// Rename moves a file or directory with MOVE, failing if newName exists.
+func (f *Fs) Rename(oldName, newName string) error {
+	header := http.Header{
+		"Destination": {f.url(newName).String()},
+		"Overwrite":   {"F"},
+	}
+
+	if _, err := f.do("MOVE", oldName, header, nil, http.StatusCreated, http.StatusNoContent); err != nil {
+		// Some servers answer a missing source with 403
+		if _, statErr := f.Stat(oldName); errors.Is(statErr, fs.ErrNotExist) {
+			return statErr
+		}
+
+		return &fs.PathError{Op: "rename", Path: oldName, Err: err}
+	}
+
+	return nil
+}
+
+// Replace moves the file oldName over newName with MOVE and Overwrite: T,
+// which the server performs in one request. Some servers remove newName
+// before looking for oldName, so oldName is checked first.
+func (f *Fs) Replace(oldName, newName string) error {
+	if _, err := f.Stat(oldName); err != nil {
+		return err
+	}
+
+	header := http.Header{
+		"Destination": {f.url(newName).String()},
+		"Overwrite":   {"T"},
+	}
+
+	if _, err := f.do("MOVE", oldName, header, nil, http.StatusCreated, http.StatusNoContent); err != nil {
+		return &fs.PathError{Op: "replace", Path: oldName, Err: err}
+	}
+
+	return nil
+}
+
+// Copy copies a file with COPY, failing if dst exists.
+func (f *Fs) Copy(src, dst string) error {
+	header := http.Header{
+		"Destination": {f.url(dst).String()},
+		"Overwrite":   {"F"},
+		"Depth":       {"0"},
+	}
+
+	if _, err := f.do("COPY", src, header, nil, http.StatusCreated, http.StatusNoContent); err != nil {
+		return &fs.PathError{Op: "copy", Path: src, Err: err}
+	}
+
+	return nil
+}
+
+// Create returns a writer whose content is streamed to the server with a
+// single PUT, which completes on Close. Aborting the writer cancels the PUT
+// and removes whatever the server stored of it.
+func (f *Fs) Create(name string) (io.WriteCloser, error) {
+	if _, err := f.Stat(name); err == nil {
+		return nil, &fs.PathError{Op: "create", Path: name, Err: fs.ErrExist}
+	} else if !errors.Is(err, fs.ErrNotExist) {
+		return nil, err
+	}
+
+	pipeReader, pipeWriter := io.Pipe()
+	w := &writer{f: f, name: name, pipe: pipeWriter, done: make(chan error, 1)}
+
+	go func() {
+		header := http.Header{"If-None-Match": {"*"}}
+		_, err := f.do(http.MethodPut, name, header, pipeReader, http.StatusCreated, http.StatusNoContent, http.StatusOK)
+		pipeReader.CloseWithError(err)
+		w.done <- err
+	}()
+
+	return w, nil
+}
+
+func (f *Fs) url(name string) *url.URL {
+	u := *f.base
+
+	u.Path = gopath.Join(f.base.Path, name)
+	if strings.HasSuffix(name, "/") {
+		u.Path += "/"
+	}
+
+	return &u
+}
+
+func (f *Fs) do(method, name string, header http.Header, body io.Reader, expected ...int) (*http.Response, error) {
+	req, err := http.NewRequestWithContext(f.context(), method, f.url(name).String(), body)
+	if err != nil {
+		return nil, err
+	}
+
+	for key, values := range header {
+		req.Header[key] = values
+	}
+
+	if f.cfg.Username != "" || f.cfg.Password != "" {
+		req.SetBasicAuth(f.cfg.Username, f.cfg.Password)
+	}
+
+	resp, err := f.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, status := range expected {
+		if resp.StatusCode == status {
+			if method != http.MethodGet {
+				io.Copy(io.Discard, resp.Body)
+				resp.Body.Close()
+			}
+
+			return resp, nil
+		}
+	}
+
+	resp.Body.Close()
+
+	return nil, &Error{Method: method, StatusCode: resp.StatusCode}
+}
+
+const propfindBody = `<?xml version="1.0" encoding="utf-8"?>
+<D:propfind xmlns:D="DAV:"><D:prop><D:resourcetype/><D:getcontentlength/><D:getlastmodified/></D:prop></D:propfind>`
+
+type multistatus struct {
+	Responses []struct {
+		Href     string `xml:"DAV: href"`
+		Propstat []struct {
+			Status string `xml:"DAV: status"`
+			Prop   struct {
+				ResourceType struct {
+					Collection *struct{} `xml:"DAV: collection"`
+				} `xml:"DAV: resourcetype"`
+				ContentLength string `xml:"DAV: getcontentlength"`
+				LastModified  string `xml:"DAV: getlastmodified"`
+			} `xml:"DAV: prop"`
+		} `xml:"DAV: propstat"`
+	} `xml:"DAV: response"`
+}
+
+// propfind returns the info of name first, followed by its children for
+// depth 1.
+func (f *Fs) propfind(name, depth string) ([]*fileInfo, error) {
+	header := http.Header{
+		"Depth":        {depth},
+		"Content-Type": {"application/xml; charset=utf-8"},
+	}
+
+	req, err := http.NewRequestWithContext(f.context(), "PROPFIND", f.url(name).String(), bytes.NewReader([]byte(propfindBody)))
+	if err != nil {
+		return nil, err
+	}
+	req.Header = header
+
+	if f.cfg.Username != "" || f.cfg.Password != "" {
+		req.SetBasicAuth(f.cfg.Username, f.cfg.Password)
+	}
+
+	resp, err := f.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusMultiStatus {
+		return nil, &Error{Method: "PROPFIND", StatusCode: resp.StatusCode}
+	}
+
+	var ms multistatus
+	if err := xml.NewDecoder(resp.Body).Decode(&ms); err != nil {
+		return nil, err
+	}
+
+	self := strings.TrimSuffix(f.url(name).Path, "/")
+
+	var (
+		selfInfo *fileInfo
+		infos    []*fileInfo
+	)
+
+	for _, response := range ms.Responses {
+		href, err := url.Parse(response.Href)
+		if err != nil {
+			return nil, err
+		}
+		hrefPath := strings.TrimSuffix(href.Path, "/")
+
+		info := &fileInfo{name: gopath.Base(hrefPath)}
+
+		for _, propstat := range response.Propstat {
+			if !strings.Contains(propstat.Status, " 200 ") {
+				continue
+			}
+
+			prop := propstat.Prop
+			info.dir = prop.ResourceType.Collection != nil
+			info.size, _ = strconv.ParseInt(prop.ContentLength, 10, 64)
+			info.modTime, _ = http.ParseTime(prop.LastModified)
+		}
+
+		if hrefPath == self {
+			selfInfo = info
+		} else {
+			infos = append(infos, info)
+		}
+	}
+
+	if selfInfo == nil {
+		return nil, errors.New("webdav: response does not contain the requested resource")
+	}
+
+	return append([]*fileInfo{selfInfo}, infos...), nil
+}
+
+type fileInfo struct {
+	name    string
+	size    int64
+	modTime time.Time
+	dir     bool
+}
+
+func (fi *fileInfo) Name() string       { return fi.name }
+func (fi *fileInfo) Size() int64        { return fi.size }
+func (fi *fileInfo) ModTime() time.Time { return fi.modTime }
+func (fi *fileInfo) IsDir() bool        { return fi.dir }
+func (fi *fileInfo) Sys() any           { return nil }
+
+func (fi *fileInfo) Mode() fs.FileMode {
+	if fi.dir {
+		return fs.ModeDir | 0o755
+	}
+
+	return 0o644
+}
+
+// reader reads a file with range requests, so it can be seeked without
+// downloading the skipped parts.
+type reader struct {
+	f    *Fs
+	name string
+	size int64
+
+	offset int64
+	body   io.ReadCloser
+}
+
+func (r *reader) get() error {
+	header := http.Header{}
+	if r.offset > 0 {
+		header.Set("Range", "bytes="+strconv.FormatInt(r.offset, 10)+"-")
+	}
+
+	resp, err := r.f.do(http.MethodGet, r.name, header, nil, http.StatusOK, http.StatusPartialContent)
+	if err != nil {
+		return err
+	}
+
+	if r.offset > 0 && resp.StatusCode != http.StatusPartialContent {
+		resp.Body.Close()
+		return errors.New("webdav: server does not support range requests")
+	}
+
+	if r.offset == 0 {
+		r.size = resp.ContentLength
+	}
+	r.body = resp.Body
+
+	return nil
+}
+
+func (r *reader) Read(p []byte) (int, error) {
+	if r.size >= 0 && r.offset >= r.size {
+		return 0, io.EOF
+	}
+
+	if r.body == nil {
+		if err := r.get(); err != nil {
+			return 0, err
+		}
+	}
+
+	n, err := r.body.Read(p)
+	r.offset += int64(n)
+
+	return n, err
+}
+
+func (r *reader) Seek(offset int64, whence int) (int64, error) {
+	if r.size < 0 {
+		return 0, errors.New("webdav: unknown content length")
+	}
+
+	switch whence {
+	case io.SeekStart:
+	case io.SeekCurrent:
+		offset += r.offset
+	case io.SeekEnd:
+		offset += r.size
+	default:
+		return 0, errors.New("webdav: invalid whence")
+	}
+
+	if offset < 0 {
+		return 0, errors.New("webdav: negative position")
+	}
+
+	if offset != r.offset && r.body != nil {
+		r.body.Close()
+		r.body = nil
+	}
+	r.offset = offset
+
+	return offset, nil
+}
+
+func (r *reader) Close() error {
+	if r.body == nil {
+		return nil
+	}
+
+	return r.body.Close()
+}
+
+type writer struct {
+	f    *Fs
+	name string
+	pipe *io.PipeWriter
+	done chan error
+}
+
+func (w *writer) Write(p []byte) (int, error) {
+	return w.pipe.Write(p)
+}
+
+// errAborted ends the request body of an aborted writer.
+var errAborted = errors.New("webdavfs: upload aborted")
+
+// Abort cancels the PUT. Servers may still store the partial body, so it is
+// removed unless the PUT failed because someone else created the file.
+func (w *writer) Abort() error {
+	w.pipe.CloseWithError(errAborted)
+
+	var statusErr *Error
+	if err := <-w.done; errors.As(err, &statusErr) && statusErr.StatusCode == http.StatusPreconditionFailed {
+		return nil
+	}
+
+	if err := w.f.RemoveFile(w.name); err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return err
+	}
+
+	return nil
+}
+
+func (w *writer) Close() error {
+	w.pipe.Close()
+
+	if err := <-w.done; err != nil {
+		return &fs.PathError{Op: "write", Path: w.name, Err: err}
+	}
+
+	return nil
+}
@@ -0,0 +1,54 @@
+package webdavfs_test
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/fhilgers/gocryptomator/pkg/vault"
+	"github.com/fhilgers/gocryptomator/pkg/vault/fstest"
+	"github.com/fhilgers/gocryptomator/pkg/webdavfs"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/net/webdav"
+)
+
+const prefix = "/remote.php/dav/files/user"
+
+func newTestFs(t *testing.T) *webdavfs.Fs {
+	handler := &webdav.Handler{
+		Prefix:     prefix,
+		FileSystem: webdav.NewMemFS(),
+		LockSystem: webdav.NewMemLS(),
+	}
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if user, password, ok := r.BasicAuth(); !ok || user != "user" || password != "secret" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+
+		handler.ServeHTTP(w, r)
+	}))
+	t.Cleanup(server.Close)
+
+	f, err := webdavfs.New(webdavfs.Config{
+		URL:      server.URL + prefix,
+		Username: "user",
+		Password: "secret",
+	})
+	require.NoError(t, err)
+
+	return f
+}
+
+func TestConformance(t *testing.T) {
+	fstest.TestFs(t, func() vault.Fs {
+		return newTestFs(t)
+	})
+}
+
+func TestVault(t *testing.T) {
+	fstest.TestVault(t, func() vault.Fs {
+		return newTestFs(t)
+	})
+}
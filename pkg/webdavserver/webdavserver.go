@@ -0,0 +1,403 @@
+// Package webdavserver exposes an unlocked vault as a webdav.FileSystem.
+package webdavserver
+
+import (
+	"context"
+	"crypto/subtle"
+	"errors"
+	"io"
+	"io/fs"
+	"net/http"
+	"os"
+	gopath "path"
+	"strings"
+	"time"
+
+	"github.com/fhilgers/gocryptomator/pkg/vault"
+	"golang.org/x/net/webdav"
+)
+
+type FileSystem struct {
+	v *vault.Vault
+}
+
+func NewFileSystem(v *vault.Vault) *FileSystem {
+	return &FileSystem{v: v}
+}
+
+// NewHandler returns a webdav handler serving the vault below prefix.
+func NewHandler(v *vault.Vault, prefix string) *webdav.Handler {
+	return &webdav.Handler{
+		Prefix:     prefix,
+		FileSystem: NewFileSystem(v),
+		LockSystem: webdav.NewMemLS(),
+	}
+}
+
+// BasicAuth wraps h and rejects requests without the given credentials.
+func BasicAuth(h http.Handler, user, password string) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		u, p, ok := r.BasicAuth()
+
+		userOk := subtle.ConstantTimeCompare([]byte(u), []byte(user)) == 1
+		passwordOk := subtle.ConstantTimeCompare([]byte(p), []byte(password)) == 1
+
+		if !ok || !userOk || !passwordOk {
+			w.Header().Set("WWW-Authenticate", `Basic realm="gocryptomator"`)
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+
+		h.ServeHTTP(w, r)
+	})
+}
+
+func (fsys *FileSystem) Mkdir(ctx context.Context, name string, perm os.FileMode) error {
+	if _, err := fsys.v.GetDirIDContext(ctx, name); err == nil {
+		return &fs.PathError{Op: "mkdir", Path: name, Err: fs.ErrExist}
+	}
+
+	return convertError(fsys.v.MkdirContext(ctx, name))
+}
+
+func (fsys *FileSystem) OpenFile(ctx context.Context, name string, flag int, perm os.FileMode) (webdav.File, error) {
+	info, err := fsys.stat(ctx, name)
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return nil, convertError(err)
+	}
+
+	if flag&(os.O_WRONLY|os.O_RDWR|os.O_CREATE|os.O_TRUNC) != 0 {
+		switch {
+		case info == nil && flag&os.O_CREATE == 0:
+			return nil, convertError(err)
+		case info != nil && flag&os.O_EXCL != 0:
+			return nil, &fs.PathError{Op: "open", Path: name, Err: fs.ErrExist}
+		case info != nil && info.IsDir():
+			return nil, &fs.PathError{Op: "open", Path: name, Err: errors.New("is a directory")}
+		case info != nil && flag&os.O_TRUNC == 0:
+			return nil, &fs.PathError{Op: "open", Path: name, Err: errors.New("only truncating writes are supported")}
+		}
+
+		if _, err := fsys.v.GetDirIDContext(ctx, gopath.Dir(cleanName(name))); err != nil {
+			return nil, convertError(err)
+		}
+
+		return newWriteFile(ctx, fsys.v, name, info != nil), nil
+	}
+
+	if info == nil {
+		return nil, convertError(err)
+	}
+
+	if info.IsDir() {
+		return &dirFile{ctx: ctx, v: fsys.v, name: name, info: info}, nil
+	}
+
+	r, err := fsys.v.OpenSeekableFileContext(ctx, name)
+	if errors.Is(err, vault.ErrTruncated) && vault.IsTruncated(info) {
+		// Damaged files are listed and can be replaced, only reading fails
+		return &readFile{ReadSeekCloser: damagedFile{err}, info: damagedInfo{info}}, nil
+	} else if err != nil {
+		return nil, convertError(err)
+	}
+
+	return &readFile{ReadSeekCloser: r, info: info}, nil
+}
+
+func (fsys *FileSystem) RemoveAll(ctx context.Context, name string) error {
+	if cleanName(name) == "" {
+		return &fs.PathError{Op: "removeall", Path: name, Err: errors.New("cannot remove the root directory")}
+	}
+
+	return convertError(fsys.v.RemoveAllContext(ctx, name))
+}
+
+func (fsys *FileSystem) Rename(ctx context.Context, oldName, newName string) error {
+	return convertError(fsys.v.RenameContext(ctx, oldName, newName))
+}
+
+func (fsys *FileSystem) Stat(ctx context.Context, name string) (os.FileInfo, error) {
+	info, err := fsys.stat(ctx, name)
+
+	return info, convertError(err)
+}
+
+func (fsys *FileSystem) stat(ctx context.Context, name string) (fs.FileInfo, error) {
+	name = cleanName(name)
+	if name == "" {
+		return rootInfo{}, nil
+	}
+
+	return fsys.v.StatContext(ctx, name)
+}
+
+// convertError strips wrapping from not exist and exist errors, as the
+// webdav package checks them with os.IsNotExist and os.IsExist.
+func convertError(err error) error {
+	switch {
+	case err == nil:
+		return nil
+	case errors.Is(err, fs.ErrNotExist), errors.Is(err, vault.ErrNotDirectory):
+		return os.ErrNotExist
+	case errors.Is(err, fs.ErrExist):
+		return os.ErrExist
+	default:
+		return err
+	}
+}
+
+func cleanName(name string) string {
+	return strings.Trim(gopath.Clean("/"+name), "/")
+}
+
+type rootInfo struct{}
+
+func (rootInfo) Name() string       { return "/" }
+func (rootInfo) Size() int64        { return 0 }
+func (rootInfo) Mode() fs.FileMode  { return fs.ModeDir | 0o755 }
+func (rootInfo) ModTime() time.Time { return time.Time{} }
+func (rootInfo) IsDir() bool        { return true }
+func (rootInfo) Sys() any           { return nil }
+
+type readFile struct {
+	io.ReadSeekCloser
+	info fs.FileInfo
+}
+
+func (f *readFile) Readdir(count int) ([]fs.FileInfo, error) {
+	return nil, &fs.PathError{Op: "readdir", Path: f.info.Name(), Err: errors.New("not a directory")}
+}
+
+func (f *readFile) Stat() (fs.FileInfo, error) {
+	return f.info, nil
+}
+
+func (f *readFile) Write(p []byte) (int, error) {
+	return 0, &fs.PathError{Op: "write", Path: f.info.Name(), Err: fs.ErrPermission}
+}
+
+// damagedFile fails every read of a file whose ciphertext is too short to
+// be opened.
+type damagedFile struct {
+	err error
+}
+
+func (f damagedFile) Read(p []byte) (int, error)                   { return 0, f.err }
+func (f damagedFile) Seek(offset int64, whence int) (int64, error) { return 0, f.err }
+func (f damagedFile) Close() error                                 { return nil }
+
+// damagedInfo keeps the webdav package from sniffing the content type of a
+// damaged file, which would fail the whole listing.
+type damagedInfo struct {
+	fs.FileInfo
+}
+
+func (damagedInfo) ContentType(ctx context.Context) (string, error) {
+	return "application/octet-stream", nil
+}
+
+type dirFile struct {
+	ctx  context.Context
+	v    *vault.Vault
+	name string
+	info fs.FileInfo
+
+	entries []fs.FileInfo
+	read    bool
+}
+
+func (f *dirFile) Close() error {
+	return nil
+}
+
+func (f *dirFile) Read(p []byte) (int, error) {
+	return 0, &fs.PathError{Op: "read", Path: f.name, Err: errors.New("is a directory")}
+}
+
+func (f *dirFile) Seek(offset int64, whence int) (int64, error) {
+	if offset == 0 && whence == io.SeekStart {
+		f.entries, f.read = nil, false
+		return 0, nil
+	}
+
+	return 0, &fs.PathError{Op: "seek", Path: f.name, Err: errors.New("is a directory")}
+}
+
+func (f *dirFile) Readdir(count int) ([]fs.FileInfo, error) {
+	if !f.read {
+		entries, err := f.v.ReadDirContext(f.ctx, f.name)
+		if err != nil {
+			return nil, convertError(err)
+		}
+
+		for _, entry := range entries {
+			info, err := entry.Info()
+			if err != nil {
+				return nil, err
+			}
+
+			f.entries = append(f.entries, info)
+		}
+
+		f.read = true
+	}
+
+	if count <= 0 {
+		entries := f.entries
+		f.entries = nil
+		return entries, nil
+	}
+
+	if len(f.entries) == 0 {
+		return nil, io.EOF
+	}
+
+	if count > len(f.entries) {
+		count = len(f.entries)
+	}
+
+	entries := f.entries[:count]
+	f.entries = f.entries[count:]
+
+	return entries, nil
+}
+
+func (f *dirFile) Stat() (fs.FileInfo, error) {
+	return f.info, nil
+}
+
+func (f *dirFile) Write(p []byte) (int, error) {
+	return 0, &fs.PathError{Op: "write", Path: f.name, Err: errors.New("is a directory")}
+}
+
+// writeFile streams the written plaintext into the vault. An existing file
+// is only replaced on Close once everything is written, so failed uploads
+// keep it. The webdav handler closes files even if copying the request
+// body failed, so the first write or read error is kept and Close aborts
+// the upload with it instead of committing what was written so far.
+type writeFile struct {
+	name string
+	w    *io.PipeWriter
+	done chan error
+
+	size   int64
+	err    error
+	closed bool
+}
+
+func newWriteFile(ctx context.Context, v *vault.Vault, name string, exists bool) *writeFile {
+	r, w := io.Pipe()
+
+	f := &writeFile{name: name, w: w, done: make(chan error, 1)}
+
+	go func() {
+		var err error
+		if exists {
+			err = v.ReplaceFileContext(ctx, name, r)
+		} else {
+			err = v.WriteFileContext(ctx, name, r)
+		}
+
+		// Fail the writes still waiting if the vault gave up early
+		r.CloseWithError(err)
+		f.done <- err
+	}()
+
+	return f
+}
+
+func (f *writeFile) Close() error {
+	if f.closed {
+		return fs.ErrClosed
+	}
+	f.closed = true
+
+	if f.err != nil {
+		f.w.CloseWithError(f.err)
+		<-f.done
+
+		return f.err
+	}
+
+	f.w.Close()
+
+	return convertError(<-f.done)
+}
+
+func (f *writeFile) Read(p []byte) (int, error) {
+	return 0, &fs.PathError{Op: "read", Path: f.name, Err: fs.ErrPermission}
+}
+
+func (f *writeFile) Seek(offset int64, whence int) (int64, error) {
+	if offset == 0 && (whence != io.SeekStart || f.size == 0) {
+		return f.size, nil
+	}
+
+	return 0, &fs.PathError{Op: "seek", Path: f.name, Err: errors.New("not supported while writing")}
+}
+
+func (f *writeFile) Readdir(count int) ([]fs.FileInfo, error) {
+	return nil, &fs.PathError{Op: "readdir", Path: f.name, Err: errors.New("not a directory")}
+}
+
+func (f *writeFile) Stat() (fs.FileInfo, error) {
+	return writeInfo{f}, nil
+}
+
+func (f *writeFile) Write(p []byte) (int, error) {
+	if f.closed {
+		return 0, fs.ErrClosed
+	}
+
+	n, err := f.w.Write(p)
+	f.size += int64(n)
+
+	if err != nil && f.err == nil {
+		f.err = err
+	}
+
+	return n, err
+}
+
+// ReadFrom is used by io.Copy and records errors reading from r, which
+// Write would never see.
+func (f *writeFile) ReadFrom(r io.Reader) (n int64, err error) {
+	buf := make([]byte, 32*1024)
+
+	for {
+		nr, rerr := r.Read(buf)
+		if nr > 0 {
+			nw, werr := f.Write(buf[:nr])
+			n += int64(nw)
+
+			if werr != nil {
+				err = werr
+				return
+			}
+		}
+
+		if rerr == io.EOF {
+			return
+		}
+
+		if rerr != nil {
+			if f.err == nil {
+				f.err = rerr
+			}
+
+			err = rerr
+			return
+		}
+	}
+}
+
+type writeInfo struct {
+	f *writeFile
+}
+
+func (i writeInfo) Name() string       { return gopath.Base(i.f.name) }
+func (i writeInfo) Size() int64        { return i.f.size }
+func (i writeInfo) Mode() fs.FileMode  { return 0o644 }
+func (i writeInfo) ModTime() time.Time { return time.Now() }
+func (i writeInfo) IsDir() bool        { return false }
+func (i writeInfo) Sys() any           { return nil }
@@ -0,0 +1,213 @@
+package webdavserver_test
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+	"testing/iotest"
+
+	"github.com/fhilgers/gocryptomator/pkg/osfs"
+	"github.com/fhilgers/gocryptomator/pkg/vault"
+	"github.com/fhilgers/gocryptomator/pkg/webdavserver"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func newTestServer(t *testing.T) (*httptest.Server, *vault.Vault) {
+	v, err := vault.Create(osfs.New(t.TempDir()), "passphrase")
+	require.NoError(t, err)
+	require.NoError(t, v.MkRootDir())
+
+	handler := webdavserver.BasicAuth(webdavserver.NewHandler(v, ""), "user", "secret")
+
+	server := httptest.NewServer(handler)
+	t.Cleanup(server.Close)
+
+	return server, v
+}
+
+func do(t *testing.T, method, url string, body []byte, header map[string]string) (*http.Response, []byte) {
+	req, err := http.NewRequest(method, url, bytes.NewReader(body))
+	require.NoError(t, err)
+
+	req.SetBasicAuth("user", "secret")
+	for key, value := range header {
+		req.Header.Set(key, value)
+	}
+
+	resp, err := http.DefaultClient.Do(req)
+	require.NoError(t, err)
+	defer resp.Body.Close()
+
+	respBody, err := io.ReadAll(resp.Body)
+	require.NoError(t, err)
+
+	return resp, respBody
+}
+
+func TestWebdav(t *testing.T) {
+	server, v := newTestServer(t)
+
+	content := make([]byte, 100000)
+	for i := range content {
+		content[i] = byte(i % 253)
+	}
+
+	resp, _ := do(t, "MKCOL", server.URL+"/docs", nil, nil)
+	assert.Equal(t, http.StatusCreated, resp.StatusCode)
+
+	resp, _ = do(t, "MKCOL", server.URL+"/docs", nil, nil)
+	assert.Equal(t, http.StatusMethodNotAllowed, resp.StatusCode)
+
+	resp, _ = do(t, http.MethodPut, server.URL+"/docs/a.bin", content, nil)
+	assert.Equal(t, http.StatusCreated, resp.StatusCode)
+
+	resp, _ = do(t, http.MethodPut, server.URL+"/missing/a.bin", content, nil)
+	assert.Equal(t, http.StatusNotFound, resp.StatusCode)
+
+	resp, body := do(t, http.MethodGet, server.URL+"/docs/a.bin", nil, nil)
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Equal(t, content, body)
+
+	resp, body = do(t, http.MethodGet, server.URL+"/docs/a.bin", nil, map[string]string{"Range": "bytes=32760-32780"})
+	assert.Equal(t, http.StatusPartialContent, resp.StatusCode)
+	assert.Equal(t, content[32760:32781], body)
+
+	resp, body = do(t, "PROPFIND", server.URL+"/docs/", nil, map[string]string{"Depth": "1"})
+	assert.Equal(t, http.StatusMultiStatus, resp.StatusCode)
+	assert.Contains(t, string(body), "/docs/a.bin")
+	assert.Contains(t, string(body), "<D:getcontentlength>100000</D:getcontentlength>")
+
+	resp, _ = do(t, "MOVE", server.URL+"/docs/a.bin", nil, map[string]string{"Destination": server.URL + "/b.bin"})
+	assert.Equal(t, http.StatusCreated, resp.StatusCode)
+
+	resp, _ = do(t, http.MethodPut, server.URL+"/b.bin", []byte("replaced"), nil)
+	assert.Equal(t, http.StatusCreated, resp.StatusCode)
+
+	r, err := v.OpenFile("b.bin")
+	require.NoError(t, err)
+	replaced, err := io.ReadAll(r)
+	require.NoError(t, err)
+	assert.Equal(t, "replaced", string(replaced))
+	r.Close()
+
+	resp, _ = do(t, http.MethodDelete, server.URL+"/docs", nil, nil)
+	assert.Equal(t, http.StatusNoContent, resp.StatusCode)
+
+	resp, _ = do(t, http.MethodGet, server.URL+"/docs/a.bin", nil, nil)
+	assert.Equal(t, http.StatusNotFound, resp.StatusCode)
+}
+
+func TestBasicAuth(t *testing.T) {
+	server, _ := newTestServer(t)
+
+	resp, err := http.Get(server.URL + "/")
+	require.NoError(t, err)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusUnauthorized, resp.StatusCode)
+
+	resp, body := do(t, "PROPFIND", server.URL+"/", nil, map[string]string{"Depth": "0"})
+	assert.Equal(t, http.StatusMultiStatus, resp.StatusCode)
+	assert.True(t, strings.Contains(string(body), "<D:collection"))
+}
+
+func TestFailedOverwrite(t *testing.T) {
+	_, v := newTestServer(t)
+	fsys := webdavserver.NewFileSystem(v)
+
+	require.NoError(t, v.WriteFile("file", strings.NewReader("original")))
+
+	ctx, cancel := context.WithCancel(context.Background())
+
+	f, err := fsys.OpenFile(ctx, "/file", os.O_WRONLY|os.O_TRUNC, 0)
+	require.NoError(t, err)
+
+	_, err = f.Write(bytes.Repeat([]byte("x"), 100000))
+	require.NoError(t, err)
+
+	cancel()
+	assert.Error(t, f.Close())
+
+	r, err := v.OpenFile("file")
+	require.NoError(t, err)
+	defer r.Close()
+
+	content, err := io.ReadAll(r)
+	require.NoError(t, err)
+	assert.Equal(t, "original", string(content))
+}
+
+func TestFailedUpload(t *testing.T) {
+	_, v := newTestServer(t)
+	fsys := webdavserver.NewFileSystem(v)
+
+	require.NoError(t, v.WriteFile("file", strings.NewReader("original")))
+
+	errReset := errors.New("connection reset")
+	body := func() io.Reader {
+		return io.MultiReader(strings.NewReader("partial"), iotest.ErrReader(errReset))
+	}
+
+	// Mirrors the PUT handler, which closes the file after a failed copy
+	f, err := fsys.OpenFile(context.Background(), "/file", os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0)
+	require.NoError(t, err)
+
+	_, err = io.Copy(f, body())
+	assert.ErrorIs(t, err, errReset)
+	assert.ErrorIs(t, f.Close(), errReset)
+
+	r, err := v.OpenFile("file")
+	require.NoError(t, err)
+	defer r.Close()
+
+	content, err := io.ReadAll(r)
+	require.NoError(t, err)
+	assert.Equal(t, "original", string(content))
+
+	f, err = fsys.OpenFile(context.Background(), "/new", os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0)
+	require.NoError(t, err)
+
+	_, err = io.Copy(f, body())
+	assert.ErrorIs(t, err, errReset)
+	assert.ErrorIs(t, f.Close(), errReset)
+
+	_, err = v.Stat("new")
+	assert.ErrorIs(t, err, os.ErrNotExist)
+}
+
+func TestDamagedFile(t *testing.T) {
+	storage := osfs.New(t.TempDir())
+
+	v, err := vault.Create(storage, "passphrase")
+	require.NoError(t, err)
+	require.NoError(t, v.MkRootDir())
+	require.NoError(t, v.WriteFile("file", strings.NewReader("original")))
+
+	server := httptest.NewServer(webdavserver.NewHandler(v, ""))
+	defer server.Close()
+
+	encrypted, _, err := v.GetFilePath("file")
+	require.NoError(t, err)
+	require.NoError(t, os.Truncate(storage.Root()+"/"+encrypted, 10))
+
+	// Damaged files are listed like Stat reports them and can be replaced
+	resp, body := do(t, "PROPFIND", server.URL+"/", nil, map[string]string{"Depth": "1"})
+	assert.Equal(t, http.StatusMultiStatus, resp.StatusCode)
+	assert.Contains(t, string(body), "<D:getcontentlength>0</D:getcontentlength>")
+
+	resp, _ = do(t, http.MethodGet, server.URL+"/file", nil, nil)
+	assert.Equal(t, http.StatusInternalServerError, resp.StatusCode)
+
+	resp, _ = do(t, http.MethodPut, server.URL+"/file", []byte("replaced"), nil)
+	assert.Equal(t, http.StatusCreated, resp.StatusCode)
+
+	resp, body = do(t, http.MethodGet, server.URL+"/file", nil, nil)
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Equal(t, "replaced", string(body))
+}